@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireAdmin only lets through requests carrying the ADMIN_TOKEN as a
+// bearer token.
+func requireAdmin(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isAdmin(c, adminToken) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin token required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func isAdmin(c *gin.Context, adminToken string) bool {
+	if adminToken == "" {
+		return false
+	}
+	got := []byte(c.GetHeader("Authorization"))
+	return subtle.ConstantTimeCompare(got, []byte("Bearer "+adminToken)) == 1
+}
+
+// refreshRequested reports whether the request has ?refresh=1, which
+// throws away the cached blob and conversion of the video. As that is an
+// ops escape hatch, it needs the admin token, otherwise the request is
+// aborted and ok is false.
+func (s *State) refreshRequested(c *gin.Context) (refresh, ok bool) {
+	if c.Query("refresh") != "1" {
+		return false, true
+	}
+	if !isAdmin(c, s.config.AdminToken) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "refresh requires the admin token"})
+		return false, false
+	}
+	return true, true
+}
+
+// refresh invalidates a video before handling the request, answering
+// 409 if it is being converted.
+func (s *State) refresh(c *gin.Context, did, cid string) bool {
+	if err := s.cm.invalidate(did, cid); err != nil {
+		if errors.Is(err, errInvalidateRunning) {
+			c.AbortWithError(http.StatusConflict, err)
+			return false
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+	log.Printf("Refreshing %s/%s", did, cid)
+	return true
+}
+
+// retainedSource is the uploaded video of a failed job, kept around so the
+// job can be retried without the client uploading it again. The upload's
+// authorization isn't kept, a retry brings a new one.
+type retainedSource struct {
+	path string
+	size int64
+	// the uploader, for deleteUserData
+	did        string
+	retainedAt time.Time
+}
+
+// retainSource keeps the body of a failed job on disk for
+// FailedSourceRetention, after which it is deleted. Past
+// FailedSourceMaxBytes, the oldest sources are deleted early.
+func (s *State) retainSource(job Job, body []byte) {
+	if s.config.FailedSourceRetention <= 0 || int64(len(body)) > s.config.FailedSourceMaxBytes {
+		return
+	}
+	file, err := s.config.createTemp(fmt.Sprintf("source_%s_*", job.ID))
+	if err != nil {
+		log.Printf("Failed to retain source of job %s: %s", job.ID, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(body); err != nil {
+		log.Printf("Failed to retain source of job %s: %s", job.ID, err)
+		os.Remove(file.Name())
+		return
+	}
+
+	source := &retainedSource{path: file.Name(), size: int64(len(body)), did: job.userDID, retainedAt: time.Now()}
+	s.failedSources.Store(job.ID, source)
+	time.AfterFunc(s.config.FailedSourceRetention, func() {
+		// a retry may have already taken this source
+		if s.failedSources.CompareAndDelete(job.ID, source) {
+			os.Remove(source.path)
+		}
+	})
+	s.pruneRetainedSources()
+}
+
+// pruneRetainedSources deletes the oldest retained sources until they take
+// at most FailedSourceMaxBytes.
+func (s *State) pruneRetainedSources() {
+	s.failedSourcesMu.Lock()
+	defer s.failedSourcesMu.Unlock()
+	type retained struct {
+		id     string
+		source *retainedSource
+	}
+	var sources []retained
+	total := int64(0)
+	s.failedSources.Range(func(idA, sourceA any) bool {
+		source := sourceA.(*retainedSource)
+		sources = append(sources, retained{idA.(string), source})
+		total += source.size
+		return true
+	})
+	slices.SortFunc(sources, func(a, b retained) int { return a.source.retainedAt.Compare(b.source.retainedAt) })
+	for _, r := range sources {
+		if total <= s.config.FailedSourceMaxBytes {
+			break
+		}
+		if s.failedSources.CompareAndDelete(r.id, r.source) {
+			os.Remove(r.source.path)
+			log.Printf("Deleted the retained source of job %s early, FAILED_SOURCE_MAX_BYTES reached", r.id)
+		}
+		total -= r.source.size
+	}
+}
+
+// retryJob runs a failed job again from its retained source. Uploading to
+// the PDS needs a new authorization of the uploader, given as the
+// Upload-Authorization header, as the original one isn't kept.
+func (s *State) retryJob(c *gin.Context) {
+	jobID := c.Param("id")
+	token := c.GetHeader("Upload-Authorization")
+	if token == "" && s.config.UploadMode != "local" {
+		c.AbortWithError(http.StatusBadRequest, errors.New("Upload-Authorization with a token of the uploader is required"))
+		return
+	}
+	job, err := s.storage.jobs.GetJob(jobID)
+	if errors.Is(err, errJobNotFound) {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if job.state != "JOB_STATE_FAILED" {
+		c.AbortWithError(http.StatusConflict, fmt.Errorf("job %s is not failed", jobID))
+		return
+	}
+
+	// the source is gone once taken, don't take it for a full queue
+	if s.queue.full() {
+		c.Header("Retry-After", fmt.Sprintf("%.0f", uploadQueueRetryAfter.Seconds()))
+		c.AbortWithError(http.StatusServiceUnavailable, errQueueFull)
+		return
+	}
+	sourceA, ok := s.failedSources.LoadAndDelete(jobID)
+	if !ok {
+		c.AbortWithError(http.StatusGone, fmt.Errorf("source of job %s is no longer available", jobID))
+		return
+	}
+	source := sourceA.(*retainedSource)
+	body, err := os.ReadFile(source.path)
+	os.Remove(source.path)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	job.token = token
+	job.state = "JOB_STATE_CREATED"
+	job.progress = 0
+	job.err = nil
+	s.update(*job)
+	s.queueJob(c, *job, body)
+}
+
+// getConversionStatus reports the state of the conversion and thumbnails
+// of a video, with the end of the ffmpeg output of those that failed.
+func (s *State) getConversionStatus(c *gin.Context) {
+	did := c.Param("did")
+	cid := c.Param("cid")
+
+	type status struct {
+		Kind         string     `json:"kind"`
+		Running      bool       `json:"running"`
+		Error        string     `json:"error,omitempty"`
+		ErrorKind    string     `json:"errorKind,omitempty"`
+		FFmpegOutput string     `json:"ffmpegOutput,omitempty"`
+		FailedAt     *time.Time `json:"failedAt,omitempty"`
+		// where the output and ffmpeg log of the failure are kept, see
+		// FAILED_CONVERSION_RETENTION
+		Retained string `json:"retained,omitempty"`
+	}
+	newStatus := func(kind string, running bool, err error, output string, failedAt time.Time) status {
+		st := status{Kind: kind, Running: running, FFmpegOutput: output}
+		if err != nil {
+			st.Error = err.Error()
+			st.FailedAt = &failedAt
+			var convErr *ConversionError
+			if errors.As(err, &convErr) {
+				st.ErrorKind = convErr.Kind.String()
+			}
+		}
+		return st
+	}
+
+	statuses := make([]status, 0)
+	if convA, ok := s.cm.conversions.Load(fmt.Sprintf("%s/%s", did, cid)); ok {
+		conv := convA.(*Conversion)
+		conv.mu.Lock()
+		st := newStatus("hls", conv.Converting, conv.Error, conv.FFmpegOutput, conv.FailedAt)
+		st.Retained = s.cm.retainedFailure(conv)
+		statuses = append(statuses, st)
+		conv.mu.Unlock()
+	}
+	prefix := thumbnailKeyPrefix(did, cid)
+	s.cm.thumbnails.Range(func(keyA, thumbA any) bool {
+		if key := keyA.(string); strings.HasPrefix(key, prefix) {
+			thumb := thumbA.(*Thumbnail)
+			thumb.mu.Lock()
+			statuses = append(statuses, newStatus("thumbnail:"+strings.TrimPrefix(key, prefix), thumb.Generating, thumb.Error, thumb.FFmpegOutput, thumb.FailedAt))
+			thumb.mu.Unlock()
+		}
+		return true
+	})
+
+	if len(statuses) == 0 {
+		c.AbortWithError(http.StatusNotFound, errors.New("no conversion of this video"))
+		return
+	}
+	c.JSON(http.StatusOK, statuses)
+}
+
+// flush clears the caches, skipping conversions and thumbnails that are
+// in progress, being served or pinned.
+func (s *State) flush(c *gin.Context) {
+	conversions, thumbnails, blobs := s.cm.flush()
+	flushedDIDs := false
+	if resolver, ok := s.storage.resolver.(flushableResolver); ok {
+		resolver.Flush()
+		flushedDIDs = true
+	}
+	log.Printf("Flushed %d conversions, %d thumbnails and %d blobs", conversions, thumbnails, blobs)
+	c.JSON(http.StatusOK, gin.H{
+		"conversions": conversions,
+		"thumbnails":  thumbnails,
+		"blobs":       blobs,
+		"didCache":    flushedDIDs,
+	})
+}
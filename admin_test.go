@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetainSourceLimit(t *testing.T) {
+	config := testConfig(t)
+	config.FailedSourceRetention = time.Hour
+	config.FailedSourceMaxBytes = 10
+	s := &State{config: config}
+
+	for i := range 3 {
+		s.retainSource(Job{ID: fmt.Sprintf("job%d", i), userDID: "did:plc:a", token: "Bearer secret"}, []byte("12345"))
+	}
+	if _, ok := s.failedSources.Load("job0"); ok {
+		t.Errorf("expected the oldest source to be deleted past FAILED_SOURCE_MAX_BYTES")
+	}
+	for _, id := range []string{"job1", "job2"} {
+		sourceA, ok := s.failedSources.Load(id)
+		if !ok {
+			t.Fatalf("expected %s to be retained", id)
+		}
+		if _, err := os.Stat(sourceA.(*retainedSource).path); err != nil {
+			t.Errorf("retained source of %s: %s", id, err)
+		}
+	}
+	s.retainSource(Job{ID: "large"}, make([]byte, 11))
+	if _, ok := s.failedSources.Load("large"); ok {
+		t.Errorf("expected a source larger than FAILED_SOURCE_MAX_BYTES not to be retained")
+	}
+	s.deleteRetainedSources("did:plc:a")
+}
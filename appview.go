@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// AppviewPool tracks the health of the appviews we download blobs from.
+// Appviews that recently failed are only tried after the healthy ones.
+type AppviewPool struct {
+	urls     []string
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	failedAt map[string]time.Time
+}
+
+func NewAppviewPool(urls []string, cooldown time.Duration) *AppviewPool {
+	return &AppviewPool{
+		urls:     urls,
+		cooldown: cooldown,
+		failedAt: make(map[string]time.Time),
+	}
+}
+
+// candidates returns the appviews in the order they should be tried:
+// configuration order, with the ones in their failure cooldown last.
+func (p *AppviewPool) candidates() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	healthy := make([]string, 0, len(p.urls))
+	failing := make([]string, 0)
+	for _, url := range p.urls {
+		if failedAt, ok := p.failedAt[url]; ok && time.Since(failedAt) < p.cooldown {
+			failing = append(failing, url)
+		} else {
+			healthy = append(healthy, url)
+		}
+	}
+	return append(healthy, failing...)
+}
+
+func (p *AppviewPool) markFailed(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failedAt[url] = time.Now()
+}
+
+func (p *AppviewPool) markHealthy(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.failedAt, url)
+}
+
+// HTTPStatusError is a non-200 response from an upstream server.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", e.StatusCode)
+}
+
+var errHostNotAllowed = errors.New("host not allowed")
+
+// errBlobNotFound is returned when every appview answered 404 for a blob.
+var errBlobNotFound = errors.New("blob not found")
+
+// blobGuard guards against downloading blobs from anywhere but the allowed
+// hosts, so that a URL built from request input can't be used to make us
+// fetch arbitrary (e.g. internal) addresses. Its client checks redirects
+// too, and with no allowed hosts it refuses to connect to addresses that
+// aren't public, as a public looking name may resolve to anything.
+type blobGuard struct {
+	// nil for any public https host
+	hosts  []string
+	client *http.Client
+}
+
+// maxBlobRedirects is how many redirects are followed fetching a blob.
+const maxBlobRedirects = 10
+
+func newBlobGuard(hosts []string) *blobGuard {
+	g := &blobGuard{hosts: hosts}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if hosts == nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refuseNonPublicAddress}
+		transport.DialContext = dialer.DialContext
+		// a proxy would be dialed instead of the host
+		transport.Proxy = nil
+	}
+	g.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxBlobRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxBlobRedirects)
+			}
+			return g.checkBlobHost(req.URL.String())
+		},
+	}
+	return g
+}
+
+// checkBlobHost checks that sourceURL is on an allowed host.
+func (g *blobGuard) checkBlobHost(sourceURL string) error {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return fmt.Errorf("invalid blob url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %q", errHostNotAllowed, u.Scheme)
+	}
+	if g.hosts == nil {
+		// any PDS, as long as it looks public
+		hostname := u.Hostname()
+		if u.Scheme != "https" || net.ParseIP(hostname) != nil || hostname == "localhost" || !strings.Contains(hostname, ".") {
+			return fmt.Errorf("%w: %s is not a public https host", errHostNotAllowed, u.Host)
+		}
+		return nil
+	}
+	if !slices.Contains(g.hosts, u.Host) {
+		return fmt.Errorf("%w: %s", errHostNotAllowed, u.Host)
+	}
+	return nil
+}
+
+// refuseNonPublicAddress is a net.Dialer Control refusing to connect to
+// loopback, private, link-local and other non public addresses.
+func refuseNonPublicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errHostNotAllowed, address)
+	}
+	if !isPublicAddr(ip) {
+		return fmt.Errorf("%w: %s is not a public address", errHostNotAllowed, ip)
+	}
+	return nil
+}
+
+// carrier-grade NAT, shared address space
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+var blobSources = []string{"appview", "pds"}
+
+// appviewBlobURL is where an appview serves the blob did/cid.
+func appviewBlobURL(appviewURL, did, cid string) string {
+	return fmt.Sprintf("%s/blob/%s/%s", appviewURL, did, cid)
+}
+
+// pdsBlobURL is where a PDS serves the blob did/cid.
+func pdsBlobURL(pdsURL, did, cid string) string {
+	query := url.Values{"did": {did}, "cid": {cid}}
+	return fmt.Sprintf("%s/xrpc/com.atproto.sync.getBlob?%s", strings.TrimRight(pdsURL, "/"), query.Encode())
+}
+
+// downloadFromPDS downloads the blob did/cid from the PDS of did, sending
+// authorization if set.
+func (cm *ConversionManager) downloadFromPDS(ctx context.Context, did, cid, authorization string) (string, error) {
+	pdsURL, err := cm.userPDS(ctx, did)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the PDS of %s: %w", did, err)
+	}
+	path, err := cm.downloadBlob(ctx, cm.pdsBlobs, pdsBlobURL(pdsURL, did, cid), authorization)
+	if err != nil {
+		return "", pdsBlobError(pdsURL, err)
+	}
+	return path, nil
+}
+
+// streamSource returns the URL the blob did/cid can be streamed from, and
+// the guard to fetch it with: the first appview that has it, or the PDS of
+// did.
+func (cm *ConversionManager) streamSource(ctx context.Context, did, cid string) (string, *blobGuard, error) {
+	if cm.config.BlobSource == "pds" {
+		pdsURL, err := cm.userPDS(ctx, did)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to find the PDS of %s: %w", did, err)
+		}
+		sourceURL := pdsBlobURL(pdsURL, did, cid)
+		if err := cm.checkSource(ctx, cm.blobs, sourceURL, ""); err != nil {
+			return "", nil, pdsBlobError(pdsURL, err)
+		}
+		return sourceURL, cm.blobs, nil
+	}
+
+	var sourceURL string
+	err := cm.tryAppviews(ctx, func(appviewURL string) error {
+		sourceURL = appviewBlobURL(appviewURL, did, cid)
+		return cm.checkSource(ctx, cm.blobs, sourceURL, "")
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return sourceURL, cm.blobs, nil
+}
+
+// tryAppviews calls try with each appview, healthy ones first, until one
+// succeeds. Only network errors and 5xx responses count as appview
+// failures, a 404 just means that appview doesn't have the blob, and
+// errBlobNotFound is returned if none has it.
+func (cm *ConversionManager) tryAppviews(ctx context.Context, try func(appviewURL string) error) error {
+	var errs []error
+	notFound := 0
+	for _, appviewURL := range cm.appviews.candidates() {
+		err := try(appviewURL)
+		if err == nil {
+			cm.appviews.markHealthy(appviewURL)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var statusErr *HTTPStatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode >= 500 {
+			log.Printf("Appview %s failed: %s", appviewURL, err)
+			cm.appviews.markFailed(appviewURL)
+		} else if statusErr.StatusCode == http.StatusNotFound {
+			notFound++
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", appviewURL, err))
+	}
+	if len(errs) == 0 {
+		return errors.New("no appview configured")
+	}
+	if notFound == len(errs) {
+		return fmt.Errorf("%w: %w", errBlobNotFound, errors.Join(errs...))
+	}
+	return errors.Join(errs...)
+}
+
+// checkSource checks that sourceURL is allowed by guard and serves a blob,
+// by fetching its first byte, sending authorization if set.
+func (cm *ConversionManager) checkSource(ctx context.Context, guard *blobGuard, sourceURL, authorization string) error {
+	if err := guard.checkBlobHost(sourceURL); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", sourceURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := guard.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// downloadSource downloads the blob did/cid from the first appview that
+// has it, see tryAppviews.
+func (cm *ConversionManager) downloadSource(ctx context.Context, did, cid string) (string, error) {
+	if path, ok := cm.localSourceFile(did, cid); ok {
+		return path, nil
+	}
+
+	select {
+	case cm.downloadSlots <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	cm.downloadsInFlight.Add(1)
+	defer func() {
+		cm.downloadsInFlight.Add(-1)
+		<-cm.downloadSlots
+	}()
+
+	// with PDS_BLOB_AUTH, a watch request downloads from the PDS on behalf
+	// of its requester, and falls back to the usual source if it can't
+	if authorization := blobAuth(ctx); authorization != "" {
+		path, err := cm.downloadFromPDS(ctx, did, cid, authorization)
+		if err == nil {
+			if cm.blobCache != nil {
+				cm.blobCache.put(cid, path)
+			}
+			return path, nil
+		}
+		if errors.Is(err, errBlobNotFound) || ctx.Err() != nil {
+			return "", err
+		}
+		log.Printf("PDS download of %s/%s failed, falling back: %s", did, cid, err)
+	}
+
+	if cm.config.BlobSource == "pds" {
+		path, err := cm.downloadFromPDS(ctx, did, cid, "")
+		if err == nil && cm.blobCache != nil {
+			cm.blobCache.put(cid, path)
+		}
+		return path, err
+	}
+
+	var path string
+	err := cm.tryAppviews(ctx, func(appviewURL string) (err error) {
+		path, err = cm.downloadBlob(ctx, cm.blobs, appviewBlobURL(appviewURL, did, cid), "")
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if cm.blobCache != nil {
+		cm.blobCache.put(cid, path)
+	}
+	return path, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCheckBlobHost(t *testing.T) {
+	open := newBlobGuard(nil)
+	allowlist := newBlobGuard([]string{"cdn.example.com", "127.0.0.1:8080"})
+	tests := []struct {
+		guard   *blobGuard
+		url     string
+		allowed bool
+	}{
+		{open, "https://pds.example.com/xrpc/com.atproto.sync.getBlob", true},
+		{open, "https://pds.example.com:8443/blob", true},
+		{open, "http://pds.example.com/blob", false},
+		{open, "https://127.0.0.1/blob", false},
+		{open, "https://[::1]/blob", false},
+		{open, "https://localhost/blob", false},
+		{open, "https://intranet/blob", false},
+		{open, "file:///etc/passwd", false},
+		{allowlist, "https://cdn.example.com/blob", true},
+		{allowlist, "http://127.0.0.1:8080/blob", true},
+		{allowlist, "http://127.0.0.1:8081/blob", false},
+		{allowlist, "https://pds.example.com/blob", false},
+		{allowlist, "gopher://cdn.example.com/blob", false},
+	}
+	for _, test := range tests {
+		err := test.guard.checkBlobHost(test.url)
+		if test.allowed && err != nil {
+			t.Errorf("%s: expected allowed, got %s", test.url, err)
+		}
+		if !test.allowed && !errors.Is(err, errHostNotAllowed) {
+			t.Errorf("%s: expected errHostNotAllowed, got %v", test.url, err)
+		}
+	}
+}
+
+func TestRefuseNonPublicAddress(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.215.14:443":        true,
+		"[2606:2800:21f::1]:443":   true,
+		"127.0.0.1:443":            false,
+		"10.1.2.3:443":             false,
+		"172.16.0.1:443":           false,
+		"192.168.1.1:443":          false,
+		"169.254.169.254:80":       false,
+		"100.64.0.1:443":           false,
+		"0.0.0.0:443":              false,
+		"[::1]:443":                false,
+		"[fe80::1]:443":            false,
+		"[fd00::1]:443":            false,
+		"[::ffff:127.0.0.1]:443":   false,
+		"[::ffff:93.184.215.14]:1": true,
+	}
+	for address, public := range tests {
+		err := refuseNonPublicAddress("tcp", address, nil)
+		if public && err != nil {
+			t.Errorf("%s: expected allowed, got %s", address, err)
+		}
+		if !public && !errors.Is(err, errHostNotAllowed) {
+			t.Errorf("%s: expected errHostNotAllowed, got %v", address, err)
+		}
+	}
+}
+
+func TestBlobGuardRedirect(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer internal.Close()
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/local" {
+			w.Write([]byte("blob"))
+			return
+		}
+		target := internal.URL
+		if r.URL.Path == "/same" {
+			target = "/local"
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+	defer allowed.Close()
+
+	allowedURL, _ := url.Parse(allowed.URL)
+	guard := newBlobGuard([]string{allowedURL.Host})
+
+	resp, err := guard.client.Get(allowed.URL + "/same")
+	if err != nil {
+		t.Fatalf("redirect to an allowed host: %s", err)
+	}
+	resp.Body.Close()
+
+	_, err = guard.client.Get(allowed.URL + "/elsewhere")
+	if !errors.Is(err, errHostNotAllowed) {
+		t.Fatalf("redirect to another host: expected errHostNotAllowed, got %v", err)
+	}
+}
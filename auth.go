@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"time"
 
@@ -49,7 +49,13 @@ type Auth struct {
 	KeyCache    *lru.ARCCache[string, KeyCacheEntry]
 	KeyCacheTTL time.Duration
 	ServiceDID  string
-	Dir         *identity.CacheDirectory
+	Dir         identity.Directory
+	// uploads are kept by douga instead of sent to a PDS, so service auth
+	// tokens for them must be meant for douga itself
+	LocalUploads bool
+	// where the metadata and keys of OAuth authorization servers are
+	// fetched from, for DPoP tokens
+	OAuthServers *blobGuard
 }
 
 // NewAuth creates a new Auth instance with the given key cache size and TTL
@@ -76,10 +82,7 @@ func NewAuth(
 		Transport: otelhttp.NewTransport(http.DefaultTransport),
 	}
 
-	plcUrl := os.Getenv("ATPROTO_PLC_URL")
-	if plcUrl == "" {
-		plcUrl = "https://plc.directory"
-	}
+	plcUrl := getEnvOrDefault("ATPROTO_PLC_URL", "https://plc.directory")
 
 	baseDir := identity.BaseDirectory{
 		PLCURL:              plcUrl,
@@ -92,10 +95,11 @@ func NewAuth(
 	dir := identity.NewCacheDirectory(&baseDir, keyCacheSize, keyCacheTTL, time.Minute*2, keyCacheTTL)
 
 	return &Auth{
-		KeyCache:    keyCache,
-		KeyCacheTTL: keyCacheTTL,
-		ServiceDID:  serviceDID,
-		Dir:         &dir,
+		KeyCache:     keyCache,
+		KeyCacheTTL:  keyCacheTTL,
+		ServiceDID:   serviceDID,
+		Dir:          &dir,
+		OAuthServers: newBlobGuard(nil),
 	}, nil
 }
 
@@ -215,3 +219,108 @@ func (auth *Auth) AuthenticateGinRequestViaJWT(c *gin.Context) {
 	span.End()
 	c.Next()
 }
+
+// AuthenticateUploader authenticates uploads like
+// AuthenticateGinRequestViaJWT, setting the uploader's DID as user_did.
+// Upload tokens are forwarded to the PDS of the uploader to store the
+// video there, so they may also be meant for that PDS, but not for any
+// other service: those could replay the tokens they were given here.
+// With LocalUploads, OAuth access tokens are accepted as well, see
+// verifyDPoP.
+func (auth *Auth) AuthenticateUploader(c *gin.Context) {
+	tracer := otel.Tracer("auth")
+	ctx, span := tracer.Start(c.Request.Context(), "Auth:AuthenticateUploader")
+	defer span.End()
+
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		c.Next()
+		return
+	}
+
+	if scheme, token, _ := strings.Cut(authHeader, " "); strings.EqualFold(scheme, "DPoP") {
+		// DPoP proofs are only valid for the request they were made for,
+		// so the PDS would need one of its own
+		if !auth.LocalUploads {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "DPoP tokens can't be forwarded to the PDS, use a service auth token"})
+			c.Abort()
+			return
+		}
+		did, err := auth.verifyDPoP(ctx, c.Request, token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Errorf("Invalid DPoP token: %v", err).Error()})
+			c.Abort()
+			return
+		}
+		c.Set("user_did", did)
+		span.SetAttributes(attribute.String("user.did", did))
+		c.Next()
+		return
+	}
+
+	claims := jwt.StandardClaims{}
+	err := auth.GetClaimsFromAuthHeader(ctx, authHeader, &claims)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Errorf("Failed to get claims from auth header: %v", err).Error()})
+		c.Abort()
+		return
+	}
+
+	if claims.Audience != auth.ServiceDID {
+		if auth.LocalUploads {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Invalid audience (expected %s)", auth.ServiceDID)})
+			c.Abort()
+			return
+		}
+		if err := auth.checkPDSAudience(ctx, claims.Issuer, claims.Audience); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("Invalid audience (expected %s or the PDS of %s): %v", auth.ServiceDID, claims.Issuer, err)})
+			c.Abort()
+			return
+		}
+	}
+
+	c.Set("user_did", claims.Issuer)
+	span.SetAttributes(attribute.String("user.did", claims.Issuer))
+	c.Next()
+}
+
+// checkPDSAudience checks that audience is the did:web of the PDS in the
+// DID document of did.
+func (auth *Auth) checkPDSAudience(ctx context.Context, did, audience string) error {
+	// service DIDs may name one of their services, e.g. #atproto_pds
+	aud, _, _ := strings.Cut(audience, "#")
+	host, ok := strings.CutPrefix(aud, "did:web:")
+	if !ok || host == "" {
+		return fmt.Errorf("audience %q isn't a did:web", audience)
+	}
+	// did:web encodes ports as %3A
+	host, err := url.PathUnescape(host)
+	if err != nil {
+		return fmt.Errorf("invalid audience %q: %w", audience, err)
+	}
+	pds, err := auth.pdsURL(ctx, did)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(host, pds.Host) {
+		return fmt.Errorf("audience %s isn't the PDS of %s at %s", audience, did, pds.Host)
+	}
+	return nil
+}
+
+// pdsURL returns the URL of the PDS in the DID document of did.
+func (auth *Auth) pdsURL(ctx context.Context, did string) (*url.URL, error) {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse user DID: %v", err)
+	}
+	id, err := auth.Dir.LookupDID(ctx, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lookup user DID: %v", err)
+	}
+	u, err := url.Parse(id.PDSEndpoint())
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%s has no PDS", did)
+	}
+	return u, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"gitlab.com/yawning/secp256k1-voi/secec"
+)
+
+// testAuth is an Auth knowing the key of did, so that tokens signed with
+// the returned key verify without resolving the DID. did is on the PDS
+// pds.example.com.
+func testAuth(t *testing.T, did string) (*Auth, *secec.PrivateKey) {
+	t.Helper()
+	auth, err := NewAuth(10, time.Hour, 1, "did:web:douga.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := secec.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.KeyCache.Add(did, KeyCacheEntry{Key: key.PublicKey(), ExpiresAt: time.Now().Add(time.Hour)})
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:      syntax.DID(did),
+		Handle:   syntax.HandleInvalid,
+		Services: map[string]identity.Service{"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: "https://pds.example.com"}},
+	})
+	auth.Dir = &dir
+	return auth, key
+}
+
+// signES256K makes a token like the service auth tokens of PDSes, which
+// the jwt library can only verify.
+func signES256K(t *testing.T, key *secec.PrivateKey, claims jwt.StandardClaims) string {
+	t.Helper()
+	signingString, err := jwt.NewWithClaims(jwt.GetSigningMethod("ES256K"), claims).SigningString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(signingString))
+	sig, err := key.Sign(rand.Reader, digest[:], &secec.ECDSAOptions{Hash: crypto.SHA256, Encoding: secec.EncodingCompact})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + signingString + "." + jwt.EncodeSegment(sig)
+}
+
+func TestAuthenticateUploader(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	auth, key := testAuth(t, did)
+	_, otherKey := testAuth(t, did)
+	exp := time.Now().Add(time.Minute).Unix()
+
+	r := gin.New()
+	r.POST("/upload", auth.AuthenticateUploader, func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("user_did"))
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"for douga", signES256K(t, key, jwt.StandardClaims{Issuer: did, Audience: "did:web:douga.example.com", ExpiresAt: exp}), http.StatusOK},
+		{"for their PDS", signES256K(t, key, jwt.StandardClaims{Issuer: did, Audience: "did:web:pds.example.com", ExpiresAt: exp}), http.StatusOK},
+		{"for their PDS service", signES256K(t, key, jwt.StandardClaims{Issuer: did, Audience: "did:web:pds.example.com#atproto_pds", ExpiresAt: exp}), http.StatusOK},
+		{"for another did:web", signES256K(t, key, jwt.StandardClaims{Issuer: did, Audience: "did:web:feeds.example.com", ExpiresAt: exp}), http.StatusUnauthorized},
+		{"for another DID", signES256K(t, key, jwt.StandardClaims{Issuer: did, Audience: "did:plc:other", ExpiresAt: exp}), http.StatusUnauthorized},
+		{"expired", signES256K(t, key, jwt.StandardClaims{Issuer: did, Audience: "did:web:douga.example.com", ExpiresAt: time.Now().Add(-time.Minute).Unix()}), http.StatusUnauthorized},
+		{"forged", signES256K(t, otherKey, jwt.StandardClaims{Issuer: did, Audience: "did:web:douga.example.com", ExpiresAt: exp}), http.StatusUnauthorized},
+		{"unsigned", "Bearer " + strings.Join(strings.Split(signES256K(t, key, jwt.StandardClaims{Issuer: did, ExpiresAt: exp}), ".")[:2], ".") + ".", http.StatusUnauthorized},
+		{"anonymous", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/upload", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, expected %d: %s", test.name, w.Code, test.status, w.Body)
+			continue
+		}
+		// only verified tokens name the uploader
+		if w.Code == http.StatusOK && test.authorization != "" && w.Body.String() != did {
+			t.Errorf("%s: got uploader %q, expected %s", test.name, w.Body, did)
+		}
+	}
+
+	// local uploads never reach the PDS, their tokens must be meant for us
+	auth.LocalUploads = true
+	req := httptest.NewRequest("POST", "/upload", nil)
+	req.Header.Set("Authorization", tests[1].authorization)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("local upload with a token for the PDS: got %d, expected 401", w.Code)
+	}
+}
+
+func TestUploadWithoutAuthorization(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	auth, _ := testAuth(t, "did:plc:ewvi7nxzyoun6zhxrhs64oiz")
+	s := &State{config: Config{MaxUploadBytes: 1 << 20, AllowedUploadTypes: "video/mp4"}}
+	r := gin.New()
+	r.POST("/xrpc/app.bsky.video.uploadVideo", auth.AuthenticateUploader, s.uploadVideo)
+
+	for _, authorization := range []string{"", "Bearer", "Basic dXNlcjpwYXNz", "Bearer not.a.jwt"} {
+		req := httptest.NewRequest("POST", "/xrpc/app.bsky.video.uploadVideo", strings.NewReader("a video"))
+		req.Header.Set("Content-Type", "video/mp4")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("authorization %q: got %d, expected 401", authorization, w.Code)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+// errBlobForbidden is a PDS refusing a requester access to a blob.
+var errBlobForbidden = errors.New("blob access denied")
+
+// blobAccessTTL is how long the answer of a PDS about a requester's access
+// to a blob is reused, as players fetch many segments in a row.
+const blobAccessTTL = time.Minute
+
+type blobAccess struct {
+	err       error
+	checkedAt time.Time
+}
+
+type blobAuthKey struct{}
+
+// withBlobAuth carries the Authorization of a watch request to the
+// download it may start, for PDS_BLOB_AUTH.
+func withBlobAuth(ctx context.Context, authorization string) context.Context {
+	return context.WithValue(ctx, blobAuthKey{}, authorization)
+}
+
+// blobAuth returns the Authorization carried by ctx, if any.
+func blobAuth(ctx context.Context) string {
+	authorization, _ := ctx.Value(blobAuthKey{}).(string)
+	return authorization
+}
+
+// pdsBlobError tells why com.atproto.sync.getBlob on pdsURL failed.
+// PDSes answer missing and taken down blobs with 400 BlobNotFound.
+func pdsBlobError(pdsURL string, err error) error {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusNotFound, http.StatusBadRequest:
+			return fmt.Errorf("%w: %s: %w", errBlobNotFound, pdsURL, err)
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("%w: %s: %w", errBlobForbidden, pdsURL, err)
+		}
+	}
+	return fmt.Errorf("%s: %w", pdsURL, err)
+}
+
+// tokenAudience returns the host of the service a bearer token is meant
+// for, from its aud claim, e.g. pds.example.com for did:web:pds.example.com.
+// The token isn't verified, this only tells where it may be sent: only its
+// audience may verify it, and anyone else could replay it.
+func tokenAudience(authorization string) (string, error) {
+	scheme, token, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("expected a Bearer token")
+	}
+	claims := jwt.StandardClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse authorization token: %w", err)
+	}
+	// service DIDs may name one of their services, e.g. #atproto_pds
+	aud, _, _ := strings.Cut(claims.Audience, "#")
+	host, ok := strings.CutPrefix(aud, "did:web:")
+	if !ok || host == "" {
+		return "", fmt.Errorf("authorization token audience %q isn't a did:web", claims.Audience)
+	}
+	// did:web encodes ports as %3A
+	host, err := url.PathUnescape(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization token audience %q: %w", claims.Audience, err)
+	}
+	return host, nil
+}
+
+// checkBlobAccess asks the PDS of did whether the holder of authorization
+// may fetch the blob did/cid, so that takedowns apply to videos that are
+// already converted too. It fails with errBlobNotFound or errBlobForbidden
+// when the PDS says no, and authorization is only ever sent to the PDS it
+// was issued for. Answers of the PDS are reused for blobAccessTTL, failures
+// to ask it aren't.
+func (cm *ConversionManager) checkBlobAccess(ctx context.Context, did, cid, authorization string) error {
+	// tokens aren't kept around in the clear
+	key := fmt.Sprintf("%s/%s/%x", did, cid, sha256.Sum256([]byte(authorization)))
+	if accessA, ok := cm.blobAccess.Load(key); ok {
+		if access := accessA.(blobAccess); time.Since(access.checkedAt) < blobAccessTTL {
+			return access.err
+		}
+	}
+
+	audience, err := tokenAudience(authorization)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBlobForbidden, err)
+	}
+	pdsURL, err := cm.userPDS(ctx, did)
+	if err != nil {
+		return fmt.Errorf("failed to find the PDS of %s: %w", did, err)
+	}
+	if u, err := url.Parse(pdsURL); err != nil || !strings.EqualFold(u.Host, audience) {
+		return fmt.Errorf("%w: authorization token is for %s, not the PDS of %s at %s", errBlobForbidden, audience, did, pdsURL)
+	}
+	err = cm.checkSource(ctx, cm.pdsBlobs, pdsBlobURL(pdsURL, did, cid), authorization)
+	if err != nil {
+		err = pdsBlobError(pdsURL, err)
+		if !errors.Is(err, errBlobNotFound) && !errors.Is(err, errBlobForbidden) {
+			return err
+		}
+	}
+	cm.blobAccess.Store(key, blobAccess{err: err, checkedAt: time.Now()})
+	return err
+}
+
+// pruneBlobAccess forgets the access checks older than blobAccessTTL.
+func (cm *ConversionManager) pruneBlobAccess() {
+	cm.blobAccess.Range(func(key, accessA any) bool {
+		if time.Since(accessA.(blobAccess).checkedAt) >= blobAccessTTL {
+			cm.blobAccess.CompareAndDelete(key, accessA)
+		}
+		return true
+	})
+}
+
+// authorizeBlob checks the access of a watch request to did/cid with its
+// PDS, answering 401 without authorization, 404 or 403 if refused, and 502
+// if the PDS couldn't be asked. Admin requests are always served.
+func (s *State) authorizeBlob(c *gin.Context, did, cid string) bool {
+	if isAdmin(c, s.config.AdminToken) {
+		return true
+	}
+	authorization := c.GetHeader("Authorization")
+	if authorization == "" {
+		c.AbortWithError(http.StatusUnauthorized, errors.New("authorization required"))
+		return false
+	}
+	err := s.cm.checkBlobAccess(c.Request.Context(), did, cid, authorization)
+	switch {
+	case errors.Is(err, errBlobNotFound):
+		c.AbortWithError(http.StatusNotFound, err)
+		return false
+	case errors.Is(err, errBlobForbidden):
+		c.AbortWithError(http.StatusForbidden, err)
+		return false
+	case err != nil:
+		c.AbortWithError(http.StatusBadGateway, fmt.Errorf("failed to check blob access: %w", err))
+		return false
+	}
+	c.Request = c.Request.WithContext(withBlobAuth(c.Request.Context(), authorization))
+	return true
+}
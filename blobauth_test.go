@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func testToken(t *testing.T, audience string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Audience: audience}).SignedString([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func TestTokenAudience(t *testing.T) {
+	tests := map[string]string{
+		"did:web:pds.example.com":             "pds.example.com",
+		"did:web:pds.example.com#atproto_pds": "pds.example.com",
+		"did:web:localhost%3A2583":            "localhost:2583",
+		"did:plc:ewvi7nxzyoun6zhxrhs64oiz":    "",
+		"https://pds.example.com":             "",
+		"":                                    "",
+	}
+	for audience, expected := range tests {
+		host, err := tokenAudience(testToken(t, audience))
+		if host != expected || (expected == "") != (err != nil) {
+			t.Errorf("%q: got %q, %v, expected %q", audience, host, err, expected)
+		}
+	}
+	if _, err := tokenAudience("Basic dXNlcjpwYXNz"); err == nil {
+		t.Error("expected an error for a Basic authorization")
+	}
+}
+
+func TestCheckBlobAccess(t *testing.T) {
+	var hits atomic.Int64
+	var status atomic.Int64
+	status.Store(http.StatusOK)
+	pds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer pds.Close()
+	pdsURL, _ := url.Parse(pds.URL)
+
+	cm := NewConversionManager(Config{WorkDir: t.TempDir(), BlobHosts: pdsURL.Host, MaxConcurrentDownloads: 1, PrepareConcurrency: 1}, noopReporter{})
+	cm.userPDS = func(ctx context.Context, did string) (string, error) { return pds.URL, nil }
+	ctx := context.Background()
+	audience := "did:web:" + strings.ReplaceAll(pdsURL.Host, ":", "%3A")
+
+	// tokens for other services are never sent
+	err := cm.checkBlobAccess(ctx, "did:plc:a", "cid1", testToken(t, "did:web:attacker.example.com"))
+	if !errors.Is(err, errBlobForbidden) || hits.Load() != 0 {
+		t.Fatalf("token for another service: got %v after %d requests", err, hits.Load())
+	}
+
+	token := testToken(t, audience)
+	if err := cm.checkBlobAccess(ctx, "did:plc:a", "cid1", token); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.checkBlobAccess(ctx, "did:plc:a", "cid1", token); err != nil || hits.Load() != 1 {
+		t.Fatalf("expected the access to be reused, got %v after %d requests", err, hits.Load())
+	}
+
+	status.Store(http.StatusForbidden)
+	if err := cm.checkBlobAccess(ctx, "did:plc:a", "cid2", token); !errors.Is(err, errBlobForbidden) {
+		t.Fatalf("expected errBlobForbidden, got %v", err)
+	}
+
+	// failing to ask the PDS denies access, and isn't cached
+	status.Store(http.StatusBadGateway)
+	before := hits.Load()
+	for range 2 {
+		err := cm.checkBlobAccess(ctx, "did:plc:a", "cid3", token)
+		if err == nil || errors.Is(err, errBlobForbidden) || errors.Is(err, errBlobNotFound) {
+			t.Fatalf("expected an upstream error, got %v", err)
+		}
+	}
+	if hits.Load() != before+2 {
+		t.Fatalf("expected upstream failures not to be cached")
+	}
+}
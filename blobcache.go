@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// BlobCache keeps downloaded source blobs on disk. Blobs are addressed by
+// their CID and never change, so a video whose conversion was evicted can
+// be converted again without downloading it again.
+type BlobCache struct {
+	dir      string
+	ttl      time.Duration
+	maxBytes int64
+
+	// serializes pruning
+	mu     sync.Mutex
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func NewBlobCache(dir string, ttl time.Duration, maxBytes int64) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create blob cache directory: %w", err)
+	}
+	return &BlobCache{dir: dir, ttl: ttl, maxBytes: maxBytes}, nil
+}
+
+// path returns where the blob is cached. The CID is parsed so that it
+// can't be used to escape the cache directory.
+func (bc *BlobCache) path(blobCID string) (string, error) {
+	parsed, err := cid.Decode(blobCID)
+	if err != nil {
+		return "", fmt.Errorf("invalid cid: %w", err)
+	}
+	return filepath.Join(bc.dir, parsed.String()), nil
+}
+
+// get links the cached blob to a new temp file owned by the caller,
+// reporting whether the blob was cached.
+func (bc *BlobCache) get(blobCID string) (string, bool) {
+	cachedPath, err := bc.path(blobCID)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(cachedPath); err != nil {
+		bc.misses.Add(1)
+		return "", false
+	}
+	tmpPath, err := linkOrCopyTemp(cachedPath, "", "blob_*")
+	if err != nil {
+		log.Printf("Failed to read cached blob %s: %s", blobCID, err)
+		bc.misses.Add(1)
+		return "", false
+	}
+	// the modification time is when the blob was last used, for pruning
+	now := time.Now()
+	os.Chtimes(cachedPath, now, now)
+	bc.hits.Add(1)
+	return tmpPath, true
+}
+
+// put adds the blob downloaded at path to the cache. The caller keeps
+// ownership of path.
+func (bc *BlobCache) put(blobCID, path string) {
+	cachedPath, err := bc.path(blobCID)
+	if err != nil {
+		return
+	}
+	// blobs appear under their final name only once complete
+	tmpPath, err := linkOrCopyTemp(path, bc.dir, ".incoming_*")
+	if err != nil {
+		log.Printf("Failed to cache blob %s: %s", blobCID, err)
+		return
+	}
+	if err := os.Rename(tmpPath, cachedPath); err != nil {
+		log.Printf("Failed to cache blob %s: %s", blobCID, err)
+		os.Remove(tmpPath)
+		return
+	}
+	bc.prune()
+}
+
+// remove drops a blob from the cache, e.g. because it is corrupt,
+// reporting whether it was cached.
+func (bc *BlobCache) remove(blobCID string) (bool, error) {
+	cachedPath, err := bc.path(blobCID)
+	if err != nil {
+		return false, err
+	}
+	err = os.Remove(cachedPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to remove cached blob: %w", err)
+	}
+	return true, nil
+}
+
+// linkOrCopyTemp hard links src to a new temp file in dir, copying it if
+// they are on different filesystems.
+func linkOrCopyTemp(src, dir, pattern string) (string, error) {
+	tmpFile, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	os.Remove(tmpPath)
+	if err := os.Link(src, tmpPath); err == nil {
+		return tmpPath, nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if err = errors.Join(err, out.Close()); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// prune removes blobs unused for longer than the TTL, then the least
+// recently used ones until the cache fits in its size cap.
+func (bc *BlobCache) prune() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	entries, err := os.ReadDir(bc.dir)
+	if err != nil {
+		log.Printf("Failed to prune blob cache: %s", err)
+		return
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		// incoming blobs belong to a running put
+		if strings.HasPrefix(info.Name(), ".incoming_") {
+			continue
+		}
+		if time.Since(info.ModTime()) > bc.ttl {
+			os.Remove(filepath.Join(bc.dir, info.Name()))
+			continue
+		}
+		infos = append(infos, info)
+		total += info.Size()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		if total <= bc.maxBytes {
+			break
+		}
+		os.Remove(filepath.Join(bc.dir, info.Name()))
+		total -= info.Size()
+	}
+}
+
+// clear removes every cached blob, returning how many it removed.
+func (bc *BlobCache) clear() int {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	entries, err := os.ReadDir(bc.dir)
+	if err != nil {
+		log.Printf("Failed to clear blob cache: %s", err)
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".incoming_") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(bc.dir, entry.Name())); err == nil {
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cacheCategory groups what we serve by how long CDNs may cache it.
+type cacheCategory int
+
+const (
+	// playlists and segments.json, which change while converting
+	cachePlaylist cacheCategory = iota
+	// segments, init segments, MP4s and sources, never changed once written
+	cacheSegment
+	// thumbnails and posters
+	cacheThumbnail
+)
+
+// fileCacheCategory is the category of a file of a conversion.
+func fileCacheCategory(filename string) cacheCategory {
+	switch filepath.Ext(filename) {
+	case ".m3u8", ".json":
+		return cachePlaylist
+	case ".jpg", ".webp", ".avif":
+		return cacheThumbnail
+	default:
+		return cacheSegment
+	}
+}
+
+// setCacheControl sets the Cache-Control of a response to the one
+// configured for its category.
+func (s *State) setCacheControl(c *gin.Context, category cacheCategory) {
+	switch category {
+	case cachePlaylist:
+		c.Header("Cache-Control", s.config.CacheControlPlaylist)
+	case cacheSegment:
+		c.Header("Cache-Control", s.config.CacheControlSegment)
+	case cacheThumbnail:
+		c.Header("Cache-Control", s.config.CacheControlThumbnail)
+	}
+}
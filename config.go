@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// settings whose values are never logged
+var secretSettings = []string{"ADMIN_TOKEN", "THUMBNAIL_SIGNING_KEY", "SENTRY_DSN"}
+
+var (
+	// settings read from CONFIG_FILE, by env var name
+	fileSettings map[string]string
+	// the value every setting ended up with, and where it came from
+	settingsMu       sync.Mutex
+	effectiveSetting = map[string]string{}
+	settingSource    = map[string]string{}
+)
+
+// loadConfigFile reads the settings of a TOML or YAML file, told apart by
+// its extension. Its keys are the names of the env vars they stand for,
+// in any case, e.g. `hls_segment_length = 4`.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONFIG_FILE: %w", err)
+	}
+	raw := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("CONFIG_FILE must be a .toml, .yaml or .yml file, got %q", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CONFIG_FILE: %w", err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for key, value := range raw {
+		s, err := settingValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("CONFIG_FILE: %s: %w", key, err)
+		}
+		settings[strings.ToUpper(key)] = s
+	}
+	return settings, nil
+}
+
+// settingValue turns a value of a config file into what its env var would
+// be set to. Lists are joined with commas, like ALLOWED_DIDS.
+func settingValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, nested := item.([]any); nested {
+				return "", fmt.Errorf("lists can't be nested")
+			}
+			s, err := settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("expected a string, number, boolean or list, got %T", value)
+	}
+}
+
+// lookupSetting finds key in the environment, and then in CONFIG_FILE.
+func lookupSetting(key string) (value, source string) {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value, "env"
+	}
+	if value := strings.TrimSpace(fileSettings[key]); value != "" {
+		return value, "file"
+	}
+	return "", ""
+}
+
+func recordSetting(key, value, source string) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	effectiveSetting[key] = value
+	settingSource[key] = source
+}
+
+// redactSetting hides the secrets in the value of key.
+func redactSetting(key, value string) string {
+	if value == "" {
+		return value
+	}
+	if slices.Contains(secretSettings, key) {
+		return "[redacted]"
+	}
+	if key == "DATABASE_URL" {
+		// only the password is secret
+		if u, err := url.Parse(value); err == nil {
+			return u.Redacted()
+		}
+		return "[redacted]"
+	}
+	return value
+}
+
+// logSettings logs the value of every setting that was read, and warns
+// about those in CONFIG_FILE that weren't, which are likely typos.
+func logSettings() {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	keys := make([]string, 0, len(effectiveSetting))
+	for key := range effectiveSetting {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		log.Printf("Setting %s=%s (%s)", key, redactSetting(key, effectiveSetting[key]), settingSource[key])
+	}
+	for key := range fileSettings {
+		if _, ok := effectiveSetting[key]; !ok {
+			log.Printf("Warning: unknown setting %s in CONFIG_FILE", key)
+		}
+	}
+}
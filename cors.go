@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// apiCORS only lets the configured appviews and frontend call the XRPC
+// API, with credentials.
+func apiCORS(config Config) gin.HandlerFunc {
+	return cors.New(cors.Config{
+		AllowOrigins:     append(config.appviewURLs(), config.FrontendURL),
+		AllowMethods:     splitList(config.APICORSMethods),
+		AllowHeaders:     splitList(config.APICORSHeaders),
+		ExposeHeaders:    []string{"Content-Length", "Content-Type", "X-Poll-Interval", "Location", "Upload-Length", "Upload-Offset"},
+		AllowCredentials: true,
+		AllowOriginFunc: func(origin string) bool {
+			return slices.Contains(config.appviewURLs(), origin) || origin == config.FrontendURL
+		},
+		MaxAge: config.APICORSMaxAge,
+	})
+}
+
+// watchCORS is the policy of /watch/, where videos are played from. It is
+// independent from the API's, as media is usually embedded from anywhere.
+func watchCORS(config Config) gin.HandlerFunc {
+	corsConfig := cors.Config{
+		AllowMethods:  splitList(config.WatchCORSMethods),
+		AllowHeaders:  splitList(config.WatchCORSHeaders),
+		ExposeHeaders: []string{"Content-Length", "Content-Type", "Content-Range", "Accept-Ranges", "Retry-After", "Link"},
+		MaxAge:        config.WatchCORSMaxAge,
+	}
+	for _, origin := range splitList(config.WatchCORSOrigins) {
+		if origin == "*" {
+			corsConfig.AllowAllOrigins = true
+		} else {
+			corsConfig.AllowOrigins = append(corsConfig.AllowOrigins, origin)
+		}
+	}
+	if corsConfig.AllowAllOrigins {
+		corsConfig.AllowOrigins = nil
+	}
+	return cors.New(corsConfig)
+}
+
+// corsByRoute applies the watch policy to /watch/ and the API policy to
+// everything else. This is global middleware rather than per route group
+// so that it also answers preflight requests, which match no route.
+func corsByRoute(api, watch gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/watch/") {
+			watch(c)
+		} else {
+			api(c)
+		}
+	}
+}
+
+// allowMethods answers OPTIONS requests that aren't CORS preflights (those
+// are answered by the CORS middleware) with the methods of a route.
+func allowMethods(methods ...string) gin.HandlerFunc {
+	allow := strings.Join(append(methods, "OPTIONS"), ", ")
+	return func(c *gin.Context) {
+		c.Header("Allow", allow)
+		c.Status(http.StatusNoContent)
+	}
+}
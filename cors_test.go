@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testCORSRouter() *gin.Engine {
+	config := Config{
+		AppviewURL:       "https://appview.example",
+		FrontendURL:      "https://frontend.example",
+		WatchCORSOrigins: "*",
+		WatchCORSMethods: "GET,HEAD,POST",
+		WatchCORSHeaders: "Origin,Range,Content-Type",
+		WatchCORSMaxAge:  time.Hour,
+		APICORSMethods:   "GET,HEAD,POST,PUT,PATCH,DELETE",
+		APICORSHeaders:   "Origin,Authorization,content-type",
+		APICORSMaxAge:    time.Hour,
+	}
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(corsByRoute(apiCORS(config), watchCORS(config)))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/watch/:did/:cid/*filepath", ok)
+	r.OPTIONS("/watch/:did/:cid/*filepath", allowMethods("GET", "HEAD", "POST"))
+	r.POST("/xrpc/app.bsky.video.uploadVideo", ok)
+	return r
+}
+
+func TestCORSPreflight(t *testing.T) {
+	r := testCORSRouter()
+	preflight := func(path, origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// media is played from anywhere
+	w := preflight("/watch/did:plc:a/cid/playlist.m3u8", "https://player.example", "GET", "Range")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("watch preflight: got %d, Allow-Origin %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	// the API only from the appview and frontend, with credentials
+	w = preflight("/xrpc/app.bsky.video.uploadVideo", "https://frontend.example", "POST", "Authorization")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://frontend.example" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("API preflight: got %d, Allow-Origin %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	w = preflight("/xrpc/app.bsky.video.uploadVideo", "https://evil.example", "POST", "Authorization")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("API preflight from another origin: got Allow-Origin %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// plain OPTIONS, without CORS
+	req := httptest.NewRequest("OPTIONS", "/watch/did:plc:a/cid/playlist.m3u8", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, HEAD, POST, OPTIONS" {
+		t.Errorf("OPTIONS: got %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
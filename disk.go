@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// diskUsageInterval is how often the disk used by conversions and
+// thumbnails is measured.
+const diskUsageInterval = 30 * time.Second
+
+var errDiskFull = errors.New("no disk space left for new conversions")
+
+// cachedEntry is a conversion or thumbnail, as seen by a disk usage pass.
+type cachedEntry struct {
+	accessed time.Time
+	size     int64
+	dir      string
+	// drops the entry from the cache unless it was used since accessed
+	remove func() bool
+}
+
+func (cm *ConversionManager) diskUsageRoutine() {
+	for range time.Tick(diskUsageInterval) {
+		cm.checkDiskUsage()
+	}
+}
+
+// checkDiskUsage measures the disk used by conversions and thumbnails,
+// evicting the least recently accessed ones when past DISK_HIGH_WATER_BYTES.
+func (cm *ConversionManager) checkDiskUsage() {
+	entries, usage := cm.measureDiskUsage()
+	cm.diskUsage.Store(usage)
+	highWater := cm.config.DiskHighWaterBytes
+	if highWater <= 0 || usage <= highWater {
+		return
+	}
+
+	log.Printf("Temp disk usage of %d bytes is past %d bytes, evicting", usage, highWater)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].accessed.Before(entries[j].accessed)
+	})
+	evicted := 0
+	for _, entry := range entries {
+		if usage <= highWater {
+			break
+		}
+		if !entry.remove() {
+			continue
+		}
+		os.RemoveAll(entry.dir)
+		usage -= entry.size
+		evicted++
+	}
+	cm.diskUsage.Store(usage)
+	log.Printf("Evicted %d conversions and thumbnails, temp disk usage is now %d bytes", evicted, usage)
+}
+
+// measureDiskUsage returns the conversions and thumbnails that may be
+// evicted, and the bytes used by all of them and by retained failures.
+func (cm *ConversionManager) measureDiskUsage() ([]cachedEntry, int64) {
+	entries := make([]cachedEntry, 0)
+	var total int64
+	cm.conversions.Range(func(keyA any, convA any) bool {
+		conv := convA.(*Conversion)
+		conv.mu.Lock()
+		accessed := conv.LastAccessed
+		conv.mu.Unlock()
+		size := dirSize(conv.OutputDir)
+		total += size
+		entries = append(entries, cachedEntry{
+			accessed: accessed,
+			size:     size,
+			dir:      conv.OutputDir,
+			remove:   func() bool { return cm.removeConversion(keyA.(string), conv, accessed) },
+		})
+		return true
+	})
+	cm.thumbnails.Range(func(keyA any, thumbA any) bool {
+		thumb := thumbA.(*Thumbnail)
+		thumb.mu.Lock()
+		accessed := thumb.LastAccessed
+		thumb.mu.Unlock()
+		size := dirSize(filepath.Dir(thumb.Path))
+		total += size
+		entries = append(entries, cachedEntry{
+			accessed: accessed,
+			size:     size,
+			dir:      filepath.Dir(thumb.Path),
+			remove:   func() bool { return cm.removeThumbnail(keyA.(string), thumb, accessed) },
+		})
+		return true
+	})
+	// not evicted with the rest, pruneFailures keeps them within their
+	// own cap
+	total += dirSize(cm.failuresDir())
+	return entries, total
+}
+
+// dirSize returns the bytes used by the files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// tempDir is where our temp files and directories go, WORK_DIR/tmp, so
+// that sweepTempFiles never touches anyone else's.
+func (config Config) tempDir() string {
+	return filepath.Join(config.WorkDir, "tmp")
+}
+
+// createTemp is os.CreateTemp in tempDir.
+func (config Config) createTemp(pattern string) (*os.File, error) {
+	if err := os.MkdirAll(config.tempDir(), 0o700); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(config.tempDir(), pattern)
+}
+
+// mkdirTemp is os.MkdirTemp in tempDir.
+func (config Config) mkdirTemp(pattern string) (string, error) {
+	if err := os.MkdirAll(config.tempDir(), 0o700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(config.tempDir(), pattern)
+}
+
+// sweepTempFiles removes our temp files and directories last modified
+// before olderThan, which were left behind by an instance that crashed:
+// everything in tempDir, and incomplete blob cache entries.
+func sweepTempFiles(config Config, olderThan time.Time) {
+	removed, size := 0, int64(0)
+	// sweeps the entries of dir starting with one of prefixes, or all of
+	// them without prefixes
+	sweep := func(dir string, prefixes []string) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Failed to sweep %s: %s", dir, err)
+			}
+			return
+		}
+		for _, entry := range entries {
+			if prefixes != nil && !slices.ContainsFunc(prefixes, func(prefix string) bool { return strings.HasPrefix(entry.Name(), prefix) }) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || !info.ModTime().Before(olderThan) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			entrySize := info.Size()
+			if entry.IsDir() {
+				entrySize = dirSize(path)
+			}
+			if err := os.RemoveAll(path); err != nil {
+				log.Printf("Failed to remove %s: %s", path, err)
+				continue
+			}
+			removed++
+			size += entrySize
+		}
+	}
+	sweep(config.tempDir(), nil)
+	sweep(filepath.Join(config.WorkDir, "blobs"), []string{".incoming_"})
+	if removed > 0 {
+		log.Printf("Removed %d leftover temp files and directories, reclaiming %d bytes", removed, size)
+	}
+}
+
+// diskFull reports whether the disk is too full to start new conversions.
+func (cm *ConversionManager) diskFull() bool {
+	return cm.config.DiskCriticalBytes > 0 && cm.diskUsage.Load() >= cm.config.DiskCriticalBytes
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepTempFiles(t *testing.T) {
+	config := testConfig(t)
+	old := time.Now().Add(-2 * time.Hour)
+	write := func(path string, mtime time.Time) string {
+		path = filepath.Join(config.WorkDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	leftover := write("tmp/blob_1", old)
+	recent := write("tmp/blob_2", time.Now())
+	incoming := write("blobs/.incoming_1", old)
+	cached := write("blobs/bafy", old)
+	local := write("local/did/cid", old)
+
+	sweepTempFiles(config, time.Now().Add(-time.Hour))
+	for path, removed := range map[string]bool{leftover: true, recent: false, incoming: true, cached: false, local: false} {
+		if _, err := os.Stat(path); os.IsNotExist(err) != removed {
+			t.Errorf("%s: expected removed to be %v", path, removed)
+		}
+	}
+}
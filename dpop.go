@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// atproto OAuth access tokens are presented as "DPoP <token>", with a
+// DPoP header carrying a proof signed by the key the token is bound to
+// (RFC 9449). They are issued by the authorization server of the user's
+// PDS and meant for that PDS, so everything the PDS would check is checked
+// here: the signature of the token with the keys of its issuer, that the
+// issuer is the one of the PDS in the user's DID document, and the proof,
+// which keeps anyone else holding the token from replaying it.
+
+// dpopProofMaxAge is how far the iat of a DPoP proof may be from now.
+const dpopProofMaxAge = 5 * time.Minute
+
+// maxOAuthMetadataBytes bounds the metadata and key sets read from
+// authorization servers.
+const maxOAuthMetadataBytes = 1 << 20
+
+// accessTokenClaims are the claims of atproto OAuth access tokens.
+type accessTokenClaims struct {
+	jwt.StandardClaims
+	// thumbprint of the key its DPoP proofs must be signed with
+	Confirmation struct {
+		JKT string `json:"jkt"`
+	} `json:"cnf"`
+}
+
+// dpopProofClaims are the claims of DPoP proofs.
+type dpopProofClaims struct {
+	jwt.StandardClaims
+	Method string `json:"htm"`
+	URL    string `json:"htu"`
+	// hash of the access token sent with the proof
+	TokenHash string `json:"ath"`
+}
+
+// Valid is checked by verifyDPoPProof instead, iat may be a bit ahead of
+// our clock.
+func (dpopProofClaims) Valid() error {
+	return nil
+}
+
+// jwk is an EC public key of a JWK set or DPoP proof.
+type jwk struct {
+	KTY string `json:"kty"`
+	CRV string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	KID string `json:"kid,omitempty"`
+}
+
+// publicKey returns k as an ECDSA key, only P-256 (ES256) is supported.
+func (k jwk) publicKey() (*ecdsa.PublicKey, error) {
+	if k.KTY != "EC" || k.CRV != "P-256" {
+		return nil, fmt.Errorf("unsupported key type %s %s", k.KTY, k.CRV)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(x) != 32 {
+		return nil, errors.New("invalid key x coordinate")
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil || len(y) != 32 {
+		return nil, errors.New("invalid key y coordinate")
+	}
+	// rejects points off the curve
+	if _, err := ecdh.P256().NewPublicKey(slices.Concat([]byte{4}, x, y)); err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+// thumbprint is the RFC 7638 thumbprint of k, which access tokens bound
+// to it carry as cnf.jkt.
+func (k jwk) thumbprint() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.CRV, k.KTY, k.X, k.Y)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyDPoP verifies the OAuth access token of req and its DPoP proof,
+// returning the DID of the user it was issued to.
+func (auth *Auth) verifyDPoP(ctx context.Context, req *http.Request, token string) (string, error) {
+	// unverified until the keys of its issuer are known
+	claims := accessTokenClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse access token: %w", err)
+	}
+	did := claims.Subject
+	if err := auth.checkPDSAudience(ctx, did, claims.Audience); err != nil {
+		return "", err
+	}
+	pds, err := auth.pdsURL(ctx, did)
+	if err != nil {
+		return "", err
+	}
+	issuer := claims.Issuer
+
+	parser := jwt.Parser{ValidMethods: []string{jwt.SigningMethodES256.Alg()}}
+	claims = accessTokenClaims{}
+	_, err = parser.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return auth.issuerKey(ctx, pds, issuer, kid)
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid access token: %w", err)
+	}
+	if claims.Confirmation.JKT == "" {
+		return "", errors.New("access token isn't bound to a DPoP key")
+	}
+	if err := auth.verifyDPoPProof(req, token, claims.Confirmation.JKT); err != nil {
+		return "", err
+	}
+	return did, nil
+}
+
+// verifyDPoPProof checks the DPoP header of req: a proof made for req, with
+// token, signed by the key whose thumbprint is jkt. Each proof is only
+// accepted once.
+func (auth *Auth) verifyDPoPProof(req *http.Request, token, jkt string) error {
+	proof := req.Header.Get("DPoP")
+	if proof == "" {
+		return errors.New("DPoP proof is missing")
+	}
+	parser := jwt.Parser{ValidMethods: []string{jwt.SigningMethodES256.Alg()}}
+	claims := dpopProofClaims{}
+	_, err := parser.ParseWithClaims(proof, &claims, func(t *jwt.Token) (interface{}, error) {
+		if typ, _ := t.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, fmt.Errorf("unexpected typ %q", typ)
+		}
+		raw, err := json.Marshal(t.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		var key jwk
+		if err := json.Unmarshal(raw, &key); err != nil {
+			return nil, fmt.Errorf("invalid jwk: %w", err)
+		}
+		if key.thumbprint() != jkt {
+			return nil, errors.New("proof isn't signed with the key of the access token")
+		}
+		return key.publicKey()
+	})
+	if err != nil {
+		return fmt.Errorf("invalid DPoP proof: %w", err)
+	}
+
+	if claims.Method != req.Method {
+		return fmt.Errorf("DPoP proof is for %s, not %s", claims.Method, req.Method)
+	}
+	// behind a proxy the scheme isn't known, the host is passed along
+	if u, err := url.Parse(claims.URL); err != nil || u.Host != req.Host || u.Path != req.URL.Path {
+		return fmt.Errorf("DPoP proof is for %s, not %s%s", claims.URL, req.Host, req.URL.Path)
+	}
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if time.Since(issuedAt).Abs() > dpopProofMaxAge {
+		return errors.New("DPoP proof is expired")
+	}
+	hash := sha256.Sum256([]byte(token))
+	if claims.TokenHash != base64.RawURLEncoding.EncodeToString(hash[:]) {
+		return errors.New("DPoP proof is for another access token")
+	}
+	if claims.Id == "" {
+		return errors.New("DPoP proof has no jti")
+	}
+	key := "dpop:" + claims.Id
+	if entry, ok := auth.KeyCache.Get(key); ok && entry.ExpiresAt.After(time.Now()) {
+		return errors.New("DPoP proof was already used")
+	}
+	auth.KeyCache.Add(key, KeyCacheEntry{ExpiresAt: issuedAt.Add(dpopProofMaxAge)})
+	return nil
+}
+
+// issuerKey returns the key kid of issuer, which must be an authorization
+// server of pds. Keys are cached for KeyCacheTTL, unless kid isn't among
+// them, as issuers rotate their keys.
+func (auth *Auth) issuerKey(ctx context.Context, pds *url.URL, issuer, kid string) (*ecdsa.PublicKey, error) {
+	cacheKey := "oauth:" + pds.String() + " " + issuer
+	if entry, ok := auth.KeyCache.Get(cacheKey); ok && entry.ExpiresAt.After(time.Now()) {
+		cacheHits.WithLabelValues("oauth").Inc()
+		if key, ok := entry.Key.(map[string]*ecdsa.PublicKey)[kid]; ok {
+			return key, nil
+		}
+	} else {
+		cacheMisses.WithLabelValues("oauth").Inc()
+	}
+
+	keys, err := auth.fetchIssuerKeys(ctx, pds, issuer)
+	if err != nil {
+		return nil, err
+	}
+	auth.KeyCache.Add(cacheKey, KeyCacheEntry{Key: keys, ExpiresAt: time.Now().Add(auth.KeyCacheTTL)})
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%s has no key %q", issuer, kid)
+	}
+	return key, nil
+}
+
+// fetchIssuerKeys fetches the keys of issuer, by kid, after checking that
+// it is an authorization server of pds.
+func (auth *Auth) fetchIssuerKeys(ctx context.Context, pds *url.URL, issuer string) (map[string]*ecdsa.PublicKey, error) {
+	var resource struct {
+		AuthorizationServers []string `json:"authorization_servers"`
+	}
+	if err := auth.fetchOAuthJSON(ctx, pds.JoinPath("/.well-known/oauth-protected-resource").String(), &resource); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(resource.AuthorizationServers, issuer) {
+		return nil, fmt.Errorf("%s isn't an authorization server of %s", issuer, pds)
+	}
+
+	var server struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := auth.fetchOAuthJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/oauth-authorization-server", &server); err != nil {
+		return nil, err
+	}
+	if server.Issuer != issuer {
+		return nil, fmt.Errorf("authorization server %s claims to be %s", issuer, server.Issuer)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := auth.fetchOAuthJSON(ctx, server.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*ecdsa.PublicKey)
+	for _, k := range set.Keys {
+		// other key types may be there for other uses
+		if key, err := k.publicKey(); err == nil {
+			keys[k.KID] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no ES256 keys", issuer)
+	}
+	return keys, nil
+}
+
+// fetchOAuthJSON decodes the JSON document at u into out, u must be
+// allowed by OAuthServers.
+func (auth *Auth) fetchOAuthJSON(ctx context.Context, u string, out any) error {
+	if err := auth.OAuthServers.checkBlobHost(u); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := auth.OAuthServers.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch %s: %s", u, res.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxOAuthMetadataBytes)).Decode(out); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", u, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+)
+
+// testJWK returns the public JWK of key.
+func testJWK(key *ecdsa.PrivateKey) jwk {
+	encode := func(n []byte) string { return base64.RawURLEncoding.EncodeToString(n) }
+	return jwk{
+		KTY: "EC",
+		CRV: "P-256",
+		X:   encode(key.X.FillBytes(make([]byte, 32))),
+		Y:   encode(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func newES256Key(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, header map[string]interface{}, claims jwt.Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	for name, value := range header {
+		token.Header[name] = value
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestAuthenticateUploaderDPoP(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	serverKey := newES256Key(t)
+	// the PDS is its own authorization server
+	pds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer := "http://" + r.Host
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/oauth-protected-resource":
+			json.NewEncoder(w).Encode(map[string]any{"resource": issuer, "authorization_servers": []string{issuer}})
+		case "/.well-known/oauth-authorization-server":
+			json.NewEncoder(w).Encode(map[string]any{"issuer": issuer, "jwks_uri": issuer + "/oauth/jwks"})
+		case "/oauth/jwks":
+			key := testJWK(serverKey)
+			key.KID = "server"
+			json.NewEncoder(w).Encode(map[string]any{"keys": []jwk{key}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer pds.Close()
+	pdsURL, _ := url.Parse(pds.URL)
+	pdsDID := "did:web:" + strings.ReplaceAll(pdsURL.Host, ":", "%3A")
+
+	auth, _ := testAuth(t, did)
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:      syntax.DID(did),
+		Handle:   syntax.HandleInvalid,
+		Services: map[string]identity.Service{"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: pds.URL}},
+	})
+	auth.Dir = &dir
+	auth.OAuthServers = newBlobGuard([]string{pdsURL.Host})
+	auth.LocalUploads = true
+
+	r := gin.New()
+	r.POST("/upload", auth.AuthenticateUploader, func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("user_did"))
+	})
+
+	clientKey := newES256Key(t)
+	accessToken := func(key *ecdsa.PrivateKey, audience string, bound jwk) string {
+		claims := accessTokenClaims{StandardClaims: jwt.StandardClaims{
+			Issuer:    pds.URL,
+			Subject:   did,
+			Audience:  audience,
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}}
+		claims.Confirmation.JKT = bound.thumbprint()
+		return signES256(t, key, map[string]interface{}{"kid": "server"}, claims)
+	}
+	var proofs int
+	proof := func(key *ecdsa.PrivateKey, token, htu string) string {
+		proofs++
+		hash := sha256.Sum256([]byte(token))
+		return signES256(t, key, map[string]interface{}{"typ": "dpop+jwt", "jwk": testJWK(key)}, dpopProofClaims{
+			StandardClaims: jwt.StandardClaims{Id: fmt.Sprintf("proof%d", proofs), IssuedAt: time.Now().Unix()},
+			Method:         "POST",
+			URL:            htu,
+			TokenHash:      base64.RawURLEncoding.EncodeToString(hash[:]),
+		})
+	}
+	do := func(token, dpop string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", nil)
+		req.Header.Set("Authorization", "DPoP "+token)
+		if dpop != "" {
+			req.Header.Set("DPoP", dpop)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	token := accessToken(serverKey, pdsDID, testJWK(clientKey))
+	valid := proof(clientKey, token, "http://example.com/upload")
+	if w := do(token, valid); w.Code != http.StatusOK || w.Body.String() != did {
+		t.Fatalf("DPoP upload: got %d %s", w.Code, w.Body)
+	}
+	if w := do(token, valid); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed proof: got %d", w.Code)
+	}
+
+	otherKey := newES256Key(t)
+	tests := []struct {
+		name  string
+		token string
+		proof string
+	}{
+		{"no proof", token, ""},
+		{"proof for another URL", token, proof(clientKey, token, "http://example.com/other")},
+		{"proof by another key", token, proof(otherKey, token, "http://example.com/upload")},
+		{"proof for another token", token, proof(clientKey, accessToken(serverKey, pdsDID, testJWK(otherKey)), "http://example.com/upload")},
+		{"forged token", accessToken(otherKey, pdsDID, testJWK(clientKey)), ""},
+		{"token for another PDS", accessToken(serverKey, "did:web:pds.example.com", testJWK(clientKey)), ""},
+	}
+	for _, test := range tests {
+		dpop := test.proof
+		if dpop == "" && test.name != "no proof" {
+			dpop = proof(clientKey, test.token, "http://example.com/upload")
+		}
+		if w := do(test.token, dpop); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, expected 401", test.name, w.Code)
+		}
+	}
+
+	// the PDS would need a proof of its own
+	auth.LocalUploads = false
+	if w := do(token, proof(clientKey, token, "http://example.com/upload")); w.Code != http.StatusUnauthorized {
+		t.Errorf("DPoP upload to a PDS: got %d, expected 401", w.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ConversionErrorKind is what went wrong converting a video or generating
+// one of its thumbnails.
+type ConversionErrorKind int
+
+const (
+	// the source couldn't be downloaded
+	KindDownloadFailed ConversionErrorKind = iota
+	// no appview has the source blob
+	KindNotFound
+	// ffprobe couldn't read the source
+	KindProbeFailed
+	// ffmpeg failed
+	KindTranscodeFailed
+	// the requested timestamp is past the end of the video
+	KindOutOfRange
+	// it took too long
+	KindTimeout
+	// the source is encrypted or has nothing ffmpeg can decode
+	KindUnsupportedSource
+	// the video would be cut into more than MAX_SEGMENTS segments
+	KindTooLong
+)
+
+func (k ConversionErrorKind) String() string {
+	switch k {
+	case KindDownloadFailed:
+		return "download_failed"
+	case KindNotFound:
+		return "not_found"
+	case KindProbeFailed:
+		return "probe_failed"
+	case KindTranscodeFailed:
+		return "transcode_failed"
+	case KindOutOfRange:
+		return "out_of_range"
+	case KindTimeout:
+		return "timeout"
+	case KindUnsupportedSource:
+		return "unsupported_source"
+	case KindTooLong:
+		return "too_long"
+	default:
+		return "unknown"
+	}
+}
+
+// ConversionError is a failed conversion or thumbnail, with its Kind for
+// handlers to pick a status from.
+type ConversionError struct {
+	Kind ConversionErrorKind
+	Err  error
+}
+
+func (e *ConversionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConversionError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatus is the status answering requests that failed with e.
+func (e *ConversionError) HTTPStatus() int {
+	switch e.Kind {
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindOutOfRange:
+		return http.StatusBadRequest
+	case KindProbeFailed:
+		return http.StatusUnprocessableEntity
+	case KindDownloadFailed:
+		return http.StatusBadGateway
+	case KindTimeout:
+		return http.StatusGatewayTimeout
+	case KindUnsupportedSource:
+		return http.StatusUnsupportedMediaType
+	case KindTooLong:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorStatus is the status answering requests that failed with err, 500
+// unless it is a ConversionError.
+func errorStatus(err error) int {
+	var convErr *ConversionError
+	if errors.As(err, &convErr) {
+		return convErr.HTTPStatus()
+	}
+	return http.StatusInternalServerError
+}
+
+// downloadError wraps an error of downloadSource.
+func downloadError(err error) *ConversionError {
+	kind := KindDownloadFailed
+	switch {
+	case errors.Is(err, errBlobNotFound):
+		kind = KindNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		kind = KindTimeout
+	}
+	return &ConversionError{Kind: kind, Err: err}
+}
+
+// transcodeErrorKind tells a failed ffmpeg run from one that ran out of
+// time.
+func transcodeErrorKind(ctx context.Context) ConversionErrorKind {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return KindTimeout
+	}
+	return KindTranscodeFailed
+}
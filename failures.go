@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// failuresDir is where the output of failed conversions is kept for
+// FAILED_CONVERSION_RETENTION, to find out what went wrong.
+func (cm *ConversionManager) failuresDir() string {
+	return filepath.Join(cm.config.WorkDir, "failures")
+}
+
+// retainFailure moves outputDir, the output of a conversion that failed
+// with convErr, to failuresDir, along with convErr and the whole ffmpeg
+// output in ffmpeg.log. It returns where to, or "" if it couldn't.
+func (cm *ConversionManager) retainFailure(outputDir string, convErr error, ffmpegOutput string) string {
+	// the output dir is named after the video, e.g. hls_{did}_{cid}_123
+	dest := filepath.Join(cm.failuresDir(), fmt.Sprintf("%s_%s", filepath.Base(outputDir), time.Now().UTC().Format("20060102T150405")))
+	if err := os.MkdirAll(cm.failuresDir(), 0o700); err != nil {
+		log.Printf("Failed to retain failed conversion %s: %s", outputDir, err)
+		return ""
+	}
+	if err := os.Rename(outputDir, dest); err != nil {
+		// WORK_DIR may be on another filesystem than the output
+		if err := os.CopyFS(dest, os.DirFS(outputDir)); err != nil {
+			log.Printf("Failed to retain failed conversion %s: %s", outputDir, err)
+			os.RemoveAll(dest)
+			return ""
+		}
+	}
+	ffmpegLog := fmt.Sprintf("error: %s\n\n%s", convErr, ffmpegOutput)
+	if err := os.WriteFile(filepath.Join(dest, "ffmpeg.log"), []byte(ffmpegLog), 0o600); err != nil {
+		log.Printf("Failed to write ffmpeg log of failed conversion %s: %s", dest, err)
+	}
+	log.Printf("Retained failed conversion at %s", dest)
+	return dest
+}
+
+// retainedFailure returns where the last failure of conv is kept, or ""
+// if it isn't, or no longer is.
+func (cm *ConversionManager) retainedFailure(conv *Conversion) string {
+	if conv.retainedDir == "" {
+		return ""
+	}
+	if _, err := os.Stat(conv.retainedDir); err != nil {
+		return ""
+	}
+	return conv.retainedDir
+}
+
+// pruneFailures removes the failed conversions retained for longer than
+// FAILED_CONVERSION_RETENTION, or all of them once it is disabled, then
+// the oldest ones until they fit in FAILED_CONVERSION_MAX_BYTES.
+func (cm *ConversionManager) pruneFailures() {
+	cm.failuresMu.Lock()
+	defer cm.failuresMu.Unlock()
+	entries, err := os.ReadDir(cm.failuresDir())
+	if err != nil {
+		return
+	}
+	type failure struct {
+		name     string
+		modified time.Time
+		size     int64
+	}
+	remove := func(name string) {
+		if err := os.RemoveAll(filepath.Join(cm.failuresDir(), name)); err != nil {
+			log.Printf("Failed to remove retained failure %s: %s", name, err)
+		}
+	}
+	expired := time.Now().Add(-cm.config.FailedConversionRetention)
+	kept := make([]failure, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().After(expired) {
+			remove(entry.Name())
+			continue
+		}
+		size := dirSize(filepath.Join(cm.failuresDir(), entry.Name()))
+		kept = append(kept, failure{name: entry.Name(), modified: info.ModTime(), size: size})
+		total += size
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].modified.Before(kept[j].modified) })
+	for _, failure := range kept {
+		if total <= cm.config.FailedConversionMaxBytes {
+			break
+		}
+		log.Printf("Retained failures take %d bytes, past %d bytes, removing %s", total, cm.config.FailedConversionMaxBytes, failure.name)
+		remove(failure.name)
+		total -= failure.size
+	}
+}
+
+// deleteUserFailures removes the retained failed conversions of did,
+// returning how many there were.
+func (cm *ConversionManager) deleteUserFailures(did string) int {
+	entries, err := os.ReadDir(cm.failuresDir())
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, fmt.Sprintf("hls_%s_", did)) && !strings.HasPrefix(name, fmt.Sprintf("mp4_%s_", did)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(cm.failuresDir(), name)); err == nil {
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetainFailure(t *testing.T) {
+	config := testConfig(t)
+	config.FailedConversionRetention = time.Hour
+	config.FailedConversionMaxBytes = 1 << 20
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+
+	outputDir, err := config.mkdirTemp("hls_did:plc:a_cid_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, "segment0.ts"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dest := cm.retainFailure(outputDir, errors.New("ffmpeg error: exit status 1"), "the whole output")
+	if dest == "" || !strings.HasPrefix(dest, cm.failuresDir()) {
+		t.Fatalf("expected the failure to be retained in %s, got %q", cm.failuresDir(), dest)
+	}
+	if segment, err := os.ReadFile(filepath.Join(dest, "segment0.ts")); err != nil || string(segment) != "partial" {
+		t.Errorf("expected the output to be moved, got %q, %v", segment, err)
+	}
+	ffmpegLog, _ := os.ReadFile(filepath.Join(dest, "ffmpeg.log"))
+	if !strings.Contains(string(ffmpegLog), "exit status 1") || !strings.Contains(string(ffmpegLog), "the whole output") {
+		t.Errorf("ffmpeg.log: got %q", ffmpegLog)
+	}
+}
+
+func TestPruneFailures(t *testing.T) {
+	config := testConfig(t)
+	config.FailedConversionRetention = time.Hour
+	config.FailedConversionMaxBytes = 10
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+
+	failure := func(name string, age time.Duration) string {
+		dir := filepath.Join(cm.failuresDir(), name)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "ffmpeg.log"), []byte("6bytes"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-age)
+		if err := os.Chtimes(dir, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	expired := failure("expired", 2*time.Hour)
+	oldest := failure("oldest", 30*time.Minute)
+	newest := failure("newest", time.Minute)
+
+	cm.pruneFailures()
+	for dir, kept := range map[string]bool{expired: false, oldest: false, newest: true} {
+		if _, err := os.Stat(dir); (err == nil) != kept {
+			t.Errorf("%s: expected kept to be %v", filepath.Base(dir), kept)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Runner runs the external commands (ffmpeg, ffprobe) behind conversions,
+// so they can be replaced by a fake that writes canned output.
+type Runner interface {
+	// Output runs a command and returns its stdout. The command is
+	// killed once ctx is done.
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+	// CombinedOutput runs a command and returns its stdout and stderr.
+	CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+type execRunner struct{}
+
+func (execRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).Output()
+}
+
+func (execRunner) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+var ffmpegLogLevels = []string{"quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug", "trace"}
+
+// DryRunError is returned instead of running ffmpeg when FFMPEG_DRY_RUN
+// is set, carrying the command that would have run.
+type DryRunError struct {
+	Command string
+}
+
+func (e *DryRunError) Error() string {
+	return "ffmpeg dry run: " + e.Command
+}
+
+// runFFmpeg runs ffmpeg with args, returning its combined output.
+func (cm *ConversionManager) runFFmpeg(ctx context.Context, args ...string) ([]byte, error) {
+	if cm.config.FFmpegLogLevel != "" {
+		args = append([]string{"-v", cm.config.FFmpegLogLevel}, args...)
+	}
+	name := "ffmpeg"
+	if cm.config.FFmpegNice > 0 {
+		args = append([]string{"-n", strconv.Itoa(cm.config.FFmpegNice), name}, args...)
+		name = "nice"
+	}
+	if cm.config.FFmpegDryRun {
+		command := shellQuote(append([]string{name}, args...))
+		log.Printf("ffmpeg dry run: %s", command)
+		return nil, &DryRunError{Command: command}
+	}
+	return cm.runner.CombinedOutput(ctx, name, args...)
+}
+
+// respondDryRun answers with the ffmpeg command if err is from a dry run,
+// reporting whether it did.
+func respondDryRun(c *gin.Context, err error) bool {
+	var dryRun *DryRunError
+	if !errors.As(err, &dryRun) {
+		return false
+	}
+	c.JSON(200, gin.H{"dryRun": true, "command": dryRun.Command})
+	return true
+}
+
+// shellQuote joins args into a command line that can be pasted in a shell.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=+,%") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// tonemapFilter converts HDR (PQ/HLG) video to SDR bt709.
+const tonemapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv"
+
+// segmentFilenamePattern is a printf pattern with a single, optionally
+// zero padded, %d for the segment number
+var segmentFilenamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]*%0?[0-9]*d[A-Za-z0-9_.-]*\.ts$`)
+
+var playlistTypes = []string{"vod", "event", "none"}
+
+var encodePresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+
+var scaleModes = []string{"fit", "cover"}
+
+// parseSize parses a WxH size. Both dimensions must be even, as 4:2:0
+// encoders can't handle odd ones.
+func parseSize(size string) (width, height int, err error) {
+	w, h, ok := strings.Cut(size, "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("size must look like WIDTHxHEIGHT, got %q", size)
+	}
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("size must look like WIDTHxHEIGHT, got %q", size)
+	}
+	if width%2 != 0 || height%2 != 0 {
+		return 0, 0, fmt.Errorf("size dimensions must be even, got %q", size)
+	}
+	return width, height, nil
+}
+
+// scaleFilter scales video into exactly size. "fit" keeps the whole
+// picture and pads it, "cover" fills the box and crops what overflows.
+func scaleFilter(mode, size string) string {
+	width, height, _ := parseSize(size)
+	if mode == "cover" {
+		return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,setsar=1",
+			width, height, width, height)
+	}
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1",
+		width, height, width, height)
+}
+
+// singleFileName is the file all segments go in with SINGLE_FILE_HLS.
+const singleFileName = "media.ts"
+
+// segmentFilename is the -hls_segment_filename of a conversion, relative
+// to its output dir. With SINGLE_FILE_HLS it is the single file instead
+// of a pattern.
+func (cm *ConversionManager) segmentFilename() string {
+	if cm.config.SingleFileHLS {
+		return singleFileName
+	}
+	return cm.config.SegmentFilename
+}
+
+// hlsArgs builds the ffmpeg arguments converting input into an HLS
+// playlist and segments inside outputDir. probe is the ffprobe result of
+// input, which may be nil if no option needs it.
+func (cm *ConversionManager) hlsArgs(input, outputDir string, probe *ProbeResult) []string {
+	length := cm.segmentLength(probe)
+	segmentLength := strconv.Itoa(length)
+	args, rotate := rotationArgs(probe)
+	ladder := len(cm.config.Renditions) > 0
+	args = append(args, cm.inputArgs(input)...)
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", cm.config.EncodePreset,
+		"-profile:v", "baseline",
+		// keyframes on segment boundaries give clean cuts and accurate seeking
+		"-force_key_frames", cm.keyframeExpr(length),
+	)
+	// ladder renditions have their own bitrates and sizes past level 3.0
+	if !ladder {
+		args = append(args, "-crf", strconv.Itoa(cm.config.CRF), "-level", "3.0")
+	}
+	if cm.config.MaxBitrate != "" && !ladder {
+		args = append(args, "-maxrate", cm.config.MaxBitrate, "-bufsize", cm.config.MaxBitrate)
+	}
+	if cm.config.GOPSize > 0 {
+		args = append(args, "-g", strconv.Itoa(cm.config.GOPSize))
+	}
+	args = append(args, cm.threadArgs()...)
+
+	var filters []string
+	if rotate != "" {
+		filters = append(filters, rotate)
+	}
+	if cm.config.TonemapHDR && probe != nil && probe.isHDR() {
+		filters = append(filters, tonemapFilter)
+	}
+	if cm.config.VideoSize != "" {
+		filters = append(filters, scaleFilter(cm.config.ScaleMode, cm.config.VideoSize))
+	}
+	if cm.config.ForceYUV420P && !ladder {
+		filters = append(filters, "format=yuv420p")
+	}
+	if graph := cm.videoFilterGraph(filters); graph != "" && !ladder {
+		args = append(args, "-vf", graph)
+	}
+	if cm.config.FastStartSegmentLength > 0 {
+		// -hls_init_time only applies until a bounded playlist is full,
+		// so instead segments are cut every FastStartSegmentLength at the
+		// next keyframe, and keyframes are only where segments should end
+		segmentLength = strconv.Itoa(cm.config.FastStartSegmentLength)
+		args = append(args, "-sc_threshold", "0", "-g", strconv.Itoa(fastStartGOPSize))
+	}
+	if cm.config.LowLatencyHLS {
+		// ffmpeg cuts parts, lowLatencySegments puts segments together
+		segmentLength = strconv.FormatFloat(cm.config.LowLatencyPartLength.Seconds(), 'f', -1, 64)
+	}
+	args = append(args,
+		"-start_number", strconv.Itoa(cm.config.SegmentStartNumber),
+		"-hls_time", segmentLength,
+		"-hls_list_size", "0",
+		"-f", "hls",
+	)
+	if cm.config.PlaylistType != "none" {
+		args = append(args, "-hls_playlist_type", cm.config.PlaylistType)
+	}
+	var hlsFlags []string
+	if cm.config.LowLatencyHLS {
+		// the playlist and segments are served while ffmpeg writes them,
+		// so they must only appear once complete. parts end between
+		// keyframes, only segments start with one
+		hlsFlags = append(hlsFlags, "temp_file", "split_by_time")
+	}
+	if cm.config.ProgramDateTime {
+		hlsFlags = append(hlsFlags, "program_date_time")
+	}
+	if cm.config.SingleFileHLS {
+		// segments become #EXT-X-BYTERANGE of one file, served with
+		// range requests
+		hlsFlags = append(hlsFlags, "single_file")
+	}
+	if len(hlsFlags) > 0 {
+		args = append(args, "-hls_flags", strings.Join(hlsFlags, "+"))
+	}
+	if ladder {
+		return append(args, cm.ladderArgs(outputDir, filters, probe)...)
+	}
+	if probe != nil {
+		audio := probe.audioStreams()
+		renditions := cm.config.AudioRenditions && len(audio) > 1
+		audioOnly := cm.config.AudioOnlyRendition && len(audio) > 0
+		if renditions || audioOnly {
+			return append(args, variantStreamArgs(outputDir, cm.segmentFilename(), audio, renditions, audioOnly)...)
+		}
+	}
+	if cm.config.LowLatencyHLS {
+		return append(args,
+			"-hls_segment_filename", filepath.Join(outputDir, lowLatencyPartFilename),
+			filepath.Join(outputDir, lowLatencyPartsPlaylist),
+		)
+	}
+	args = append(args,
+		"-hls_segment_filename", filepath.Join(outputDir, cm.segmentFilename()),
+		filepath.Join(outputDir, "playlist.m3u8"),
+	)
+	return args
+}
+
+var segmentLimitActions = []string{"adjust", "reject"}
+
+var errTooManySegments = errors.New("video is too long")
+
+// segmentLength is the segment length of converting a video, in seconds:
+// SegmentLength, unless the video would be cut into more than MaxSegments
+// segments and SEGMENT_LIMIT_ACTION=adjust, then the smallest multiple of
+// it that fits, so that keyframes still land on segment boundaries.
+func (cm *ConversionManager) segmentLength(probe *ProbeResult) int {
+	length := cm.config.SegmentLength
+	if cm.config.MaxSegments <= 0 || cm.config.SegmentLimitAction != "adjust" || probe == nil {
+		return length
+	}
+	duration, ok := probe.duration()
+	if !ok || duration <= float64(length*cm.config.MaxSegments) {
+		return length
+	}
+	return int(math.Ceil(duration/float64(length*cm.config.MaxSegments))) * length
+}
+
+// checkSegmentCount fails videos that would be cut into more than
+// MAX_SEGMENTS segments with SEGMENT_LIMIT_ACTION=reject, and logs the
+// segment length of those adjusted otherwise.
+func (cm *ConversionManager) checkSegmentCount(did, cid string, probe *ProbeResult) error {
+	if cm.config.MaxSegments <= 0 || probe == nil {
+		return nil
+	}
+	duration, ok := probe.duration()
+	if !ok {
+		return nil
+	}
+	segments := int(math.Ceil(duration / float64(cm.config.SegmentLength)))
+	if segments <= cm.config.MaxSegments {
+		return nil
+	}
+	if cm.config.SegmentLimitAction == "reject" {
+		return &ConversionError{
+			Kind: KindTooLong,
+			Err:  fmt.Errorf("%w: %.0fs would be %d segments, more than MAX_SEGMENTS (%d)", errTooManySegments, duration, segments, cm.config.MaxSegments),
+		}
+	}
+	log.Printf("Raising the segment length of %s/%s to %ds, %.0fs would be %d segments, more than MAX_SEGMENTS (%d)",
+		did, cid, cm.segmentLength(probe), duration, segments, cm.config.MaxSegments)
+	return nil
+}
+
+var languageCode = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// variantStreamArgs makes playlist.m3u8 a master playlist, with the video
+// and every other stream in their own media playlist, stream_<name>.m3u8.
+//
+// With renditions, the audio streams of a video are split into their own
+// renditions, each an #EXT-X-MEDIA in the "audio" group. With audioOnly,
+// the first audio stream is also its own audio-only variant, for very
+// low bandwidth.
+func variantStreamArgs(outputDir, segmentFilename string, audio []ProbeStream, renditions, audioOnly bool) []string {
+	args := []string{"-map", "0:v:0"}
+	var streamMap []string
+	// audio streams mapped so far
+	var mapped int
+	if renditions {
+		streamMap = append(streamMap, "v:0,agroup:audio,name:video")
+		for i, stream := range audio {
+			args = append(args, "-map", fmt.Sprintf("0:%d", stream.Index))
+			entry := fmt.Sprintf("a:%d,agroup:audio,name:audio%d", i, i)
+			if language := stream.Tags["language"]; languageCode.MatchString(language) {
+				entry += ",language:" + language
+			}
+			if i == 0 {
+				entry += ",default:yes"
+			}
+			streamMap = append(streamMap, entry)
+		}
+		mapped = len(audio)
+	} else {
+		args = append(args, "-map", fmt.Sprintf("0:%d", audio[0].Index))
+		streamMap = append(streamMap, "v:0,a:0,name:video")
+		mapped = 1
+	}
+	if audioOnly {
+		// outside of any group, so that it is listed as a variant
+		args = append(args, "-map", fmt.Sprintf("0:%d", audio[0].Index))
+		streamMap = append(streamMap, fmt.Sprintf("a:%d,name:audioonly", mapped))
+	}
+	return append(args,
+		"-c:a", "aac",
+		"-var_stream_map", strings.Join(streamMap, " "),
+		"-master_pl_name", "playlist.m3u8",
+		"-hls_segment_filename", filepath.Join(outputDir, "stream_%v_"+segmentFilename),
+		filepath.Join(outputDir, "stream_%v.m3u8"),
+	)
+}
+
+// fastStartGOPSize keeps the encoder from adding keyframes of its own with
+// a fast start, as each would end a segment.
+const fastStartGOPSize = 100000
+
+// keyframeExpr forces keyframes every KeyframeInterval seconds. With a
+// fast start, keyframes are only where segments end instead: the first
+// FastStartSegmentLength in, then every segmentLength.
+func (cm *ConversionManager) keyframeExpr(segmentLength int) string {
+	fastStart := cm.config.FastStartSegmentLength
+	if fastStart <= 0 {
+		return fmt.Sprintf("expr:gte(t,n_forced*%d)", cm.config.KeyframeInterval)
+	}
+	return fmt.Sprintf("expr:gte(t,if(eq(n_forced,0),0,%d+(n_forced-1)*%d))", fastStart, segmentLength)
+}
+
+// rotationArgs returns the input options and filter turning the video
+// of probe upright, or nothing if it isn't rotated. ffmpeg autorotates on
+// its own, but doing it explicitly keeps the rotation ahead of our own
+// filters whatever the ffmpeg version.
+func rotationArgs(probe *ProbeResult) (args []string, filter string) {
+	if probe == nil {
+		return nil, ""
+	}
+	switch probe.rotation() {
+	case 90:
+		filter = "transpose=clock"
+	case 180:
+		filter = "hflip,vflip"
+	case 270:
+		filter = "transpose=cclock"
+	default:
+		return nil, ""
+	}
+	return []string{"-noautorotate"}, filter
+}
+
+// threadArgs caps the threads of the encoder to FFMPEG_THREADS.
+func (cm *ConversionManager) threadArgs() []string {
+	if cm.config.FFmpegThreads <= 0 {
+		return nil
+	}
+	return []string{"-threads", strconv.Itoa(cm.config.FFmpegThreads)}
+}
+
+var (
+	inputOptionName = regexp.MustCompile(`^-[a-z][a-z0-9_:]*$`)
+	negativeNumber  = regexp.MustCompile(`^-[0-9.]+$`)
+)
+
+// parseInputOptions splits ffmpeg input options into arguments, checking
+// they are pairs of an option and its value, e.g. "-reconnect 1".
+func parseInputOptions(options string) ([]string, error) {
+	args := strings.Fields(options)
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("expected pairs of an option and its value, got %q", options)
+	}
+	for i := 0; i < len(args); i += 2 {
+		name, value := args[i], args[i+1]
+		if !inputOptionName.MatchString(name) {
+			return nil, fmt.Errorf("invalid option %q", name)
+		}
+		if name == "-i" {
+			return nil, errors.New("-i can't be set, the input is always the blob")
+		}
+		if strings.HasPrefix(value, "-") && !negativeNumber.MatchString(value) {
+			return nil, fmt.Errorf("option %s has no value", name)
+		}
+	}
+	return args, nil
+}
+
+// inputArgs returns the arguments reading input, with
+// FFMPEG_NETWORK_OPTIONS before it when it is a URL, so that ffmpeg
+// reconnects to flaky upstreams instead of failing the encode.
+func (cm *ConversionManager) inputArgs(input string) []string {
+	if !strings.HasPrefix(input, "http://") && !strings.HasPrefix(input, "https://") {
+		return []string{"-i", input}
+	}
+	// checked by validate
+	args, _ := parseInputOptions(cm.config.FFmpegNetworkOptions)
+	return append(args, "-i", input)
+}
+
+// thumbnailArgs builds the ffmpeg arguments extracting the frame at the
+// at second mark of input into output. probe is the ffprobe result of
+// input, which may be nil. By default -ss goes before -i, seeking the
+// input near at, which is fast but may land on the wrong frame, accurate
+// puts it after -i to decode the video up to at instead.
+func (cm *ConversionManager) thumbnailArgs(input, output string, format ThumbnailFormat, at float64, accurate bool, probe *ProbeResult) []string {
+	args, rotate := rotationArgs(probe)
+	scale := scaleFilter(cm.config.ScaleMode, cm.config.ThumbnailSize)
+	if rotate != "" {
+		scale = rotate + "," + scale
+	}
+	seek := []string{"-ss", strconv.FormatFloat(at, 'f', 3, 64)}
+	if accurate {
+		args = append(args, cm.inputArgs(input)...)
+		args = append(args, seek...)
+	} else {
+		args = append(args, seek...)
+		args = append(args, cm.inputArgs(input)...)
+	}
+	args = append(args,
+		"-vframes", "1",
+		"-vf", scale,
+	)
+	args = append(args, cm.threadArgs()...)
+	args = append(args, format.CodecArgs...)
+	if format.Name == thumbnailJPEG.Name {
+		args = append(args, "-q:v", strconv.Itoa(cm.config.ThumbnailQuality))
+	}
+	return append(args, "-y", output)
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testConfig is the default configuration, working in a temp dir.
+func testConfig(t testing.TB) Config {
+	return Config{
+		WorkDir:                t.TempDir(),
+		BlobSource:             "appview",
+		RetryCooldown:          time.Minute,
+		SegmentLength:          10,
+		KeyframeInterval:       10,
+		SegmentLimitAction:     "adjust",
+		SegmentFilename:        "segment%d.ts",
+		PlaylistType:           "vod",
+		CacheControlPlaylist:   "public, max-age=300",
+		CacheControlSegment:    "public, max-age=31536000, immutable",
+		CacheControlThumbnail:  "public, max-age=31536000",
+		MaxUploadBytes:         100000000,
+		ForceYUV420P:           true,
+		FFmpegThreads:          1,
+		EncodePreset:           "veryfast",
+		CRF:                    23,
+		ScaleMode:              "fit",
+		ThumbnailSize:          "480x270",
+		ThumbnailQuality:       4,
+		ThumbnailSeek:          "fast",
+		AllowedUploadTypes:     "video/mp4,video/quicktime,video/webm",
+		UploadExpiry:           time.Hour,
+		UploadMode:             "pds",
+		MaxConversions:         1000,
+		PrepareConcurrency:     2,
+		UploadConcurrency:      2,
+		UploadQueueSize:        10,
+		MaxConcurrentDownloads: 2,
+		AppviewFailureCooldown: 30 * time.Second,
+		SegmentLogSampleRate:   1,
+	}
+}
+
+// fakeProbe is what the fake ffprobe reports for every input: a 25 second
+// 640x360 H.264 video in an MP4.
+const fakeProbe = `{
+	"streams": [{"index": 0, "codec_type": "video", "codec_name": "h264", "pix_fmt": "yuv420p", "width": 640, "height": 360}],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "25.000000"}
+}`
+
+// fakeRunner stands in for ffmpeg and ffprobe. ffprobe answers fakeProbe,
+// ffmpeg writes a canned playlist and its segments (one per variant and a
+// master playlist with -var_stream_map, cut every -hls_time with
+// split_by_time), or a placeholder for other outputs (thumbnails, MP4s).
+type fakeRunner struct {
+	// bytes of its input ffmpeg reads before writing anything, like it
+	// would to produce its first segment
+	readInput int64
+	// returned by ffmpeg instead of writing its output, if set
+	err error
+	// what ffprobe answers instead of fakeProbe, if set
+	probe string
+	// how long ffmpeg runs, like a slow transcode
+	delay time.Duration
+
+	mu    sync.Mutex
+	calls [][]string
+}
+
+func (f *fakeRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	f.record(name, args)
+	if name != "ffprobe" {
+		return nil, fmt.Errorf("unexpected command %s", name)
+	}
+	if f.probe != "" {
+		return []byte(f.probe), nil
+	}
+	return []byte(fakeProbe), nil
+}
+
+func (f *fakeRunner) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	f.record(name, args)
+	if name != "ffmpeg" {
+		return nil, fmt.Errorf("unexpected command %s", name)
+	}
+	if f.readInput > 0 {
+		if err := readFakeInput(ctx, argAfter(args, "-i"), f.readInput); err != nil {
+			return []byte(err.Error()), err
+		}
+	}
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return []byte("fake ffmpeg failed"), f.err
+	}
+
+	output := args[len(args)-1]
+	if filepath.Ext(output) != ".m3u8" {
+		return nil, os.WriteFile(output, []byte("fake "+filepath.Ext(output)), 0o600)
+	}
+	pattern := argAfter(args, "-hls_segment_filename")
+	playlistType := argAfter(args, "-hls_playlist_type")
+	durations := []float64{10, 10, 5}
+	if strings.Contains(argAfter(args, "-hls_flags"), "split_by_time") {
+		length, err := strconv.ParseFloat(argAfter(args, "-hls_time"), 64)
+		if err != nil {
+			return nil, err
+		}
+		durations = nil
+		for start := 0.0; start < 25; start += length {
+			durations = append(durations, min(length, 25-start))
+		}
+	}
+	streamMap := argAfter(args, "-var_stream_map")
+	if streamMap == "" {
+		return nil, writeFakePlaylist(output, pattern, playlistType, durations)
+	}
+	master := "#EXTM3U\n#EXT-X-VERSION:3\n"
+	for _, entry := range strings.Fields(streamMap) {
+		var name string
+		for _, field := range strings.Split(entry, ",") {
+			if value, ok := strings.CutPrefix(field, "name:"); ok {
+				name = value
+			}
+		}
+		variant := strings.ReplaceAll(output, "%v", name)
+		if err := writeFakePlaylist(variant, strings.ReplaceAll(pattern, "%v", name), playlistType, durations); err != nil {
+			return nil, err
+		}
+		master += "#EXT-X-STREAM-INF:BANDWIDTH=1000000\n" + filepath.Base(variant) + "\n"
+	}
+	return nil, os.WriteFile(filepath.Join(filepath.Dir(output), argAfter(args, "-master_pl_name")), []byte(master), 0o600)
+}
+
+// writeFakePlaylist writes a media playlist of segments of durations to
+// output, with segments named after pattern.
+func writeFakePlaylist(output, pattern, playlistType string, durations []float64) error {
+	playlist := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n"
+	if playlistType != "" {
+		playlist += "#EXT-X-PLAYLIST-TYPE:" + strings.ToUpper(playlistType) + "\n"
+	}
+	for i, duration := range durations {
+		segment := fmt.Sprintf(pattern, i)
+		if err := os.WriteFile(segment, []byte(fmt.Sprintf("segment %d", i)), 0o600); err != nil {
+			return err
+		}
+		playlist += fmt.Sprintf("#EXTINF:%f,\n%s\n", duration, filepath.Base(segment))
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	return os.WriteFile(output, []byte(playlist), 0o600)
+}
+
+func (f *fakeRunner) record(name string, args []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, append([]string{name}, args...))
+}
+
+// runs returns how many times name ran.
+func (f *fakeRunner) runs(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, call := range f.calls {
+		if call[0] == name {
+			n++
+		}
+	}
+	return n
+}
+
+func argAfter(args []string, name string) string {
+	i := slices.Index(args, name)
+	if i < 0 || i+1 >= len(args) {
+		return ""
+	}
+	return args[i+1]
+}
+
+// readFakeInput reads n bytes of input, a file or URL, like ffmpeg would.
+func readFakeInput(ctx context.Context, input string, n int64) error {
+	var r io.ReadCloser
+	if strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") {
+		req, err := http.NewRequestWithContext(ctx, "GET", input, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("input: HTTP %d", resp.StatusCode)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		r = file
+	}
+	defer r.Close()
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// newTestState is a State converting with runner, serving the watch routes
+// on its router.
+func newTestState(t testing.TB, config Config, runner Runner) (*State, *gin.Engine) {
+	gin.SetMode(gin.ReleaseMode)
+	cm := NewConversionManager(config, noopReporter{})
+	cm.runner = runner
+	t.Cleanup(cm.cleanupTicker.Stop)
+	s := &State{cm: cm, config: config, reporter: noopReporter{}}
+	r := gin.New()
+	r.GET("/watch/:did/:cid/*filepath", s.getVideoOrThumbnail)
+	r.HEAD("/watch/:did/:cid/*filepath", s.getVideoOrThumbnail)
+	return s, r
+}
+
+func get(r http.Handler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestWatchWithFakeFFmpeg(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	runner := &fakeRunner{}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+
+	// HEAD never starts a conversion
+	if w := get(r, "HEAD", base+"playlist.m3u8"); w.Code != http.StatusNotFound {
+		t.Fatalf("HEAD before converting: got %d", w.Code)
+	}
+	w := get(r, "GET", base+"playlist.m3u8")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "segment2.ts") {
+		t.Fatalf("playlist: got %d %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/vnd.apple.mpegurl" {
+		t.Errorf("playlist Content-Type %q", got)
+	}
+	w = get(r, "GET", base+"segment1.ts")
+	if w.Code != http.StatusOK || w.Body.String() != "segment 1" {
+		t.Fatalf("segment: got %d %q", w.Code, w.Body)
+	}
+	if w := get(r, "HEAD", base+"segment1.ts"); w.Code != http.StatusOK {
+		t.Fatalf("HEAD after converting: got %d", w.Code)
+	}
+	if w := get(r, "GET", base+"segment9.ts"); w.Code != http.StatusNotFound {
+		t.Fatalf("missing segment: got %d", w.Code)
+	}
+	if w := get(r, "GET", base+"thumbnail.jpg"); w.Code != http.StatusOK || w.Body.String() != "fake .jpg" {
+		t.Fatalf("thumbnail: got %d %q", w.Code, w.Body)
+	}
+	// served from the cache afterwards
+	get(r, "GET", base+"playlist.m3u8")
+	get(r, "GET", base+"thumbnail.jpg")
+	if runner.runs("ffmpeg") != 2 {
+		t.Errorf("expected one conversion and one thumbnail, ffmpeg ran %d times", runner.runs("ffmpeg"))
+	}
+}
+
+func TestWatchFailedConversion(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	runner := &fakeRunner{err: fmt.Errorf("exit status 1")}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/watch/%s/%s/playlist.m3u8", did, blobCID)
+	if w := get(r, "GET", path); w.Code < 500 {
+		t.Fatalf("failed conversion: got %d", w.Code)
+	}
+	// failures are cached for RETRY_COOLDOWN
+	w := get(r, "GET", path)
+	if w.Code < 500 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("cached failure: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// the conversion and the thumbnail taken along with it
+	if runner.runs("ffmpeg") != 2 {
+		t.Errorf("expected the failure to be cached, ffmpeg ran %d times", runner.runs("ffmpeg"))
+	}
+}
+
+func TestConversionWaitTimeout(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	config.ConversionWaitTimeout = 20 * time.Millisecond
+	runner := &fakeRunner{delay: 200 * time.Millisecond}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+
+	for _, filename := range []string{"playlist.m3u8", "thumbnail.jpg"} {
+		w := get(r, "GET", base+filename)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("%s while converting: got %d, Retry-After %q", filename, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	// the conversion keeps running, and can't be evicted meanwhile
+	conv, release, ok := s.cm.lookupConversion(did, blobCID.String())
+	if !ok {
+		t.Fatal("expected the conversion to be cached")
+	}
+	conv.mu.Lock()
+	users := conv.users
+	conv.mu.Unlock()
+	release()
+	if users != 2 {
+		t.Errorf("expected the background conversion to hold the conversion, got %d users", users-1)
+	}
+
+	for _, filename := range []string{"playlist.m3u8", "thumbnail.jpg"} {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+			w := get(r, "GET", base+filename)
+			if w.Code == http.StatusOK {
+				break
+			}
+			if w.Code != http.StatusServiceUnavailable || time.Now().After(deadline) {
+				t.Fatalf("%s after converting: got %d", filename, w.Code)
+			}
+		}
+	}
+	if runner.runs("ffmpeg") != 2 {
+		t.Errorf("expected later requests to join the running conversion, ffmpeg ran %d times", runner.runs("ffmpeg"))
+	}
+}
+
+func TestEncodeArgs(t *testing.T) {
+	config := testConfig(t)
+	config.EncodePreset = "slow"
+	config.CRF = 28
+	config.MaxBitrate = "2M"
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+	cm.runner = &fakeRunner{}
+	probe, err := cm.probe(context.Background(), "input.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, args := range map[string][]string{
+		"hls": cm.hlsArgs("input.mp4", t.TempDir(), probe),
+		"mp4": cm.mp4Args("input.mp4", "video.mp4", nil),
+	} {
+		for flag, value := range map[string]string{"-preset": "slow", "-crf": "28", "-maxrate": "2M", "-bufsize": "2M"} {
+			if got := argAfter(args, flag); got != value {
+				t.Errorf("%s: %s is %q, expected %q in %q", name, flag, got, value, args)
+			}
+		}
+	}
+}
+
+func TestPlaylistType(t *testing.T) {
+	for playlistType, tag := range map[string]string{"vod": "#EXT-X-PLAYLIST-TYPE:VOD", "event": "#EXT-X-PLAYLIST-TYPE:EVENT", "none": ""} {
+		config := testConfig(t)
+		config.UploadMode = "local"
+		config.PlaylistType = playlistType
+		s, r := newTestState(t, config, &fakeRunner{})
+		const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+		blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := get(r, "GET", fmt.Sprintf("/watch/%s/%s/playlist.m3u8", did, blobCID))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "#EXT-X-ENDLIST") {
+			t.Fatalf("%s: got %d %q", playlistType, w.Code, w.Body)
+		}
+		hasTag := strings.Contains(w.Body.String(), "#EXT-X-PLAYLIST-TYPE:")
+		if tag == "" && hasTag || tag != "" && !strings.Contains(w.Body.String(), tag) {
+			t.Errorf("%s: expected %q in %q", playlistType, tag, w.Body)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	const rotated = `{
+	"streams": [{"index": 0, "codec_type": "video", "codec_name": "h264", "pix_fmt": "yuv420p", "width": 1920, "height": 1080%s}],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "25.000000"}
+}`
+	for _, tc := range []struct {
+		name   string
+		stream string
+		filter string
+	}{
+		{"none", ``, ""},
+		{"display matrix 90", `, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]`, "transpose=clock"},
+		{"display matrix 270", `, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": 90}]`, "transpose=cclock"},
+		{"rotate tag 180", `, "tags": {"rotate": "180"}`, "hflip,vflip"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cm := NewConversionManager(testConfig(t), noopReporter{})
+			t.Cleanup(cm.cleanupTicker.Stop)
+			cm.runner = &fakeRunner{probe: fmt.Sprintf(rotated, tc.stream)}
+			probe, err := cm.probe(context.Background(), "input.mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hls := cm.hlsArgs("input.mp4", t.TempDir(), probe)
+			thumbnail := cm.thumbnailArgs("input.mp4", "thumbnail.jpg", thumbnailJPEG, 0, false, probe)
+			if tc.filter == "" {
+				if slices.Contains(hls, "-noautorotate") || strings.Contains(argAfter(hls, "-vf"), "transpose") {
+					t.Errorf("hls: expected no rotation in %q", hls)
+				}
+				return
+			}
+			for name, args := range map[string][]string{"hls": hls, "thumbnail": thumbnail} {
+				if !slices.Contains(args, "-noautorotate") || !strings.HasPrefix(argAfter(args, "-vf"), tc.filter) {
+					t.Errorf("%s: expected -noautorotate and %s first in -vf, got %q", name, tc.filter, args)
+				}
+			}
+		})
+	}
+}
+
+func TestThumbnailSeek(t *testing.T) {
+	cm := NewConversionManager(testConfig(t), noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+	for accurate, seekFirst := range map[bool]bool{false: true, true: false} {
+		args := cm.thumbnailArgs("input.mp4", "thumbnail.jpg", thumbnailJPEG, 2.5, accurate, nil)
+		ss, i := slices.Index(args, "-ss"), slices.Index(args, "-i")
+		if ss < 0 || i < 0 || (ss < i) != seekFirst || argAfter(args, "-ss") != "2.500" {
+			t.Errorf("accurate %v: got %q", accurate, args)
+		}
+	}
+
+	for _, tc := range []struct {
+		config string
+		query  string
+		want   bool
+	}{
+		{"fast", "", false},
+		{"accurate", "", true},
+		{"fast", "?seek=accurate", true},
+		{"accurate", "?seek=fast", false},
+		{"fast", "?seek=bogus", false},
+	} {
+		cm.config.ThumbnailSeek = tc.config
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/watch/did/cid/thumbnail.jpg"+tc.query, nil)
+		if got := cm.thumbnailAccurate(c); got != tc.want {
+			t.Errorf("THUMBNAIL_SEEK=%s %q: got %v", tc.config, tc.query, got)
+		}
+	}
+	if thumbnailKey("did", "cid", thumbnailJPEG, 1, true) == thumbnailKey("did", "cid", thumbnailJPEG, 1, false) {
+		t.Error("expected accurate and fast thumbnails to be cached apart")
+	}
+}
+
+func TestUndecodableSource(t *testing.T) {
+	for name, tc := range map[string]struct {
+		probe string
+		err   error
+	}{
+		"encrypted": {`{
+	"streams": [{"index": 0, "codec_type": "video", "codec_name": "h264", "codec_tag_string": "encv"}],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "25.000000"}
+}`, errEncryptedSource},
+		"encryption side data": {`{
+	"streams": [{"index": 0, "codec_type": "audio", "codec_name": "aac", "side_data_list": [{"side_data_type": "Encryption info"}]}],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "25.000000"}
+}`, errEncryptedSource},
+		"no decoder": {`{
+	"streams": [{"index": 0, "codec_type": "video", "codec_name": "none"}, {"index": 1, "codec_type": "data", "codec_name": "bin_data"}],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "25.000000"}
+}`, errNoDecodableStream},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := testConfig(t)
+			config.UploadMode = "local"
+			runner := &fakeRunner{probe: tc.probe}
+			s, r := newTestState(t, config, runner)
+			probe, err := s.cm.probe(context.Background(), "input.mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := probe.checkDecodable(); !errors.Is(err, tc.err) {
+				t.Errorf("expected %v, got %v", tc.err, err)
+			}
+
+			const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+			blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := get(r, "GET", fmt.Sprintf("/watch/%s/%s/playlist.m3u8", did, blobCID))
+			if w.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("expected 415, got %d", w.Code)
+			}
+			if runner.runs("ffmpeg") != 0 {
+				t.Errorf("expected ffmpeg not to run, it ran %d times", runner.runs("ffmpeg"))
+			}
+		})
+	}
+}
+
+// segmentDurations simulates how ffmpeg cuts a video of duration seconds
+// with args: keyframes are forced by -force_key_frames, and a segment
+// ends at the first keyframe at least -hls_time after its start.
+func segmentDurations(t *testing.T, args []string, duration float64) []float64 {
+	t.Helper()
+	expr := argAfter(args, "-force_key_frames")
+	var fastStart, segmentLength, interval int
+	var threshold func(n int) float64
+	if n, _ := fmt.Sscanf(expr, "expr:gte(t,if(eq(n_forced,0),0,%d+(n_forced-1)*%d))", &fastStart, &segmentLength); n == 2 {
+		threshold = func(n int) float64 {
+			if n == 0 {
+				return 0
+			}
+			return float64(fastStart + (n-1)*segmentLength)
+		}
+	} else if n, _ := fmt.Sscanf(expr, "expr:gte(t,n_forced*%d)", &interval); n == 1 {
+		threshold = func(n int) float64 { return float64(n * interval) }
+	} else {
+		t.Fatalf("unexpected keyframe expression %q", expr)
+	}
+	hlsTime, err := strconv.ParseFloat(argAfter(args, "-hls_time"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var durations []float64
+	start, forced := 0.0, 0
+	// 25 fps
+	for frame := 0; float64(frame)/25 < duration; frame++ {
+		at := float64(frame) / 25
+		if at < threshold(forced) {
+			continue
+		}
+		forced++
+		if at-start >= hlsTime {
+			durations = append(durations, at-start)
+			start = at
+		}
+	}
+	return append(durations, duration-start)
+}
+
+func TestFastStart(t *testing.T) {
+	config := testConfig(t)
+	config.SegmentLength = 6
+	config.KeyframeInterval = 6
+	for fastStart, want := range map[int][]float64{0: {6, 6, 6, 6, 1}, 2: {2, 6, 6, 6, 5}} {
+		config.FastStartSegmentLength = fastStart
+		cm := NewConversionManager(config, noopReporter{})
+		t.Cleanup(cm.cleanupTicker.Stop)
+		args := cm.hlsArgs("input.mp4", t.TempDir(), nil)
+		if got := segmentDurations(t, args, 25); !slices.Equal(got, want) {
+			t.Errorf("FAST_START_SEGMENT_LENGTH=%d: expected segments of %v, got %v", fastStart, want, got)
+		}
+		if fastStart > 0 && (argAfter(args, "-sc_threshold") != "0" || argAfter(args, "-g") != strconv.Itoa(fastStartGOPSize)) {
+			t.Errorf("expected the encoder not to add keyframes of its own with a fast start, got %q", args)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Segment struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	// where the segment starts in Filename, for the byte ranges of
+	// SINGLE_FILE_HLS
+	Offset   *int64  `json:"offset,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+type SegmentList struct {
+	TotalSegments int       `json:"totalSegments"`
+	TotalDuration float64   `json:"totalDuration"`
+	Segments      []Segment `json:"segments"`
+	// the segments of each variant of a master playlist, the ones above
+	// are those of the first
+	Variants []VariantSegmentList `json:"variants,omitempty"`
+}
+
+// VariantSegmentList is the SegmentList of a variant stream.
+type VariantSegmentList struct {
+	Playlist string `json:"playlist"`
+	SegmentList
+}
+
+// parsePlaylist reads the media segments out of an HLS media playlist, in
+// order, with the durations given by their #EXTINF tags and the byte
+// ranges given by their #EXT-X-BYTERANGE tags, if any. It also reports
+// whether the playlist is finished (has #EXT-X-ENDLIST).
+func parsePlaylist(playlist []byte) ([]Segment, bool, error) {
+	segments := make([]Segment, 0)
+	ended := false
+	var duration float64
+	hasDuration := false
+	var byteRange *Segment
+	// a byte range without offset starts where the last one of its file
+	// ended
+	rangeEnds := make(map[string]int64)
+
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			d, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid EXTINF %q: %w", line, err)
+			}
+			duration = d
+			hasDuration = true
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			value := strings.TrimPrefix(line, "#EXT-X-BYTERANGE:")
+			length, offset, hasOffset := strings.Cut(value, "@")
+			size, err := strconv.ParseInt(length, 10, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid EXT-X-BYTERANGE %q: %w", line, err)
+			}
+			byteRange = &Segment{Size: size}
+			if hasOffset {
+				start, err := strconv.ParseInt(offset, 10, 64)
+				if err != nil {
+					return nil, false, fmt.Errorf("invalid EXT-X-BYTERANGE %q: %w", line, err)
+				}
+				byteRange.Offset = &start
+			}
+		case line == "#EXT-X-ENDLIST":
+			ended = true
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			if !hasDuration {
+				return nil, false, fmt.Errorf("segment %s has no EXTINF", line)
+			}
+			segment := Segment{Filename: line, Duration: duration}
+			if byteRange != nil {
+				segment.Size = byteRange.Size
+				segment.Offset = byteRange.Offset
+				if segment.Offset == nil {
+					start := rangeEnds[line]
+					segment.Offset = &start
+				}
+				rangeEnds[line] = *segment.Offset + segment.Size
+			}
+			segments = append(segments, segment)
+			hasDuration = false
+			byteRange = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return segments, ended, nil
+}
+
+// targetDuration returns the #EXT-X-TARGETDURATION of a playlist, in
+// seconds, if it has one.
+func targetDuration(playlist []byte) (int, bool) {
+	for _, line := range strings.Split(string(playlist), "\n") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXT-X-TARGETDURATION:")
+		if ok {
+			n, err := strconv.Atoi(value)
+			return n, err == nil && n > 0
+		}
+	}
+	return 0, false
+}
+
+// lowLatencyTarget is the target duration of the conversion being served
+// with LL_HLS: the one of its playlist once written, which ffmpeg raises
+// for segments longer than asked, or else the segment length it was
+// started with, which SEGMENT_LIMIT_ACTION=adjust may have raised.
+func (s *State) lowLatencyTarget(conv *Conversion, playlistPath string) time.Duration {
+	if playlist, err := os.ReadFile(playlistPath); err == nil {
+		if target, ok := targetDuration(playlist); ok {
+			return time.Duration(target) * time.Second
+		}
+	}
+	conv.mu.Lock()
+	length := conv.segmentLength
+	conv.mu.Unlock()
+	if length <= 0 {
+		length = s.config.SegmentLength
+	}
+	return time.Duration(length) * time.Second
+}
+
+// serveLowLatency serves a conversion while it is still running, so that
+// playback starts with the first segment instead of the whole transcode.
+// Playlists list partial segments (see llhls.go). Playlist requests with
+// _HLS_msn block until that segment is listed, or its part _HLS_part, and
+// requests for segments and parts block until they are written, all
+// bounded by three target durations like the HLS spec asks of blocking
+// reloads.
+func (s *State) serveLowLatency(c *gin.Context, did, cid string, conv *Conversion, filename string) {
+	msn, err := strconv.Atoi(c.Query("_HLS_msn"))
+	hasMsn := err == nil
+	part := -1
+	if c.Query("_HLS_part") != "" {
+		part, err = strconv.Atoi(c.Query("_HLS_part"))
+		if err != nil || part < 0 || !hasMsn {
+			c.AbortWithError(http.StatusBadRequest, errors.New("_HLS_part must be a part number, with _HLS_msn"))
+			return
+		}
+	}
+
+	playlistPath := filepath.Join(conv.OutputDir, "playlist.m3u8")
+	if _, err := os.Stat(playlistPath); err == nil {
+		// finished, or converted before LL_HLS was set
+		s.serveConversionFile(c, conv, filename)
+		return
+	}
+	// joins this conversion if it is already running
+	// served across many requests, so none of them may cancel it
+	go s.cm.convertToHLS(context.Background(), did, cid, conv)
+
+	var ready func() bool
+	if filename == "playlist.m3u8" {
+		ready = func() bool {
+			progress, err := s.cm.readLowLatencyProgress(conv)
+			if err != nil {
+				return false
+			}
+			return !hasMsn || s.cm.hasPart(progress, msn, part)
+		}
+	} else {
+		ready = func() bool {
+			// writes the segments the parts so far complete
+			s.cm.readLowLatencyProgress(conv)
+			_, err := os.Stat(filepath.Join(conv.OutputDir, filename))
+			return err == nil
+		}
+	}
+
+	timeout := 3 * s.lowLatencyTarget(conv, playlistPath)
+	if err := s.cm.waitForConversion(c.Request.Context(), conv, timeout, ready); err != nil {
+		if errors.Is(err, errWaitTimeout) {
+			c.Header("Retry-After", "1")
+			c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+		c.AbortWithError(errorStatus(err), err)
+		return
+	}
+
+	if filename != "playlist.m3u8" {
+		s.serveConversionFile(c, conv, filename)
+		return
+	}
+	progress, err := s.cm.readLowLatencyProgress(conv)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	playlist := s.cm.lowLatencyPlaylist(progress)
+	if s.config.HashedSegments {
+		playlist, err = s.cm.hashSegmentURIs(playlist, conv.OutputDir)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	s.servePlaylist(c, playlist)
+}
+
+// servePlaylist serves a playlist of the video in the request, pointing
+// its URIs at CDN_BASE_URL if set.
+func (s *State) servePlaylist(c *gin.Context, playlist []byte) {
+	if s.config.CDNBaseURL != "" {
+		base := fmt.Sprintf("%s/watch/%s/%s/", s.config.CDNBaseURL, c.Param("did"), c.Param("cid"))
+		playlist = rewriteURIs(playlist, base)
+	}
+	s.setCacheControl(c, cachePlaylist)
+	c.Data(http.StatusOK, contentTypes[".m3u8"], playlist)
+}
+
+// isMasterPlaylist reports whether playlist lists variant streams rather
+// than media segments.
+func isMasterPlaylist(playlist []byte) bool {
+	return bytes.Contains(playlist, []byte("#EXT-X-STREAM-INF:"))
+}
+
+// variantURIs returns the URIs of the variant streams of a master
+// playlist, in order.
+func variantURIs(playlist []byte) []string {
+	lines := strings.Split(string(playlist), "\n")
+	uris := make([]string, 0)
+	for i := 0; i+1 < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), "#EXT-X-STREAM-INF:") {
+			// the variant's URI is on the next line
+			uris = append(uris, strings.TrimSpace(lines[i+1]))
+			i++
+		}
+	}
+	return uris
+}
+
+// filterMasterPlaylist drops the variants and renditions of a master
+// playlist whose media playlist doesn't exist, e.g. because its encode
+// failed. It reports whether any variant stream remains.
+func filterMasterPlaylist(playlist []byte, exists func(uri string) bool) ([]byte, bool) {
+	lines := strings.Split(string(playlist), "\n")
+	out := make([]string, 0, len(lines))
+	variants := 0
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			// the variant's URI is on the next line
+			if i+1 < len(lines) && exists(strings.TrimSpace(lines[i+1])) {
+				out = append(out, lines[i], lines[i+1])
+				variants++
+			}
+			i++
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			match := uriAttribute.FindStringSubmatch(line)
+			if match == nil || exists(match[1]) {
+				out = append(out, lines[i])
+			}
+		default:
+			out = append(out, lines[i])
+		}
+	}
+	return []byte(strings.Join(out, "\n")), variants > 0
+}
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// rewriteURIs prefixes the relative URIs of a playlist, both URI lines and
+// URI attributes (e.g. of #EXT-X-MEDIA), with base.
+func rewriteURIs(playlist []byte, base string) []byte {
+	absolute := func(uri string) string {
+		if uri == "" || strings.Contains(uri, "://") || strings.HasPrefix(uri, "/") {
+			return uri
+		}
+		return base + uri
+	}
+
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			lines[i] = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := uriAttribute.FindStringSubmatch(attr)[1]
+				return `URI="` + absolute(uri) + `"`
+			})
+		default:
+			lines[i] = absolute(trimmed)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+var errWaitTimeout = errors.New("timed out waiting for conversion")
+
+// waitForConversion polls ready until it returns true, the conversion
+// fails, ctx is done or timeout passes.
+func (cm *ConversionManager) waitForConversion(ctx context.Context, conv *Conversion, timeout time.Duration, ready func() bool) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		if ready() {
+			return nil
+		}
+		conv.mu.Lock()
+		convErr := conv.Error
+		conv.mu.Unlock()
+		if convErr != nil {
+			return convErr
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return errWaitTimeout
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLowLatencyTarget(t *testing.T) {
+	config := testConfig(t)
+	s := &State{config: config}
+	conv := &Conversion{OutputDir: t.TempDir()}
+	playlistPath := filepath.Join(conv.OutputDir, "playlist.m3u8")
+
+	if got := s.lowLatencyTarget(conv, playlistPath); got != 10*time.Second {
+		t.Errorf("before converting: got %s, expected SEGMENT_LENGTH", got)
+	}
+	// raised by SEGMENT_LIMIT_ACTION=adjust
+	conv.segmentLength = 30
+	if got := s.lowLatencyTarget(conv, playlistPath); got != 30*time.Second {
+		t.Errorf("adjusted segment length: got %s", got)
+	}
+	// ffmpeg rounds up to the longest segment
+	if err := os.WriteFile(playlistPath, []byte("#EXTM3U\n#EXT-X-TARGETDURATION:32\n#EXTINF:31.5,\nsegment0.ts\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.lowLatencyTarget(conv, playlistPath); got != 32*time.Second {
+		t.Errorf("from the playlist: got %s", got)
+	}
+}
+
+func TestRewriteURIs(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="en",URI="stream_a0.m3u8"
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:10.000000,
+segment0.ts
+#EXTINF:10.000000,
+https://elsewhere.example/segment1.ts
+#EXTINF:5.000000,
+/absolute/segment2.ts
+#EXT-X-ENDLIST
+`
+	got := string(rewriteURIs([]byte(playlist), "https://cdn.example/watch/did:plc:a/cid/"))
+	for _, expected := range []string{
+		`URI="https://cdn.example/watch/did:plc:a/cid/stream_a0.m3u8"`,
+		`URI="https://cdn.example/watch/did:plc:a/cid/init.mp4"`,
+		"\nhttps://cdn.example/watch/did:plc:a/cid/segment0.ts\n",
+		// already absolute URIs are left alone
+		"\nhttps://elsewhere.example/segment1.ts\n",
+		"\n/absolute/segment2.ts\n",
+		"\n#EXTINF:10.000000,\n",
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("expected %q in\n%s", expected, got)
+		}
+	}
+}
+
+func TestServePlaylistCDN(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	config.CDNBaseURL = "https://cdn.example"
+	s, r := newTestState(t, config, &fakeRunner{})
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := get(r, "GET", fmt.Sprintf("/watch/%s/%s/playlist.m3u8", did, blobCID))
+	expected := fmt.Sprintf("https://cdn.example/watch/%s/%s/segment0.ts", did, blobCID)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), expected) {
+		t.Fatalf("got %d %q, expected %s", w.Code, w.Body, expected)
+	}
+	// only the served playlist, not the one on disk
+	conv, release, _ := s.cm.lookupConversion(did, blobCID.String())
+	defer release()
+	onDisk, err := os.ReadFile(filepath.Join(conv.OutputDir, "playlist.m3u8"))
+	if err != nil || strings.Contains(string(onDisk), "cdn.example") {
+		t.Errorf("expected the playlist on disk to be left alone, got %q %v", onDisk, err)
+	}
+}
+
+func TestFilterMasterPlaylist(t *testing.T) {
+	master := []byte(`#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="en",DEFAULT=YES,URI="stream_a0.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="fr",URI="stream_a1.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,AUDIO="audio"
+stream_720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,AUDIO="audio"
+stream_360p.m3u8
+`)
+	encoded := map[string]bool{"stream_360p.m3u8": true, "stream_a0.m3u8": true}
+	filtered, ok := filterMasterPlaylist(master, func(uri string) bool { return encoded[uri] })
+	if !ok {
+		t.Fatal("expected a variant to remain")
+	}
+	got := string(filtered)
+	for _, uri := range []string{"stream_720p.m3u8", "stream_a1.m3u8", "1280x720"} {
+		if strings.Contains(got, uri) {
+			t.Errorf("expected %s to be dropped from\n%s", uri, got)
+		}
+	}
+	for _, uri := range []string{"#EXTM3U", "RESOLUTION=640x360", "stream_360p.m3u8", "stream_a0.m3u8"} {
+		if !strings.Contains(got, uri) {
+			t.Errorf("expected %s to be kept in\n%s", uri, got)
+		}
+	}
+
+	if _, ok := filterMasterPlaylist(master, func(string) bool { return false }); ok {
+		t.Errorf("expected no variant to remain when none was encoded")
+	}
+}
+
+func TestServeMasterPlaylist(t *testing.T) {
+	s, r := newTestState(t, testConfig(t), &fakeRunner{})
+	conv := &Conversion{OutputDir: t.TempDir()}
+	r.GET("/files/:did/:cid/:filename", func(c *gin.Context) {
+		s.serveConversionFile(c, conv, c.Param("filename"))
+	})
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2000000\nstream_720p.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nstream_360p.m3u8\n"
+	if err := os.WriteFile(filepath.Join(conv.OutputDir, "playlist.m3u8"), []byte(master), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(r, "GET", "/files/did/cid/playlist.m3u8"); w.Code != http.StatusNotFound {
+		t.Errorf("no rendition encoded: got %d", w.Code)
+	}
+	if err := os.WriteFile(filepath.Join(conv.OutputDir, "stream_360p.m3u8"), []byte("#EXTM3U\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w := get(r, "GET", "/files/did/cid/playlist.m3u8")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "stream_720p") || !strings.Contains(w.Body.String(), "stream_360p") {
+		t.Errorf("one rendition encoded: got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestParsePlaylist(t *testing.T) {
+	segments, ended, err := parsePlaylist([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.000000,\nsegment0.ts\n#EXTINF:4.5,a title\n\nsegment1.ts\n#EXT-X-ENDLIST\n"))
+	want := []Segment{{Filename: "segment0.ts", Duration: 10}, {Filename: "segment1.ts", Duration: 4.5}}
+	if err != nil || !ended || !slices.EqualFunc(segments, want, func(a, b Segment) bool { return a.Filename == b.Filename && a.Duration == b.Duration }) {
+		t.Errorf("got %+v, ended %v, %v", segments, ended, err)
+	}
+	if _, ended, err := parsePlaylist([]byte("#EXTM3U\n#EXTINF:10,\nsegment0.ts\n")); err != nil || ended {
+		t.Errorf("unfinished playlist: ended %v, %v", ended, err)
+	}
+	for _, playlist := range []string{"#EXTM3U\nsegment0.ts\n", "#EXTM3U\n#EXTINF:ten,\nsegment0.ts\n"} {
+		if _, _, err := parsePlaylist([]byte(playlist)); err == nil {
+			t.Errorf("expected %q to fail", playlist)
+		}
+	}
+}
+
+func TestGetSegments(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	s, r := newTestState(t, config, &fakeRunner{})
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+	if w := get(r, "GET", base+"segments.json"); w.Code != http.StatusNotFound {
+		t.Errorf("before converting: got %d", w.Code)
+	}
+
+	get(r, "GET", base+"playlist.m3u8")
+	w := get(r, "GET", base+"segments.json")
+	var list SegmentList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body, err)
+	}
+	if list.TotalSegments != 3 || list.TotalDuration != 25 || len(list.Segments) != 3 {
+		t.Fatalf("got %+v", list)
+	}
+	for i, segment := range list.Segments {
+		if segment.Filename != fmt.Sprintf("segment%d.ts", i) || segment.Size != int64(len(fmt.Sprintf("segment %d", i))) {
+			t.Errorf("segment %d: got %+v", i, segment)
+		}
+	}
+}
+
+func TestGetSegmentsLadder(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	renditions, err := loadRenditions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Renditions = renditions
+	runner := &fakeRunner{probe: strings.ReplaceAll(strings.ReplaceAll(fakeProbe, "640", "1920"), "360", "1080")}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+
+	get(r, "GET", base+"playlist.m3u8")
+	w := get(r, "GET", base+"segments.json")
+	var list SegmentList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("%d %s: %v", w.Code, w.Body, err)
+	}
+	if len(list.Variants) != len(renditions) {
+		t.Fatalf("expected %d variants, got %+v", len(renditions), list.Variants)
+	}
+	for i, variant := range list.Variants {
+		name := renditions[i].Name
+		if variant.Playlist != "stream_"+name+".m3u8" || variant.TotalSegments != 3 || variant.TotalDuration != 25 {
+			t.Errorf("variant %d: got %+v", i, variant)
+		}
+		if variant.Segments[0].Filename != "stream_"+name+"_segment0.ts" {
+			t.Errorf("variant %d: got %+v", i, variant.Segments)
+		}
+	}
+	// the first variant is also at the top, for clients of media playlists
+	if list.TotalSegments != 3 || list.Segments[0].Filename != "stream_360p_segment0.ts" {
+		t.Errorf("got %+v", list)
+	}
+}
+
+func TestParsePlaylistByteRanges(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-VERSION:4\n" +
+		"#EXTINF:10,\n#EXT-X-BYTERANGE:1000@0\nstream.ts\n" +
+		"#EXTINF:10,\n#EXT-X-BYTERANGE:500\nstream.ts\n" +
+		"#EXTINF:5,\n#EXT-X-BYTERANGE:300@2000\nstream.ts\n" +
+		"#EXTINF:5,\n#EXT-X-BYTERANGE:200\nstream.ts\n" +
+		"#EXTINF:5,\n#EXT-X-BYTERANGE:100\nother.ts\n" +
+		"#EXT-X-ENDLIST\n"
+	segments, _, err := parsePlaylist([]byte(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a range without offset follows the last one of the same file
+	want := []struct {
+		filename     string
+		size, offset int64
+	}{{"stream.ts", 1000, 0}, {"stream.ts", 500, 1000}, {"stream.ts", 300, 2000}, {"stream.ts", 200, 2300}, {"other.ts", 100, 0}}
+	if len(segments) != len(want) {
+		t.Fatalf("got %+v", segments)
+	}
+	for i, segment := range segments {
+		if segment.Filename != want[i].filename || segment.Size != want[i].size || segment.Offset == nil || *segment.Offset != want[i].offset {
+			t.Errorf("segment %d: expected %+v, got %+v", i, want[i], segment)
+		}
+	}
+
+	for _, byteRange := range []string{"#EXT-X-BYTERANGE:abc", "#EXT-X-BYTERANGE:100@abc"} {
+		if _, _, err := parsePlaylist([]byte("#EXTM3U\n#EXTINF:10,\n" + byteRange + "\nstream.ts\n")); err == nil {
+			t.Errorf("expected %q to fail", byteRange)
+		}
+	}
+
+	config := testConfig(t)
+	config.SingleFileHLS = true
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+	args := cm.hlsArgs("input.mp4", t.TempDir(), nil)
+	if !strings.Contains(argAfter(args, "-hls_flags"), "single_file") || filepath.Base(argAfter(args, "-hls_segment_filename")) != singleFileName {
+		t.Errorf("expected one segment file with SINGLE_FILE_HLS, got %q", args)
+	}
+}
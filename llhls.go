@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ffmpeg's hls muxer can't write LL-HLS partial segments, so with LL_HLS it
+// is asked for the parts instead: cut every LL_HLS_PART_LENGTH whether or
+// not on a keyframe, and listed in parts.m3u8. The playlist served is put
+// together from them, grouping parts into segments of the segment length,
+// which start on the keyframes forced there. Once all its parts are
+// written, a segment is written too, as the concatenation of its parts
+// (MPEG-TS is fine with that), and the final playlist.m3u8 lists segments
+// like any other conversion, with the parts of the last few.
+
+const (
+	lowLatencyPartsPlaylist = "parts.m3u8"
+	lowLatencyPartFilename  = "part%d.ts"
+)
+
+// lowLatencySegment is a segment of an LL_HLS conversion and its parts.
+type lowLatencySegment struct {
+	Segment
+	Parts []Segment
+	// whether all its parts are written, only then is it listed as a
+	// segment and written
+	Complete bool
+}
+
+// lowLatencyProgress is how far an LL_HLS conversion got.
+type lowLatencyProgress struct {
+	Segments []lowLatencySegment
+	// whether ffmpeg is done with it
+	Ended bool
+	// of the first part, with PROGRAM_DATE_TIME
+	ProgramDateTime string
+	// the target duration of segments, in seconds
+	SegmentLength int
+}
+
+// hasPart reports whether part of the segment msn is written, or the
+// whole segment if part is negative. Segments are numbered from
+// SEGMENT_START_NUMBER, as in their names.
+func (cm *ConversionManager) hasPart(progress lowLatencyProgress, msn, part int) bool {
+	i := msn - cm.config.SegmentStartNumber
+	if progress.Ended || i < 0 {
+		return true
+	}
+	if i >= len(progress.Segments) {
+		return false
+	}
+	segment := progress.Segments[i]
+	return segment.Complete || (part >= 0 && part < len(segment.Parts))
+}
+
+// lowLatencySegments groups parts, as listed in parts.m3u8, into segments of
+// segmentLength seconds. The last one is incomplete until ended.
+func (cm *ConversionManager) lowLatencySegments(parts []Segment, ended bool, segmentLength int) []lowLatencySegment {
+	perSegment := max(1, int(time.Duration(segmentLength)*time.Second/cm.config.LowLatencyPartLength))
+	segments := make([]lowLatencySegment, 0, len(parts)/perSegment+1)
+	for start := 0; start < len(parts); start += perSegment {
+		end := min(start+perSegment, len(parts))
+		segment := lowLatencySegment{
+			Segment:  Segment{Filename: fmt.Sprintf(cm.config.SegmentFilename, cm.config.SegmentStartNumber+len(segments))},
+			Parts:    parts[start:end],
+			Complete: end-start == perSegment || ended,
+		}
+		for _, part := range segment.Parts {
+			segment.Duration += part.Duration
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// readLowLatencyProgress reads the parts written so far for conv, writing
+// the segments they complete.
+func (cm *ConversionManager) readLowLatencyProgress(conv *Conversion) (lowLatencyProgress, error) {
+	playlist, err := os.ReadFile(filepath.Join(conv.OutputDir, lowLatencyPartsPlaylist))
+	if err != nil {
+		return lowLatencyProgress{}, err
+	}
+	parts, ended, err := parsePlaylist(playlist)
+	if err != nil {
+		return lowLatencyProgress{}, err
+	}
+	conv.mu.Lock()
+	segmentLength := conv.segmentLength
+	conv.mu.Unlock()
+	if segmentLength <= 0 {
+		segmentLength = cm.config.SegmentLength
+	}
+
+	progress := lowLatencyProgress{
+		Segments:      cm.lowLatencySegments(parts, ended, segmentLength),
+		Ended:         ended,
+		SegmentLength: segmentLength,
+	}
+	for _, line := range strings.Split(string(playlist), "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXT-X-PROGRAM-DATE-TIME:"); ok {
+			progress.ProgramDateTime = value
+			break
+		}
+	}
+	for _, segment := range progress.Segments {
+		if !segment.Complete {
+			continue
+		}
+		if err := writeLowLatencySegment(conv.OutputDir, segment); err != nil {
+			return lowLatencyProgress{}, err
+		}
+	}
+	return progress, nil
+}
+
+// writeLowLatencySegment writes segment out of its parts into outputDir,
+// unless it already is. Requests may write the same segment at once, it
+// only appears once whole.
+func writeLowLatencySegment(outputDir string, segment lowLatencySegment) error {
+	path := filepath.Join(outputDir, filepath.Base(segment.Filename))
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(outputDir, ".segment-*")
+	if err != nil {
+		return err
+	}
+	// a no-op once renamed
+	defer os.Remove(tmp.Name())
+	for _, part := range segment.Parts {
+		file, err := os.Open(filepath.Join(outputDir, filepath.Base(part.Filename)))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		_, err = io.Copy(tmp, file)
+		file.Close()
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write %s: %w", segment.Filename, err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lowLatencyPlaylist is the LL-HLS media playlist of progress. Parts are
+// only listed for the segments within three target durations of its end,
+// as the spec asks, players further behind load whole segments.
+func (cm *ConversionManager) lowLatencyPlaylist(progress lowLatencyProgress) []byte {
+	target := float64(progress.SegmentLength)
+	partTarget := cm.config.LowLatencyPartLength.Seconds()
+	var total float64
+	for _, segment := range progress.Segments {
+		if segment.Complete {
+			target = max(target, segment.Duration)
+		}
+		for _, part := range segment.Parts {
+			partTarget = max(partTarget, part.Duration)
+		}
+		total += segment.Duration
+	}
+	targetDuration := int(math.Ceil(target))
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:6\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	// players start this far from the live edge, three part targets as
+	// the spec recommends
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%s\n", formatFloat(3*partTarget))
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%s\n", formatFloat(partTarget))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", cm.config.SegmentStartNumber)
+	if cm.config.PlaylistType != "none" {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:" + strings.ToUpper(cm.config.PlaylistType) + "\n")
+	}
+	if progress.ProgramDateTime != "" {
+		b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + progress.ProgramDateTime + "\n")
+	}
+	var start float64
+	for _, segment := range progress.Segments {
+		if total-start-segment.Duration < float64(3*targetDuration) {
+			for i, part := range segment.Parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%s,URI=\"%s\"", formatFloat(part.Duration), part.Filename)
+				// only segments start on a keyframe
+				if i == 0 {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if segment.Complete {
+			fmt.Fprintf(&b, "#EXTINF:%s,\n%s\n", formatFloat(segment.Duration), segment.Filename)
+		}
+		start += segment.Duration
+	}
+	if progress.Ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return []byte(b.String())
+}
+
+// finishLowLatency writes the segments and final playlist.m3u8 of an
+// LL_HLS conversion once ffmpeg is done with its parts.
+func (cm *ConversionManager) finishLowLatency(conv *Conversion) error {
+	progress, err := cm.readLowLatencyProgress(conv)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(conv.OutputDir, "playlist.m3u8"), cm.lowLatencyPlaylist(progress), 0o644)
+}
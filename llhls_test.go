@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLowLatencyPlaylist(t *testing.T) {
+	config := testConfig(t)
+	config.LowLatencyHLS = true
+	config.LowLatencyPartLength = 2 * time.Second
+	config.SegmentLength = 4
+	config.PlaylistType = "event"
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+
+	// 22 seconds in, the last segment has one of its two parts
+	parts := make([]Segment, 11)
+	for i := range parts {
+		parts[i] = Segment{Filename: fmt.Sprintf("part%d.ts", i), Duration: 2}
+	}
+	progress := lowLatencyProgress{Segments: cm.lowLatencySegments(parts, false, 4), SegmentLength: 4}
+	want := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=6
+#EXT-X-PART-INF:PART-TARGET=2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:EVENT
+#EXTINF:4,
+segment0.ts
+#EXTINF:4,
+segment1.ts
+#EXT-X-PART:DURATION=2,URI="part4.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=2,URI="part5.ts"
+#EXTINF:4,
+segment2.ts
+#EXT-X-PART:DURATION=2,URI="part6.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=2,URI="part7.ts"
+#EXTINF:4,
+segment3.ts
+#EXT-X-PART:DURATION=2,URI="part8.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=2,URI="part9.ts"
+#EXTINF:4,
+segment4.ts
+#EXT-X-PART:DURATION=2,URI="part10.ts",INDEPENDENT=YES
+`
+	if got := string(cm.lowLatencyPlaylist(progress)); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	for _, tc := range []struct {
+		msn, part int
+		want      bool
+	}{
+		{4, -1, true},
+		{5, 0, true},
+		{5, 1, false},
+		{5, -1, false},
+		{6, 0, false},
+	} {
+		if got := cm.hasPart(progress, tc.msn, tc.part); got != tc.want {
+			t.Errorf("segment %d part %d: expected %v, got %v", tc.msn, tc.part, tc.want, got)
+		}
+	}
+	progress = lowLatencyProgress{Segments: cm.lowLatencySegments(parts, true, 4), Ended: true, SegmentLength: 4}
+	if !cm.hasPart(progress, 6, 0) {
+		t.Error("expected everything to be there once ended")
+	}
+	if got := string(cm.lowLatencyPlaylist(progress)); !strings.HasSuffix(got, "#EXTINF:2,\nsegment5.ts\n#EXT-X-ENDLIST\n") {
+		t.Errorf("expected the last segment to be listed once ended, got:\n%s", got)
+	}
+}
+
+func TestLowLatencyHLS(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	config.LowLatencyHLS = true
+	config.LowLatencyPartLength = 5 * time.Second
+	config.PlaylistType = "event"
+	s, r := newTestState(t, config, &fakeRunner{})
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+
+	if w := get(r, "GET", base+"playlist.m3u8?_HLS_part=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("_HLS_part without _HLS_msn: got %d", w.Code)
+	}
+	w := get(r, "GET", base+"playlist.m3u8?_HLS_msn=1&_HLS_part=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("playlist: got %d %s", w.Code, w.Body)
+	}
+	for _, expected := range []string{
+		"#EXT-X-PART-INF:PART-TARGET=5\n",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=15\n",
+		"#EXT-X-PART:DURATION=5,URI=\"part0.ts\",INDEPENDENT=YES\n#EXT-X-PART:DURATION=5,URI=\"part1.ts\"\n#EXTINF:10,\nsegment0.ts\n",
+		"#EXT-X-PART:DURATION=5,URI=\"part4.ts\",INDEPENDENT=YES\n#EXTINF:5,\nsegment2.ts\n#EXT-X-ENDLIST\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("expected the playlist to contain %q, got:\n%s", expected, w.Body)
+		}
+	}
+
+	// segments are their parts put together
+	if w := get(r, "GET", base+"segment0.ts"); w.Code != http.StatusOK || w.Body.String() != "segment 0segment 1" {
+		t.Errorf("segment: got %d %q", w.Code, w.Body)
+	}
+	if w := get(r, "GET", base+"part1.ts"); w.Code != http.StatusOK || w.Body.String() != "segment 1" {
+		t.Errorf("part: got %d %q", w.Code, w.Body)
+	}
+
+	// once finished, the playlist is written like any other
+	conv, release, ok := s.cm.lookupConversion(did, blobCID.String())
+	if !ok {
+		t.Fatal("conversion not found")
+	}
+	defer release()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(conv.OutputDir, "playlist.m3u8")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("playlist.m3u8 was never written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w = get(r, "GET", base+"segments.json")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"totalSegments":3`) {
+		t.Errorf("segments.json: got %d %s", w.Code, w.Body)
+	}
+}
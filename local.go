@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// With UPLOAD_MODE=local, uploads aren't sent to the user's PDS. douga
+// keeps the source in WORK_DIR/local/<did>/<cid> and converts it right
+// away, and the job reports the playlist it is served from.
+
+var uploadModes = []string{"pds", "local"}
+
+// localBlobPath is where the source of a local upload is kept. The DID and
+// CID are parsed so that they can't be used to escape the directory.
+func (cm *ConversionManager) localBlobPath(did, blobCID string) (string, error) {
+	parsedDID, err := syntax.ParseDID(did)
+	if err != nil {
+		return "", fmt.Errorf("invalid did: %w", err)
+	}
+	parsedCID, err := cid.Decode(blobCID)
+	if err != nil {
+		return "", fmt.Errorf("invalid cid: %w", err)
+	}
+	return filepath.Join(cm.config.WorkDir, "local", parsedDID.String(), parsedCID.String()), nil
+}
+
+// storeLocalBlob saves body as a local upload of did, returning its CID.
+func (cm *ConversionManager) storeLocalBlob(did string, body []byte) (cid.Cid, error) {
+	// same CID as a PDS would give the blob, CIDv1 raw sha256
+	hash, err := multihash.Sum(body, multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to hash upload: %w", err)
+	}
+	blobCID := cid.NewCidV1(cid.Raw, hash)
+	path, err := cm.localBlobPath(did, blobCID.String())
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return cid.Undef, fmt.Errorf("failed to store upload: %w", err)
+	}
+	// blobs appear under their final name only once complete
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".incoming_*")
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to store upload: %w", err)
+	}
+	_, err = tmpFile.Write(body)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return cid.Undef, fmt.Errorf("failed to store upload: %w", err)
+	}
+	return blobCID, nil
+}
+
+// localSource links the local upload of did/cid to a new temp file owned
+// by the caller, reporting whether there is one.
+func (cm *ConversionManager) localSource(did, blobCID string) (string, bool) {
+	path, err := cm.localBlobPath(did, blobCID)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	tmpPath, err := linkOrCopyTemp(path, "", "blob_*")
+	if err != nil {
+		log.Printf("Failed to read local upload %s/%s: %s", did, blobCID, err)
+		return "", false
+	}
+	return tmpPath, true
+}
+
+// processLocalJob keeps the upload of job on disk instead of sending it to
+// the PDS, and starts converting it. Its token was verified to be meant
+// for us, as no PDS checks it.
+func (s *State) processLocalJob(job Job, body []byte) error {
+	blobCID, err := s.cm.storeLocalBlob(job.userDID, body)
+	if err != nil {
+		return err
+	}
+	job.progress = 50
+	s.update(job)
+
+	if _, _, err := s.prepare(job.userDID, blobCID.String(), thumbnailJPEG); err != nil {
+		return fmt.Errorf("failed to start conversion: %w", err)
+	}
+
+	log.Printf("stored locally! %s", blobCID)
+	job.progress = 100
+	job.state = "JOB_STATE_COMPLETED"
+	job.verifiedCID = blobCID.String()
+	job.blob = &util.LexBlob{
+		Ref:      util.LexLink(blobCID),
+		MimeType: job.contentType,
+		Size:     int64(len(body)),
+	}
+	s.update(job)
+	return nil
+}
+
+// jobStatus is job.ToStatus, with the queue position of queued jobs, the
+// URL of the thumbnail of completed jobs, and of the playlist of local
+// uploads.
+func (s *State) jobStatus(job Job) JobStatus {
+	status := job.ToStatus()
+	if job.state == "JOB_STATE_CREATED" {
+		status.QueuePosition, _ = s.queue.position(job.ID)
+	}
+	if job.state != "JOB_STATE_COMPLETED" || job.blob == nil {
+		return status
+	}
+	blobCID := job.blob.Ref.String()
+	thumbnailBaseURL := s.config.ThumbnailBaseURL
+	if thumbnailBaseURL == "" {
+		thumbnailBaseURL = s.config.publicBaseURL()
+	}
+	if s.config.ThumbnailSigningKey != "" {
+		status.ThumbnailURL = signThumbnailURL([]byte(s.config.ThumbnailSigningKey), thumbnailBaseURL, job.userDID, blobCID, "thumbnail.jpg", "", time.Now().Add(jobThumbnailURLTTL))
+	} else {
+		status.ThumbnailURL = fmt.Sprintf("%s/watch/%s/%s/thumbnail.jpg", thumbnailBaseURL, job.userDID, blobCID)
+	}
+	if s.config.UploadMode == "local" {
+		status.PlaylistURL = fmt.Sprintf("%s/watch/%s/%s/playlist.m3u8", s.config.publicBaseURL(), job.userDID, blobCID)
+	}
+	return status
+}
+
+// jobThumbnailURLTTL is how long the signed thumbnail URL of a job status
+// is valid, enough to show a preview after uploading.
+const jobThumbnailURLTTL = time.Hour
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestLogger is gin's logger, except that only one in every
+// segmentSampleRate successful segment requests is logged. A player
+// fetches hundreds of segments per video, which would drown out
+// everything else.
+func requestLogger(segmentSampleRate int) gin.HandlerFunc {
+	var segments atomic.Uint64
+	return gin.LoggerWithConfig(gin.LoggerConfig{
+		Skip: func(c *gin.Context) bool {
+			if segmentSampleRate <= 1 || c.Writer.Status() >= http.StatusBadRequest {
+				return false
+			}
+			path := c.Request.URL.Path
+			if !strings.HasPrefix(path, "/watch/") {
+				return false
+			}
+			switch filepath.Ext(path) {
+			case ".ts", ".m4s":
+				return segments.Add(1)%uint64(segmentSampleRate) != 1
+			default:
+				return false
+			}
+		},
+	})
+}
@@ -2,39 +2,506 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/lex/util"
-	"github.com/gin-contrib/cors"
+	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/gin-gonic/gin"
+	"github.com/ipfs/go-cid"
 	gonanoid "github.com/matoous/go-nanoid"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/multiformats/go-multihash"
 	"github.com/samber/lo"
 )
 
 type Config struct {
 	ServerHostname string
-	Port           string
-	DBPath         string
-	AppviewURL     string
-	FrontendURL    string
-	PLCUrl         string
-	AllowedDIDs    string
+	// JSON array of services in our DID document
+	DIDServices string
+	BindAddress string
+	Port        string
+	// PEM certificate and key to serve HTTPS (and HTTP/2) with, plain
+	// HTTP when unset
+	TLSCert     string
+	TLSKey      string
+	DBPath      string
+	DatabaseURL string
+	// comma separated, blobs are downloaded from the first healthy one
+	AppviewURL string
+	// comma separated hosts blobs may be downloaded from, defaults to
+	// the APPVIEW_URL hosts
+	BlobHosts string
+	// where blobs are downloaded from, "appview" (APPVIEW_URL/blob/...) or
+	// "pds" (com.atproto.sync.getBlob on the PDS of their user)
+	BlobSource string
+	// forward the Authorization of watch requests to getBlob on the PDS of
+	// the video, which then decides who may watch it, e.g. after a takedown
+	PDSBlobAuth bool
+	// how long an appview that failed is tried last
+	AppviewFailureCooldown time.Duration
+	FrontendURL            string
+	PLCUrl                 string
+	AllowedDIDs            string
+	// comma separated IPs/CIDRs of reverse proxies whose X-Forwarded-For
+	// we believe, empty trusts no proxy
+	TrustedProxies string
+	// how long a failed conversion is reported as failed before retrying it
+	RetryCooldown time.Duration
+	// HLS segment length, in seconds
+	SegmentLength int
+	// keyframes are forced every KeyframeInterval seconds, which must
+	// divide SegmentLength so that every segment starts on a keyframe
+	KeyframeInterval int
+	// length of the first segment, in seconds, shorter than SegmentLength
+	// so that players start sooner. 0 for SegmentLength. Keyframes are
+	// then only forced on segment boundaries, ignoring KeyframeInterval
+	FastStartSegmentLength int
+	// most segments a video is cut into, 0 for no limit
+	MaxSegments int
+	// what longer videos get: "adjust" raises their segment length to a
+	// multiple of SegmentLength that fits, "reject" fails them with 413
+	SegmentLimitAction string
+	// printf pattern of segment filenames, given the segment number
+	SegmentFilename string
+	// write every segment of a playlist into a single file, listed as
+	// byte ranges of it
+	SingleFileHLS bool
+	// number of the first segment
+	SegmentStartNumber int
+	// maximum GOP size in frames, 0 leaves it to the encoder
+	GOPSize int
+	// errors are reported to Sentry when set
+	SentryDSN string
+	// hash uploaded videos and check the PDS returned the same CID
+	VerifyBlobCID bool
+	// also upload a thumbnail of uploaded videos to the PDS
+	UploadThumbnail bool
+	// bearer token for /admin routes, which are disabled when empty
+	AdminToken string
+	// HMAC key of signed thumbnail URLs. When set, thumbnails are only
+	// served through URLs signed with it
+	ThumbnailSigningKey string
+	// how long the upload of a failed job is kept so it can be retried
+	FailedSourceRetention time.Duration
+	// most bytes of failed uploads kept, past which the oldest are deleted
+	// early
+	FailedSourceMaxBytes int64
+	// how long the output and ffmpeg log of failed conversions are kept
+	// in WORK_DIR/failures, they are discarded right away when zero
+	FailedConversionRetention time.Duration
+	// most bytes kept in WORK_DIR/failures, past which the oldest failures
+	// are removed early
+	FailedConversionMaxBytes int64
+	// serve playlists and segments while the conversion is running, with
+	// blocking playlist reloads and partial segments
+	LowLatencyHLS bool
+	// how long the partial segments of LL_HLS are, it must divide
+	// HLS_SEGMENT_LENGTH
+	LowLatencyPartLength time.Duration
+	// upload limits, per DID over the last 24 hours and per upload
+	DailyByteLimit  int64
+	DailyVideoLimit int64
+	MaxUploadBytes  int64
+	// convert to 8-bit 4:2:0, which is all the baseline profile and
+	// older devices can decode
+	ForceYUV420P bool
+	// give each audio stream of videos with several (e.g. languages) its
+	// own HLS rendition, making playlist.m3u8 a master playlist
+	AudioRenditions bool
+	// add an audio-only variant to playlist.m3u8, making it a master
+	// playlist
+	AudioOnlyRendition bool
+	// JSON file with the ABR ladder videos are encoded to, making
+	// playlist.m3u8 a master playlist. Unset is defaultRenditions, "none"
+	// encodes a single rendition
+	RenditionsFile string
+	Renditions     []VideoRendition
+	// tonemap HDR sources to SDR, needs an ffmpeg built with zimg
+	TonemapHDR bool
+	// tag segments with #EXT-X-PROGRAM-DATE-TIME, starting at the time
+	// the conversion started
+	ProgramDateTime bool
+	// #EXT-X-PLAYLIST-TYPE of playlists, "vod", "event" or "none". Defaults
+	// to vod, or event with LL_HLS as those playlists change while served
+	PlaylistType string
+	// log ffmpeg commands instead of running them
+	FFmpegDryRun bool
+	// ffmpeg -v, empty leaves ffmpeg's default
+	FFmpegLogLevel string
+	// ffmpeg -threads, 0 leaves it to ffmpeg (all cores)
+	FFmpegThreads int
+	// ffmpeg input options for URL inputs, with STREAM_SOURCE, e.g.
+	// "-reconnect 1 -reconnect_streamed 1"
+	FFmpegNetworkOptions string
+	// niceness ffmpeg runs with, from 0 (normal) to 19 (lowest priority)
+	FFmpegNice int
+	// only log one in every SegmentLogSampleRate successful segment
+	// requests, 1 logs them all
+	SegmentLogSampleRate int
+	// segments and playlists referenced by playlists are served from this
+	// CDN when set, with absolute URLs
+	CDNBaseURL string
+	// gzip playlists and other text responses, off by default as a CDN or
+	// reverse proxy in front usually does it
+	Gzip bool
+	// suggested getJobStatus polling interval, scaled by job progress
+	JobPollInterval time.Duration
+	// base of the thumbnail URLs of job statuses, defaults to
+	// CDN_BASE_URL or else https://SERVER_HOSTNAME
+	ThumbnailBaseURL string
+	// comma separated content types uploads may have
+	AllowedUploadTypes string
+	// have ffmpeg read blobs from their URL instead of downloading them
+	// first, trading disk for upstream bandwidth during the transcode
+	StreamSource bool
+	// how often the progress of a job is saved while uploading to the PDS
+	JobProgressInterval time.Duration
+	// how long a watch request waits on a conversion before answering
+	// 503, the conversion goes on for the next request. 0 waits for it
+	ConversionWaitTimeout time.Duration
+	// serve a progressive MP4 of videos at /watch/:did/:cid/video.mp4
+	ProgressiveMP4 bool
+	// ffprobe the playlist of finished conversions, failing those whose
+	// duration is off from the source's by more than the tolerance
+	VerifyOutputDuration    bool
+	OutputDurationTolerance time.Duration
+	// Cache-Control of playlists, segments and thumbnails, for CDNs
+	CacheControlPlaylist  string
+	CacheControlSegment   string
+	CacheControlThumbnail string
+	// name segments after their content in finished playlists, so that
+	// they are immutable across encodes of a video
+	HashedSegments bool
+	// PNG overlaid on every transcode, empty for none
+	Watermark string
+	// corner of the watermark, or center
+	WatermarkPosition string
+	// opacity of the watermark in percent
+	WatermarkOpacity int
+	// how video is scaled into VideoSize and ThumbnailSize, "fit"
+	// letterboxes and "cover" crops
+	ScaleMode string
+	// WxH box videos are scaled into, empty keeps the source resolution
+	VideoSize string
+	// WxH box thumbnails are scaled into
+	ThumbnailSize string
+	// JPEG thumbnail quality, ffmpeg -q:v from 2 (best) to 31
+	ThumbnailQuality int
+	// how thumbnails seek to their frame: "fast" seeks the input to the
+	// nearest keyframe, "accurate" decodes up to the exact frame
+	ThumbnailSeek string
+	// x264 preset, trading encoding speed for compression
+	EncodePreset string
+	// x264 constant rate factor, lower is better quality and bigger
+	CRF int
+	// caps the video bitrate (e.g. "2M") on top of CRF, empty for no cap
+	MaxBitrate string
+	// most conversions kept on disk, the least recently accessed ones
+	// are removed past it. 0 for no limit
+	MaxConversions int
+	// directory for douga's on-disk caches, and its temp files in tmp/
+	WorkDir string
+	// keep downloaded source blobs in WORK_DIR/blobs, for up to
+	// BlobCacheTTL since their last use and BlobCacheMaxBytes in total
+	BlobCache         bool
+	BlobCacheTTL      time.Duration
+	BlobCacheMaxBytes int64
+	// how many videos are converted at once for prepare requests, the
+	// rest wait for their turn
+	PrepareConcurrency int
+	// how many upload jobs run at once, and how many more may wait
+	UploadConcurrency int
+	UploadQueueSize   int
+	// how many blobs are downloaded from appviews at once
+	MaxConcurrentDownloads int
+	// how long an unfinished resumable upload is kept since its last chunk
+	UploadExpiry time.Duration
+	// comma separated origins allowed to play videos from /watch/, "*"
+	// for any. The XRPC API only allows APPVIEW_URL and FRONTEND_URL
+	WatchCORSOrigins string
+	// comma separated methods and request headers allowed by the CORS
+	// policies of /watch/ and of the API, and how long browsers may cache
+	// their preflights
+	WatchCORSMethods string
+	WatchCORSHeaders string
+	WatchCORSMaxAge  time.Duration
+	APICORSMethods   string
+	APICORSHeaders   string
+	APICORSMaxAge    time.Duration
+	// bytes used by conversions and thumbnails past which the least
+	// recently accessed are evicted, and past which no new conversion is
+	// started. 0 for no limit
+	DiskHighWaterBytes int64
+	DiskCriticalBytes  int64
+	// temp files and directories in WORK_DIR/tmp older than this are
+	// removed at startup, as a crash leaves them behind. 0 disables the
+	// sweep
+	TempSweepAge time.Duration
+	// how long an Idempotency-Key of an upload maps to its job
+	IdempotencyKeyTTL time.Duration
+	// how long completed and failed jobs are kept after their last update.
+	// they count towards the daily limits, so at least a day
+	JobTTL time.Duration
+	// where uploads go, "pds" uploads them to the user's PDS and "local"
+	// keeps them in WORK_DIR and serves them from here
+	UploadMode string
+}
+
+// publicBaseURL is where clients reach douga's /watch/ routes.
+func (config Config) publicBaseURL() string {
+	if config.CDNBaseURL != "" {
+		return config.CDNBaseURL
+	}
+	return "https://" + config.ServerHostname
+}
+
+func (config Config) appviewURLs() []string {
+	return splitList(config.AppviewURL)
+}
+
+// splitList splits a comma separated list from the config, trimming its
+// items and dropping empty ones.
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// blobHosts returns the hosts (with their port, if any) that blobs may be
+// downloaded from: BLOB_HOSTS, or else the appviews. With BLOB_SOURCE=pds
+// and no BLOB_HOSTS it is nil, as users may be on any PDS.
+func (config Config) blobHosts() []string {
+	if config.BlobHosts != "" || config.BlobSource == "pds" {
+		return config.pdsHosts()
+	}
+	hosts := make([]string, 0)
+	for _, appviewURL := range config.appviewURLs() {
+		if u, err := url.Parse(appviewURL); err == nil && u.Host != "" {
+			hosts = append(hosts, u.Host)
+		}
+	}
+	return hosts
+}
+
+// pdsHosts returns the hosts that PDSes may be fetched from: BLOB_HOSTS,
+// or nil for any public host.
+func (config Config) pdsHosts() []string {
+	if config.BlobHosts == "" {
+		return nil
+	}
+	return splitList(config.BlobHosts)
+}
+
+func (config Config) validate() error {
+	if net.ParseIP(config.BindAddress) == nil {
+		return fmt.Errorf("BIND_ADDRESS must be an IPv4 or IPv6 address, got %q", config.BindAddress)
+	}
+	if port, err := strconv.Atoi(config.Port); err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("PORT must be a port number, got %q", config.Port)
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return errors.New("TLS_CERT and TLS_KEY must be set together")
+	}
+	if config.SegmentLength <= 0 {
+		return fmt.Errorf("HLS_SEGMENT_LENGTH must be positive, got %d", config.SegmentLength)
+	}
+	if config.KeyframeInterval <= 0 {
+		return fmt.Errorf("KEYFRAME_INTERVAL must be positive, got %d", config.KeyframeInterval)
+	}
+	if config.FastStartSegmentLength < 0 || config.FastStartSegmentLength >= config.SegmentLength {
+		return fmt.Errorf("FAST_START_SEGMENT_LENGTH must be between 0 and HLS_SEGMENT_LENGTH (%d), got %d", config.SegmentLength, config.FastStartSegmentLength)
+	}
+	if config.FastStartSegmentLength > 0 && config.GOPSize > 0 {
+		return errors.New("FAST_START_SEGMENT_LENGTH is not supported with GOP_SIZE")
+	}
+	if config.MaxSegments < 0 {
+		return fmt.Errorf("MAX_SEGMENTS can't be negative, got %d", config.MaxSegments)
+	}
+	if !slices.Contains(segmentLimitActions, config.SegmentLimitAction) {
+		return fmt.Errorf("SEGMENT_LIMIT_ACTION must be one of %v, got %q", segmentLimitActions, config.SegmentLimitAction)
+	}
+	if config.SegmentLength%config.KeyframeInterval != 0 {
+		return fmt.Errorf("KEYFRAME_INTERVAL (%d) must divide HLS_SEGMENT_LENGTH (%d)", config.KeyframeInterval, config.SegmentLength)
+	}
+	if !segmentFilenamePattern.MatchString(config.SegmentFilename) {
+		return fmt.Errorf("SEGMENT_FILENAME must be a .ts filename with a single %%d for the segment number, got %q", config.SegmentFilename)
+	}
+	if config.SegmentStartNumber < 0 {
+		return fmt.Errorf("SEGMENT_START_NUMBER must not be negative, got %d", config.SegmentStartNumber)
+	}
+	if config.GOPSize < 0 {
+		return fmt.Errorf("GOP_SIZE must not be negative, got %d", config.GOPSize)
+	}
+	if config.FFmpegLogLevel != "" && !slices.Contains(ffmpegLogLevels, config.FFmpegLogLevel) {
+		return fmt.Errorf("FFMPEG_LOGLEVEL must be one of %v, got %q", ffmpegLogLevels, config.FFmpegLogLevel)
+	}
+	if config.FFmpegThreads < 0 {
+		return fmt.Errorf("FFMPEG_THREADS can't be negative, got %d", config.FFmpegThreads)
+	}
+	if _, err := parseInputOptions(config.FFmpegNetworkOptions); err != nil {
+		return fmt.Errorf("FFMPEG_NETWORK_OPTIONS: %w", err)
+	}
+	if config.FFmpegNice < 0 || config.FFmpegNice > 19 {
+		return fmt.Errorf("FFMPEG_NICE must be between 0 and 19, got %d", config.FFmpegNice)
+	}
+	if config.DailyByteLimit <= 0 {
+		return fmt.Errorf("DAILY_BYTE_LIMIT must be positive, got %d", config.DailyByteLimit)
+	}
+	if config.DailyVideoLimit <= 0 {
+		return fmt.Errorf("DAILY_VIDEO_LIMIT must be positive, got %d", config.DailyVideoLimit)
+	}
+	if config.MaxUploadBytes <= 0 {
+		return fmt.Errorf("MAX_UPLOAD_BYTES must be positive, got %d", config.MaxUploadBytes)
+	}
+	if !slices.Contains(playlistTypes, config.PlaylistType) {
+		return fmt.Errorf("HLS_PLAYLIST_TYPE must be one of %v, got %q", playlistTypes, config.PlaylistType)
+	}
+	if config.LowLatencyHLS && config.AudioRenditions {
+		return errors.New("AUDIO_RENDITIONS is not supported with LL_HLS")
+	}
+	if len(config.Renditions) > 0 && (config.LowLatencyHLS || config.AudioRenditions || config.AudioOnlyRendition || config.VideoSize != "") {
+		return errors.New("RENDITIONS_FILE is not supported with LL_HLS, AUDIO_RENDITIONS, AUDIO_ONLY_RENDITION or VIDEO_SIZE")
+	}
+	if config.LowLatencyHLS && config.AudioOnlyRendition {
+		return errors.New("AUDIO_ONLY_RENDITION is not supported with LL_HLS")
+	}
+	if config.LowLatencyHLS && config.SingleFileHLS {
+		return errors.New("SINGLE_FILE_HLS is not supported with LL_HLS, segments are only served once complete")
+	}
+	if config.LowLatencyHLS && config.PlaylistType == "vod" {
+		return errors.New("HLS_PLAYLIST_TYPE can't be vod with LL_HLS, playlists change while they are served")
+	}
+	if config.LowLatencyHLS {
+		if config.LowLatencyPartLength <= 0 || (time.Duration(config.SegmentLength)*time.Second)%config.LowLatencyPartLength != 0 {
+			return fmt.Errorf("LL_HLS_PART_LENGTH must divide HLS_SEGMENT_LENGTH (%d), got %s", config.SegmentLength, config.LowLatencyPartLength)
+		}
+		if config.FastStartSegmentLength > 0 {
+			return errors.New("FAST_START_SEGMENT_LENGTH is not supported with LL_HLS, parts are grouped into segments of HLS_SEGMENT_LENGTH")
+		}
+		if config.SegmentFilename == lowLatencyPartFilename {
+			return fmt.Errorf("SEGMENT_FILENAME can't be %s with LL_HLS, it names its parts", lowLatencyPartFilename)
+		}
+	}
+	if !slices.Contains(encodePresets, config.EncodePreset) {
+		return fmt.Errorf("ENCODE_PRESET must be one of %v, got %q", encodePresets, config.EncodePreset)
+	}
+	if config.MaxConcurrentDownloads <= 0 {
+		return fmt.Errorf("MAX_CONCURRENT_DOWNLOADS must be positive, got %d", config.MaxConcurrentDownloads)
+	}
+	if config.UploadConcurrency <= 0 || config.UploadQueueSize <= 0 {
+		return fmt.Errorf("UPLOAD_CONCURRENCY and UPLOAD_QUEUE_SIZE must be positive, got %d and %d", config.UploadConcurrency, config.UploadQueueSize)
+	}
+	if config.PrepareConcurrency <= 0 {
+		return fmt.Errorf("PREPARE_CONCURRENCY must be positive, got %d", config.PrepareConcurrency)
+	}
+	if config.MaxConversions < 0 {
+		return fmt.Errorf("MAX_CONVERSIONS must not be negative, got %d", config.MaxConversions)
+	}
+	if config.SegmentLogSampleRate <= 0 {
+		return fmt.Errorf("SEGMENT_LOG_SAMPLE_RATE must be positive, got %d", config.SegmentLogSampleRate)
+	}
+	if config.CRF < 0 || config.CRF > 51 {
+		return fmt.Errorf("CRF must be between 0 and 51, got %d", config.CRF)
+	}
+	if len(splitList(config.WatchCORSMethods)) == 0 || len(splitList(config.APICORSMethods)) == 0 {
+		return errors.New("WATCH_CORS_METHODS and API_CORS_METHODS can't be empty")
+	}
+	if config.WatchCORSMaxAge < 0 || config.APICORSMaxAge < 0 {
+		return errors.New("WATCH_CORS_MAX_AGE and API_CORS_MAX_AGE can't be negative")
+	}
+	if config.IdempotencyKeyTTL <= 0 {
+		return fmt.Errorf("IDEMPOTENCY_KEY_TTL must be positive, got %s", config.IdempotencyKeyTTL)
+	}
+	if config.JobTTL < 24*time.Hour || config.JobTTL < config.IdempotencyKeyTTL {
+		return fmt.Errorf("JOB_TTL must be at least 24h and IDEMPOTENCY_KEY_TTL, got %s", config.JobTTL)
+	}
+	if len(splitList(config.AllowedUploadTypes)) == 0 {
+		return errors.New("ALLOWED_UPLOAD_TYPES can't be empty")
+	}
+	if config.JobProgressInterval <= 0 {
+		return fmt.Errorf("JOB_PROGRESS_INTERVAL must be positive, got %s", config.JobProgressInterval)
+	}
+	if err := config.checkWatermark(); err != nil {
+		return err
+	}
+	if config.OutputDurationTolerance <= 0 {
+		return fmt.Errorf("OUTPUT_DURATION_TOLERANCE must be positive, got %s", config.OutputDurationTolerance)
+	}
+	if config.FailedSourceRetention > 0 && config.FailedSourceMaxBytes <= 0 {
+		return fmt.Errorf("FAILED_SOURCE_MAX_BYTES must be positive, got %d", config.FailedSourceMaxBytes)
+	}
+	if config.FailedConversionRetention < 0 {
+		return fmt.Errorf("FAILED_CONVERSION_RETENTION can't be negative, got %s", config.FailedConversionRetention)
+	}
+	if config.FailedConversionRetention > 0 && config.FailedConversionMaxBytes <= 0 {
+		return fmt.Errorf("FAILED_CONVERSION_MAX_BYTES must be positive, got %d", config.FailedConversionMaxBytes)
+	}
+	if config.ConversionWaitTimeout < 0 {
+		return fmt.Errorf("CONVERSION_WAIT_TIMEOUT can't be negative, got %s", config.ConversionWaitTimeout)
+	}
+	if config.TempSweepAge < 0 {
+		return fmt.Errorf("TEMP_SWEEP_AGE can't be negative, got %s", config.TempSweepAge)
+	}
+	if config.DiskHighWaterBytes < 0 || config.DiskCriticalBytes < 0 {
+		return errors.New("DISK_HIGH_WATER_BYTES and DISK_CRITICAL_BYTES can't be negative")
+	}
+	if config.DiskHighWaterBytes > 0 && config.DiskCriticalBytes > 0 && config.DiskCriticalBytes < config.DiskHighWaterBytes {
+		return fmt.Errorf("DISK_CRITICAL_BYTES (%d) must be at least DISK_HIGH_WATER_BYTES (%d)", config.DiskCriticalBytes, config.DiskHighWaterBytes)
+	}
+	if !slices.Contains(blobSources, config.BlobSource) {
+		return fmt.Errorf("BLOB_SOURCE must be one of %v, got %q", blobSources, config.BlobSource)
+	}
+	if !slices.Contains(uploadModes, config.UploadMode) {
+		return fmt.Errorf("UPLOAD_MODE must be one of %v, got %q", uploadModes, config.UploadMode)
+	}
+	if !slices.Contains(scaleModes, config.ScaleMode) {
+		return fmt.Errorf("SCALE_MODE must be one of %v, got %q", scaleModes, config.ScaleMode)
+	}
+	if config.VideoSize != "" {
+		if _, _, err := parseSize(config.VideoSize); err != nil {
+			return fmt.Errorf("VIDEO_SIZE: %w", err)
+		}
+	}
+	if _, _, err := parseSize(config.ThumbnailSize); err != nil {
+		return fmt.Errorf("THUMBNAIL_SIZE: %w", err)
+	}
+	if config.ThumbnailQuality < 2 || config.ThumbnailQuality > 31 {
+		return fmt.Errorf("THUMBNAIL_QUALITY must be between 2 and 31, got %d", config.ThumbnailQuality)
+	}
+	if !slices.Contains(thumbnailSeeks, config.ThumbnailSeek) {
+		return fmt.Errorf("THUMBNAIL_SEEK must be one of %v, got %q", thumbnailSeeks, config.ThumbnailSeek)
+	}
+	if config.ThumbnailSigningKey != "" && len(config.ThumbnailSigningKey) < minSigningKeyLength {
+		return fmt.Errorf("THUMBNAIL_SIGNING_KEY must be at least %d bytes", minSigningKeyLength)
+	}
+	return nil
 }
 
 type DIDDocument struct {
@@ -49,104 +516,281 @@ type Service struct {
 	ServiceEndpoint string `json:"serviceEndpoint"`
 }
 
-func newDIDDocument(serverURL string) DIDDocument {
-	return DIDDocument{
-		Context: []string{"https://www.w3.org/ns/did/v1"},
-		ID:      fmt.Sprintf("did:web:%s", serverURL),
-		Service: []Service{
+// newDIDDocument builds our did:web document. Without configured
+// services, it advertises this server as the bsky video service.
+func newDIDDocument(serverURL string, services []Service) DIDDocument {
+	if len(services) == 0 {
+		services = []Service{
 			{
-				ID:              "#bsky_chat",
-				Type:            "BskyChatService",
+				ID:              "#bsky_video",
+				Type:            "BskyVideoService",
 				ServiceEndpoint: fmt.Sprintf("https://%s", serverURL),
 			},
-		},
+		}
+	}
+	return DIDDocument{
+		Context: []string{"https://www.w3.org/ns/did/v1"},
+		ID:      fmt.Sprintf("did:web:%s", serverURL),
+		Service: services,
+	}
+}
+
+// parseDIDServices reads DID_SERVICES, a JSON array of DID document
+// services.
+func parseDIDServices(value string) ([]Service, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var services []Service
+	if err := json.Unmarshal([]byte(value), &services); err != nil {
+		return nil, fmt.Errorf("DID_SERVICES must be a JSON array of services: %w", err)
 	}
+	for _, service := range services {
+		if !strings.HasPrefix(service.ID, "#") || service.Type == "" || service.ServiceEndpoint == "" {
+			return nil, fmt.Errorf("DID_SERVICES entry %+v needs an id starting with #, a type and a serviceEndpoint", service)
+		}
+	}
+	return services, nil
 }
 
 type Storage struct {
-	db         *sql.DB
-	plcUrl     string
-	appviewUrl string
+	jobs     JobStore
+	users    UserStore
+	pins     PinStore
+	resolver Resolver
 }
 
 type User struct {
 	pdsUrl string
 }
 
-func (st Storage) fetchUser(userDID string) (*User, error) {
-	res, err := http.Get(fmt.Sprintf("%s/%s", st.plcUrl, userDID))
+func (st Storage) fetchUser(ctx context.Context, userDID string) (*User, error) {
+	pdsUrl, err := st.resolver.ResolvePDS(ctx, userDID)
 	if err != nil {
-		return nil, err
-	}
-
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("fetching user %s failed: %s", userDID, res.Status)
-	}
-
-	defer res.Body.Close()
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, fmt.Errorf("reading user %s failed: %s", userDID, err)
-	}
-
-	var plcData DIDDocument
-	err = json.Unmarshal(body, &plcData)
-	if err != nil {
-		return nil, fmt.Errorf("unmarshaling user %s failed: %s", userDID, err)
-	}
-	var pdsUrl string
-	for _, service := range plcData.Service {
-		if service.ID == "#atproto_pds" && service.Type == "AtprotoPersonalDataServer" {
-			pdsUrl = service.ServiceEndpoint
+		stored, storedErr := st.users.GetUser(userDID)
+		if storedErr != nil {
+			return nil, err
 		}
+		log.Printf("Resolving %s failed, using stored PDS %s: %s", userDID, stored.pdsUrl, err)
+		return stored, nil
 	}
-
-	u := User{
-		pdsUrl: pdsUrl,
+	u := User{pdsUrl: pdsUrl}
+	if pdsUrl != "" {
+		if err := st.users.SaveUser(userDID, u); err != nil {
+			log.Printf("Failed to save user %s: %s", userDID, err)
+		}
 	}
 	return &u, nil
 }
 
 type State struct {
 	storage     *Storage
-	jobs        sync.Map
 	cm          *ConversionManager
 	allowedDIDs []string
+	reporter    ErrorReporter
+	config      Config
+	// job id -> *retainedSource
+	failedSources sync.Map
+	// serializes pruneRetainedSources
+	failedSourcesMu sync.Mutex
+	// jobs waiting for an upload worker
+	queue *JobQueue
+	// upload id -> *resumableUpload
+	uploads sync.Map
 }
 
 func (s *State) getUploadLimits(c *gin.Context) {
 	userDID := c.GetString("user_did")
-	out := bsky.VideoGetUploadLimits_Output{
-		CanUpload:            true,
-		RemainingDailyBytes:  lo.ToPtr(int64(10000000)),
-		RemainingDailyVideos: lo.ToPtr(int64(2000)),
+	videos, bytes, err := s.storage.jobs.UsageSince(userDID, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	remainingBytes := max(s.config.DailyByteLimit-bytes, 0)
+	remainingVideos := max(s.config.DailyVideoLimit-videos, 0)
+	out := UploadLimits{
+		VideoGetUploadLimits_Output: &bsky.VideoGetUploadLimits_Output{
+			CanUpload:            true,
+			RemainingDailyBytes:  lo.ToPtr(remainingBytes),
+			RemainingDailyVideos: lo.ToPtr(remainingVideos),
+		},
+		MaxUploadBytes: s.config.MaxUploadBytes,
 	}
-	if len(s.allowedDIDs) > 0 && !slices.Contains(s.allowedDIDs, userDID) {
+
+	// tell the client why, so it can show something better than a
+	// generic error
+	deny := func(message string) {
 		out.CanUpload = false
+		out.Message = lo.ToPtr(message)
+	}
+	allowed := len(s.allowedDIDs) == 0 || slices.Contains(s.allowedDIDs, userDID)
+	status := ""
+	if userDID != "" && allowed {
+		// an unknown status doesn't deny anything, the upload fails later
+		// if the PDS refuses it
+		status, err = s.accountStatus(c.Request.Context(), userDID)
+		if err != nil {
+			log.Printf("Failed to get the account status of %s: %s", userDID, err)
+		}
+	}
+	switch {
+	case userDID == "":
+		deny("You need to be signed in to upload videos.")
+	case !allowed:
+		deny("This account is not allowed to upload videos to this service.")
 		out.RemainingDailyBytes = lo.ToPtr(int64(0))
 		out.RemainingDailyVideos = lo.ToPtr(int64(0))
+	case status == "suspended" || status == "takendown":
+		deny("Your account is suspended.")
+	case status == "deactivated":
+		deny("Your account is deactivated.")
+	case status != "":
+		deny("Your account is not active.")
+	case remainingVideos == 0:
+		deny("You have reached the daily limit of uploaded videos.")
+	case remainingBytes == 0:
+		deny("You have reached the daily limit of uploaded bytes.")
 	}
 
 	c.JSON(200, out)
 }
 
+// accountStatusTimeout bounds asking the PDS of a user for the status of
+// their account.
+const accountStatusTimeout = 5 * time.Second
+
+// accountStatus returns why the account of did isn't active according to
+// its PDS, e.g. "suspended", "takendown" or "deactivated", or "" if it is
+// active. An inactive account without a reason is "inactive".
+func (s *State) accountStatus(ctx context.Context, did string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, accountStatusTimeout)
+	defer cancel()
+	u, err := s.storage.fetchUser(ctx, did)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch user: %w", err)
+	}
+	if u.pdsUrl == "" {
+		return "", fmt.Errorf("user %s has no PDS", did)
+	}
+	out, err := atproto.SyncGetRepoStatus(ctx, &xrpc.Client{Client: http.DefaultClient, Host: u.pdsUrl}, did)
+	if err != nil {
+		return "", err
+	}
+	if out.Active {
+		return "", nil
+	}
+	if out.Status == nil || *out.Status == "" {
+		return "inactive", nil
+	}
+	return *out.Status, nil
+}
+
+// UploadLimits is app.bsky.video.getUploadLimits#output with the largest
+// single upload we accept, so clients can check it before uploading.
+type UploadLimits struct {
+	*bsky.VideoGetUploadLimits_Output
+	MaxUploadBytes int64 `json:"maxUploadBytes"`
+}
+
 func (s *State) update(job Job) {
 	log.Printf("State update: %s %s %d %s %v %v", job.ID, job.contentType, job.progress, job.state, job.err, job.blob)
-	s.jobs.Store(job.ID, job)
+	if err := s.storage.jobs.SaveJob(job); err != nil {
+		log.Printf("Failed to save job %s: %s", job.ID, err)
+	}
 }
+
+// queueJob queues job to be processed once a worker is free, answering
+// with its status or 503 if the queue is full. It is then failed, as it
+// was already created, and its Idempotency-Key released, so that a retry
+// of the upload can be queued later. body waits on disk, not in memory.
+func (s *State) queueJob(c *gin.Context, job Job, body []byte) {
+	spooled, err := s.spoolBody(job.ID, body)
+	if err == nil {
+		err = s.queue.enqueue(job.ID, func() {
+			body, err := os.ReadFile(spooled)
+			os.Remove(spooled)
+			if err != nil {
+				job.err = fmt.Errorf("failed to read queued upload: %w", err)
+				job.state = "JOB_STATE_FAILED"
+				s.update(job)
+				return
+			}
+			s.process(job, body)
+		})
+		if err != nil {
+			os.Remove(spooled)
+		}
+	}
+	if err != nil {
+		job.err = err
+		job.state = "JOB_STATE_FAILED"
+		s.update(job)
+		if err := s.storage.jobs.ReleaseIdempotencyKeys(job.ID); err != nil {
+			log.Printf("Failed to release the idempotency keys of job %s: %s", job.ID, err)
+		}
+		if errors.Is(err, errQueueFull) {
+			c.Header("Retry-After", fmt.Sprintf("%.0f", uploadQueueRetryAfter.Seconds()))
+			c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	setPollInterval(c, job, s.config.JobPollInterval)
+	c.JSON(200, s.jobStatus(job))
+}
+
+// spoolBody writes the body of the job id to a temp file, where it waits
+// for a worker.
+func (s *State) spoolBody(jobID string, body []byte) (string, error) {
+	file, err := s.config.createTemp(fmt.Sprintf("job_%s_*", jobID))
+	if err != nil {
+		return "", fmt.Errorf("failed to queue upload: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(body); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to queue upload: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// process runs a job in the background. Jobs outlive the upload request
+// that created them, so they aren't cancelled with it.
 func (s *State) process(job Job, body []byte) {
 	log.Printf("Processing job: %s", job.ID)
-	err := s.processJob(job, body)
+	job.state = "processing"
+	job.progress = 1
+	s.update(job)
+	err := s.runJob(job, body)
 	if err != nil {
 		log.Printf("Error processing job %s: %s", job.ID, err)
+		s.reporter.Report(err, map[string]string{"did": job.userDID, "job_id": job.ID})
 		job.err = err
 		job.state = "JOB_STATE_FAILED"
 		s.update(job)
+		s.retainSource(job, body)
 		return
 	}
 }
-func (s *State) processJob(job Job, body []byte) error {
-	u, err := s.storage.fetchUser(job.userDID)
+
+// runJob is processJob turning a panic into an error, so that one bad job
+// fails alone instead of taking the whole server down with it.
+func (s *State) runJob(job Job, body []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job %s panicked: %v\n%s", job.ID, r, debug.Stack())
+			err = fmt.Errorf("internal error processing job: %v", r)
+		}
+	}()
+	return s.processJob(context.Background(), job, body)
+}
+
+func (s *State) processJob(ctx context.Context, job Job, body []byte) error {
+	if s.config.UploadMode == "local" {
+		return s.processLocalJob(job, body)
+	}
+	u, err := s.storage.fetchUser(ctx, job.userDID)
 	if err != nil {
 		return fmt.Errorf("failed to fetch user: %v", err)
 	}
@@ -158,63 +802,290 @@ func (s *State) processJob(job Job, body []byte) error {
 		s.update(job)
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/xrpc/com.atproto.repo.uploadBlob", u.pdsUrl), bytes.NewReader(body))
+	// the upload goes from 10 to 90, the rest is for verifying it and
+	// the thumbnail
+	var progressMu sync.Mutex
+	uploading := true
+	lastProgress := time.Now()
+	onProgress := func(sent int64) {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		if !uploading || time.Since(lastProgress) < s.config.JobProgressInterval {
+			return
+		}
+		lastProgress = time.Now()
+		progressJob := job
+		progressJob.progress = 10 + 80*sent/max(int64(len(body)), 1)
+		s.update(progressJob)
+	}
+	blob, err := uploadBlob(ctx, u.pdsUrl, job.token, job.contentType, body, onProgress)
+	// the request body may still be read after the response, don't let
+	// it report progress over what comes next
+	progressMu.Lock()
+	uploading = false
+	progressMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.config.VerifyBlobCID {
+		// blobs are CIDv1 raw sha256 of their bytes
+		hash, err := multihash.Sum(body, multihash.SHA2_256, -1)
+		if err != nil {
+			return fmt.Errorf("failed to hash upload: %w", err)
+		}
+		expected := cid.NewCidV1(cid.Raw, hash)
+		if !expected.Equals(cid.Cid(blob.Ref)) {
+			log.Printf("PDS returned blob %s for job %s, expected %s", blob.Ref, job.ID, expected)
+			return fmt.Errorf("uploaded blob CID mismatch: PDS returned %s, expected %s", blob.Ref, expected)
+		}
+		job.verifiedCID = expected.String()
+	}
+	if s.config.UploadThumbnail {
+		job.progress = 90
+		s.update(job)
+
+		// the video is already on the PDS, a missing thumbnail shouldn't
+		// fail the whole job
+		thumbBlob, err := s.uploadThumbnail(ctx, job, u.pdsUrl, body)
+		if err != nil {
+			log.Printf("Failed to upload thumbnail for job %s: %s", job.ID, err)
+			s.reporter.Report(err, map[string]string{"did": job.userDID, "job_id": job.ID})
+		}
+		job.thumbBlob = thumbBlob
+	}
+	{
+		log.Printf("uploaded! %s", blob.Ref)
+		job.progress = 100
+		job.state = "JOB_STATE_COMPLETED"
+		job.blob = blob
+		s.update(job)
+	}
+	return nil
+}
+
+// uploadThumbnail extracts a thumbnail from the uploaded video and uploads
+// it to the PDS as its own blob.
+func (s *State) uploadThumbnail(ctx context.Context, job Job, pdsUrl string, body []byte) (*util.LexBlob, error) {
+	tmpDir, err := s.config.mkdirTemp(fmt.Sprintf("thumb_%s_*", job.ID))
 	if err != nil {
-		return fmt.Errorf("failed to create req: %s", err)
+		return nil, fmt.Errorf("failed to create temp directory for thumbnail: %w", err)
 	}
-	req.Header.Set("authorization", job.token)
-	req.Header.Set("content-type", job.contentType)
+	defer os.RemoveAll(tmpDir)
+
+	sourcePath := filepath.Join(tmpDir, "source")
+	if err := os.WriteFile(sourcePath, body, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write video for thumbnail: %w", err)
+	}
+	probeResult, err := s.cm.probe(ctx, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	thumbPath := filepath.Join(tmpDir, "thumbnail.jpg")
+	output, err := s.cm.runFFmpeg(ctx, s.cm.thumbnailArgs(sourcePath, thumbPath, thumbnailJPEG, thumbnailAt, s.config.ThumbnailSeek == "accurate", probeResult)...)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg thumbnail error: %v, output: %s", err, outputTail(output, ffmpegOutputTail))
+	}
+	thumb, err := os.ReadFile(thumbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read thumbnail: %w", err)
+	}
+	return uploadBlob(ctx, pdsUrl, job.token, "image/jpeg", thumb, nil)
+}
+
+// uploadBlob uploads body to the PDS on behalf of the user owning token.
+// onProgress, if set, is called with the bytes sent so far as they are.
+func uploadBlob(ctx context.Context, pdsUrl, token, contentType string, body []byte, onProgress func(sent int64)) (*util.LexBlob, error) {
+	var reader io.Reader = bytes.NewReader(body)
+	if onProgress != nil {
+		reader = &countingReader{r: reader, onRead: onProgress}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/xrpc/com.atproto.repo.uploadBlob", pdsUrl), reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create req: %s", err)
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("authorization", token)
+	req.Header.Set("content-type", contentType)
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("upload error %s", err)
+		return nil, fmt.Errorf("upload error %s", err)
 	}
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		return fmt.Errorf("upload error %s, %s", res.Status, err)
+		return nil, fmt.Errorf("upload error %s, %s", res.Status, err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("upload error %s, %s", res.Status, string(resBody))
+		return nil, fmt.Errorf("upload error %s, %s", res.Status, string(resBody))
 	}
 	out := atproto.RepoUploadBlob_Output{}
 	err = json.Unmarshal(resBody, &out)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshall upload result: %w", err)
+		return nil, fmt.Errorf("failed to unmarshall upload result: %w", err)
 	}
-	{
-		log.Printf("uploaded! %s", out.Blob.Ref)
-		job.progress = 100
-		job.state = "JOB_STATE_COMPLETED"
-		job.blob = out.Blob
-		s.update(job)
+	return out.Blob, nil
+}
+
+// countingReader calls onRead with the bytes read so far after each read.
+type countingReader struct {
+	r      io.Reader
+	n      int64
+	onRead func(n int64)
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		cr.n += int64(n)
+		cr.onRead(cr.n)
 	}
-	return nil
+	return n, err
 }
 
 func (s *State) uploadVideo(c *gin.Context) {
-	// userDID := c.GetString("user_did")
-	userDID := c.Query("did")
-	if len(s.allowedDIDs) > 0 && !slices.Contains(s.allowedDIDs, userDID) {
-		c.AbortWithError(http.StatusForbidden, fmt.Errorf("DID not allowed"))
+	userDID, ok := s.uploaderDID(c)
+	if !ok {
+		return
+	}
+	// refused before reading any of it if it says it's too large, and
+	// limitBody stops reading it otherwise
+	if c.Request.ContentLength > s.config.MaxUploadBytes {
+		c.AbortWithError(http.StatusRequestEntityTooLarge, fmt.Errorf("upload is larger than %d bytes", s.config.MaxUploadBytes))
 		return
 	}
-	jobID := gonanoid.MustGenerate("abcdefghimnopqrstuvwxyz1234567890", 10)
 	body, err := io.ReadAll(c.Request.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.AbortWithError(http.StatusRequestEntityTooLarge, fmt.Errorf("upload is larger than %d bytes", tooLarge.Limit))
+		return
+	}
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	s.startJob(c, userDID, c.GetHeader("authorization"), c.GetHeader("content-type"), body, c.GetHeader("Idempotency-Key"))
+}
+
+// checkUploadType checks that an upload is one of ALLOWED_UPLOAD_TYPES, so
+// that we aren't used to relay arbitrary blobs to PDSes. body is sniffed
+// as well, as the declared type is up to the client, though most video
+// containers aren't recognized and pass.
+func (s *State) checkUploadType(contentType string, body []byte) error {
+	declared, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !slices.Contains(splitList(s.config.AllowedUploadTypes), declared) {
+		return fmt.Errorf("content type %q is not allowed, expected one of %s", contentType, s.config.AllowedUploadTypes)
+	}
+	if body == nil {
+		return nil
+	}
+	sniffed, _, _ := strings.Cut(http.DetectContentType(body), ";")
+	if sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "video/") {
+		return fmt.Errorf("upload looks like %s, not a video", sniffed)
+	}
+	return nil
+}
+
+// limitBody fails reading request bodies past n bytes with an
+// *http.MaxBytesError, so that handlers reading the whole body can't be
+// made to buffer an arbitrary amount of it.
+func limitBody(n int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, n)
+		c.Next()
+	}
+}
+
+// uploaderDID returns the DID an upload is for, which is always the one
+// its token was verified for by AuthenticateUploader. Uploads used to name
+// it with ?did=, which is still accepted but must match. Otherwise it
+// answers the request and returns false.
+func (s *State) uploaderDID(c *gin.Context) (string, bool) {
+	did := c.GetString("user_did")
+	if did == "" {
+		c.AbortWithError(http.StatusUnauthorized, errors.New("authentication required"))
+		return "", false
+	}
+	if query := c.Query("did"); query != "" && query != did {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("did %s doesn't match the authorization token, which is for %s", query, did))
+		return "", false
+	}
+	if len(s.allowedDIDs) > 0 && !slices.Contains(s.allowedDIDs, did) {
+		c.AbortWithError(http.StatusForbidden, fmt.Errorf("DID not allowed"))
+		return "", false
+	}
+	return did, true
+}
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted.
+const maxIdempotencyKeyLength = 255
+
+// startJob creates a job processing body and answers with its status. If
+// idempotencyKey was already used by an upload of userDID, that upload's
+// job is answered with instead, so that clients can safely retry uploads.
+func (s *State) startJob(c *gin.Context, userDID, token, contentType string, body []byte, idempotencyKey string) {
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("Idempotency-Key can't be longer than %d bytes", maxIdempotencyKeyLength))
+		return
+	}
+	if err := s.checkUploadType(contentType, body); err != nil {
+		c.AbortWithError(http.StatusUnsupportedMediaType, err)
+		return
+	}
+	// checked again when queueing, this only saves creating the job
+	if s.queue.full() {
+		c.Header("Retry-After", fmt.Sprintf("%.0f", uploadQueueRetryAfter.Seconds()))
+		c.AbortWithError(http.StatusServiceUnavailable, errQueueFull)
+		return
+	}
 	job := Job{
-		ID:          jobID,
 		userDID:     userDID,
-		state:       "processing",
-		progress:    1,
-		token:       c.GetHeader("authorization"),
-		contentType: c.GetHeader("content-type"),
+		state:       "JOB_STATE_CREATED",
+		progress:    0,
+		token:       token,
+		contentType: contentType,
+		size:        int64(len(body)),
+		createdAt:   time.Now(),
+	}
+	jobID, err := s.createJob(&job, idempotencyKey)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if jobID != job.ID {
+		existing, err := s.storage.jobs.GetJob(jobID)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("Upload of %s with Idempotency-Key %q is a retry of job %s", userDID, idempotencyKey, jobID)
+		setPollInterval(c, *existing, s.config.JobPollInterval)
+		c.JSON(200, s.jobStatus(*existing))
+		return
+	}
+	s.queueJob(c, job, body)
+}
+
+// createJob stores a new job under a fresh random ID, generating a new ID
+// when it collides with an existing job. The job and idempotencyKey are
+// stored together, so concurrent retries race on the key and only one of
+// them creates a job; the others get the ID of that job instead.
+func (s *State) createJob(job *Job, idempotencyKey string) (string, error) {
+	const maxAttempts = 5
+	for attempt := 1; ; attempt++ {
+		jobID, err := gonanoid.Generate("abcdefghimnopqrstuvwxyz1234567890", 10)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate job id: %w", err)
+		}
+		job.ID = jobID
+		existingID, err := s.storage.jobs.CreateJob(*job, idempotencyKey, time.Now().Add(-s.config.IdempotencyKeyTTL))
+		if !errors.Is(err, errJobExists) {
+			return existingID, err
+		}
+		log.Printf("Job ID %s already exists (attempt %d)", jobID, attempt)
+		if attempt == maxAttempts {
+			return "", fmt.Errorf("failed to find a free job id after %d attempts", maxAttempts)
+		}
 	}
-	s.jobs.Store(jobID, job)
-	go s.process(job, body)
-	c.JSON(200, job.ToBsky())
 }
 
 type Job struct {
@@ -226,10 +1097,65 @@ type Job struct {
 	blob        *util.LexBlob
 	token       string
 	contentType string
+	size        int64
+	createdAt   time.Time
+	verifiedCID string
+	thumbBlob   *util.LexBlob
+}
+
+// JobStatus is app.bsky.video.defs#jobStatus with douga specific fields.
+type JobStatus struct {
+	*bsky.VideoDefs_JobStatus
+	ThumbBlob *util.LexBlob `json:"thumbBlob,omitempty"`
+	// HLS playlist of the video, with UPLOAD_MODE=local
+	PlaylistURL string `json:"playlistUrl,omitempty"`
+	// thumbnail of the video, once completed
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	// place in the upload queue while JOB_STATE_CREATED, 1 is next
+	QueuePosition int `json:"queuePosition,omitempty"`
+}
+
+// pollInterval suggests when to poll this job again: rarely while it just
+// started, more often as it nears completion, and never once it finished.
+func (j Job) pollInterval(base time.Duration) time.Duration {
+	switch {
+	case j.state == "JOB_STATE_CREATED":
+		return base * 2
+	case j.state != "processing":
+		return 0
+	case j.progress < 50:
+		return base * 2
+	case j.progress < 90:
+		return base
+	default:
+		return base / 2
+	}
+}
+
+func setPollInterval(c *gin.Context, job Job, base time.Duration) {
+	if interval := job.pollInterval(base); interval > 0 {
+		c.Header("X-Poll-Interval", strconv.FormatInt(interval.Milliseconds(), 10))
+	}
+}
+
+func (j Job) ToStatus() JobStatus {
+	status := JobStatus{VideoDefs_JobStatus: j.ToBsky()}
+	if j.state == "JOB_STATE_COMPLETED" {
+		status.ThumbBlob = j.thumbBlob
+	}
+	return status
 }
 
 func (j Job) ToBsky() *bsky.VideoDefs_JobStatus {
 	switch j.state {
+	case "JOB_STATE_CREATED":
+		return &bsky.VideoDefs_JobStatus{
+			JobId:    j.ID,
+			Did:      j.userDID,
+			State:    j.state,
+			Progress: lo.ToPtr(int64(j.progress)),
+			Message:  lo.ToPtr("queued..."),
+		}
 	case "processing":
 		return &bsky.VideoDefs_JobStatus{
 			JobId:    j.ID,
@@ -263,209 +1189,600 @@ func (j Job) ToBsky() *bsky.VideoDefs_JobStatus {
 
 func (s *State) getJobStatus(c *gin.Context) {
 	jobID := c.Query("jobId")
-	jobA, ok := s.jobs.Load(jobID)
-	if !ok {
+	job, err := s.storage.jobs.GetJob(jobID)
+	if errors.Is(err, errJobNotFound) {
 		c.AbortWithError(http.StatusBadRequest, errors.New("invalid job id"))
 		return
 	}
-	job := jobA.(Job)
-	out := bsky.VideoGetJobStatus_Output{
-		JobStatus: job.ToBsky(),
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	out := struct {
+		JobStatus JobStatus `json:"jobStatus"`
+	}{
+		JobStatus: s.jobStatus(*job),
 	}
 
+	setPollInterval(c, *job, s.config.JobPollInterval)
 	c.JSON(200, out)
 }
 
+// getJobStatusByBlob finds the job that uploaded a blob, for clients that
+// lost the job id but still have the blob.
+func (s *State) getJobStatusByBlob(c *gin.Context) {
+	did := c.Query("did")
+	cid := c.Query("cid")
+	if did == "" || cid == "" {
+		c.AbortWithError(http.StatusBadRequest, errors.New("did and cid are required"))
+		return
+	}
+	job, err := s.storage.jobs.GetJobByBlob(did, cid)
+	if errors.Is(err, errJobNotFound) {
+		c.AbortWithError(http.StatusNotFound, errors.New("no completed job produced this blob"))
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	out := struct {
+		JobStatus JobStatus `json:"jobStatus"`
+	}{
+		JobStatus: s.jobStatus(*job),
+	}
+
+	c.JSON(200, out)
+}
+
+// ConversionManager caches conversions and thumbnails by video. Each
+// entry has its own lock, so work on one video never waits on another.
 type ConversionManager struct {
-	mu            sync.RWMutex
-	conversions   sync.Map
+	// did/cid -> *Conversion, and did/cid/mp4 for progressive MP4s
+	conversions sync.Map
+	// thumbnailKey -> *Thumbnail
 	thumbnails    sync.Map
 	cleanupTicker *time.Ticker
 	config        Config
+	reporter      ErrorReporter
+	appviews      *AppviewPool
+	runner        Runner
+	// bounds the conversions running for prepare requests
+	prepareSlots chan struct{}
+	// bounds the blob downloads running at once
+	downloadSlots     chan struct{}
+	downloadsInFlight atomic.Int64
+	// bytes used by conversions and thumbnails, as last measured
+	diskUsage atomic.Int64
+	// nil unless BLOB_CACHE is set
+	blobCache *BlobCache
+	// where blobs may be downloaded from
+	blobs *blobGuard
+	// where PDSes may be fetched from, for PDS_BLOB_AUTH
+	pdsBlobs *blobGuard
+	// serves blobs to ffmpeg, for STREAM_SOURCE
+	streams sourceProxy
+	// finds the PDS of a user, for BLOB_SOURCE=pds and PDS_BLOB_AUTH
+	userPDS func(ctx context.Context, did string) (string, error)
+	// blobAccess of requesters checked with PDS_BLOB_AUTH, by
+	// did/cid/token hash
+	blobAccess sync.Map
+	// sourceCheck of sources served by getSource, by did/cid
+	sourceChecks sync.Map
+	// segmentHash of segments by path, for HASHED_SEGMENTS
+	segmentHashes sync.Map
+	// where finished jobs are expired from, if set
+	jobs JobStore
+	// conversion keys (did/cid) that are never evicted
+	pinned sync.Map
+	// serializes pruneFailures
+	failuresMu sync.Mutex
+
+	encodersOnce sync.Once
+	encoders     map[string]bool
 }
 
 type Conversion struct {
+	// guards the fields below
+	mu           sync.Mutex
 	OutputDir    string
 	LastAccessed time.Time
 	Converting   bool
 	Error        error
+	// end of the ffmpeg output when it failed
+	FFmpegOutput string
+	FailedAt     time.Time
+	// the whole ffmpeg output when it failed, with FAILED_CONVERSION_RETENTION
+	ffmpegLog string
+	// where the last failure is kept, see retainFailure
+	retainedDir string
+	// closed when the running conversion finishes
+	done chan struct{}
+	// segment length of the running or last conversion in seconds, see
+	// segmentLength
+	segmentLength int
+	// the last conversion was cancelled by its request going away
+	interrupted bool
+	// waiting for a prepare slot
+	queued bool
+	// requests currently using this conversion, see acquire
+	users int
+	// dropped from the cache, see removeConversion
+	removed bool
 }
 
 type Thumbnail struct {
-	Path         string
+	// guards the fields below
+	mu     sync.Mutex
+	Path   string
+	Format ThumbnailFormat
+	// position of the frame in the video, in seconds
+	At float64
+	// decode up to At instead of seeking to the keyframe before it
+	Accurate bool
+	// did/cid of the video, whose pin keeps the thumbnail too
+	video        string
 	LastAccessed time.Time
 	Generating   bool
 	Error        error
+	// end of the ffmpeg output when it failed
+	FFmpegOutput string
+	FailedAt     time.Time
+	// closed when the running generation finishes
+	done chan struct{}
+	// the last generation was cancelled by its request going away
+	interrupted bool
+	// dropped from the cache, see removeThumbnail
+	removed bool
 }
 
-func NewConversionManager(config Config) *ConversionManager {
+// retryAfter returns how long until a failure at failedAt may be retried,
+// or zero if it can be retried now.
+func (cm *ConversionManager) retryAfter(failedAt time.Time) time.Duration {
+	return max(cm.config.RetryCooldown-time.Since(failedAt), 0)
+}
+
+func NewConversionManager(config Config, reporter ErrorReporter) *ConversionManager {
 	cm := &ConversionManager{
 		conversions:   sync.Map{},
 		cleanupTicker: time.NewTicker(5 * time.Minute),
 		config:        config,
+		reporter:      reporter,
+		appviews:      NewAppviewPool(config.appviewURLs(), config.AppviewFailureCooldown),
+		runner:        execRunner{},
+		blobs:         newBlobGuard(config.blobHosts()),
+		pdsBlobs:      newBlobGuard(config.pdsHosts()),
+		prepareSlots:  make(chan struct{}, max(config.PrepareConcurrency, 1)),
+		downloadSlots: make(chan struct{}, max(config.MaxConcurrentDownloads, 1)),
 	}
 	go cm.cleanupRoutine()
+	go cm.diskUsageRoutine()
 	return cm
 }
 
+// cleanupJitter spreads cleanup passes, so that instances started
+// together don't all clean up at the same moment
+const cleanupJitter = 30 * time.Second
+
 func (cm *ConversionManager) cleanupRoutine() {
 	for range cm.cleanupTicker.C {
-		cm.mu.Lock()
-		now := time.Now()
+		time.Sleep(rand.N(cleanupJitter))
+		cm.removeExpired(time.Now().Add(-30 * time.Minute))
+		cm.pruneFailures()
+		cm.pruneBlobAccess()
+		cm.pruneSourceChecks()
+		cm.pruneSegmentHashes()
+		if cm.blobCache != nil {
+			cm.blobCache.prune()
+		}
+		if cm.jobs != nil {
+			cm.expireJobs()
+		}
+	}
+}
+
+// removeExpired removes the conversions and thumbnails last accessed
+// before expired. Only picking what to remove happens under their locks,
+// removing directories is slow and would block requests for those videos
+// meanwhile.
+func (cm *ConversionManager) removeExpired(expired time.Time) {
+	dirsToRemove := make([]string, 0)
+	cm.conversions.Range(func(keyA any, convA any) bool {
+		conv := convA.(*Conversion)
+		if cm.removeConversion(keyA.(string), conv, expired) {
+			dirsToRemove = append(dirsToRemove, conv.OutputDir)
+		}
+		return true
+	})
+	cm.thumbnails.Range(func(keyA any, thumbA any) bool {
+		thumb := thumbA.(*Thumbnail)
+		if cm.removeThumbnail(keyA.(string), thumb, expired) {
+			dirsToRemove = append(dirsToRemove, filepath.Dir(thumb.Path))
+		}
+		return true
+	})
+	for _, dir := range dirsToRemove {
+		os.RemoveAll(dir)
+	}
+}
+
+// expireJobs removes the jobs that finished more than JOB_TTL ago.
+func (cm *ConversionManager) expireJobs() {
+	removed, err := cm.jobs.DeleteFinishedJobs(time.Now().Add(-cm.config.JobTTL))
+	if err != nil {
+		log.Printf("Failed to expire jobs: %s", err)
+		return
+	}
+	if removed > 0 {
+		log.Printf("Expired %d finished jobs", removed)
+	}
+}
+
+// thumbnailAt is where in the video the default thumbnail is taken, in
+// seconds
+const thumbnailAt = 1.0
+
+// thumbnailKeyPrefix starts the keys of the thumbnails of did/cid, or of
+// all of did's without cid. Neither DIDs nor CIDs contain a slash, so
+// that it never matches those of another DID sharing a prefix.
+func thumbnailKeyPrefix(did, cid string) string {
+	if cid == "" {
+		return fmt.Sprintf("thumb/%s/", did)
+	}
+	return fmt.Sprintf("thumb/%s/%s/", did, cid)
+}
+
+// thumbnailKey identifies a thumbnail, with at rounded to 100ms so that
+// nearby posters share their cache entry.
+func thumbnailKey(did, cid string, format ThumbnailFormat, at float64, accurate bool) string {
+	if accurate {
+		return fmt.Sprintf("%s%s/%.1f/accurate", thumbnailKeyPrefix(did, cid), format.Name, at)
+	}
+	return fmt.Sprintf("%s%s/%.1f", thumbnailKeyPrefix(did, cid), format.Name, at)
+}
+
+// getOrCreateThumbnail returns the thumbnail of did/cid at at, creating it
+// in the cache if needed. It is generated with generateThumbnail.
+func (cm *ConversionManager) getOrCreateThumbnail(did, cid string, format ThumbnailFormat, at float64, accurate bool) (*Thumbnail, error) {
+	for {
+		if thumb, ok := cm.lookupThumbnail(did, cid, format, at, accurate); ok {
+			return thumb, nil
+		}
+
+		// Create new temporary directory for thumbnail
+		tmpDir, err := cm.config.mkdirTemp(fmt.Sprintf("thumb_%s_%s_*", did, cid))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp directory for thumbnail: %w", err)
+		}
+
+		thumb := &Thumbnail{
+			Path:         filepath.Join(tmpDir, "thumbnail"+format.Extension),
+			Format:       format,
+			At:           math.Round(at*10) / 10,
+			Accurate:     accurate,
+			video:        fmt.Sprintf("%s/%s", did, cid),
+			LastAccessed: time.Now(),
+			Generating:   false,
+		}
+		if _, loaded := cm.thumbnails.LoadOrStore(thumbnailKey(did, cid, format, at, accurate), thumb); loaded {
+			// another request created it meanwhile, use theirs
+			os.RemoveAll(tmpDir)
+			continue
+		}
+		return thumb, nil
+	}
+}
+
+// lookupThumbnail returns an existing thumbnail without creating one.
+func (cm *ConversionManager) lookupThumbnail(did, cid string, format ThumbnailFormat, at float64, accurate bool) (*Thumbnail, bool) {
+	key := thumbnailKey(did, cid, format, at, accurate)
+	for {
+		thumbA, exists := cm.thumbnails.Load(key)
+		if !exists {
+			return nil, false
+		}
+		thumb := thumbA.(*Thumbnail)
+		thumb.mu.Lock()
+		if thumb.removed {
+			// cleaned up since we loaded it, look again
+			thumb.mu.Unlock()
+			continue
+		}
+		thumb.LastAccessed = time.Now()
+		thumb.mu.Unlock()
+		return thumb, true
+	}
+}
+
+// removeThumbnail drops thumb from the cache unless its video is pinned,
+// it is generating or was accessed after olderThan, reporting whether it
+// did. Removing its file is left to the caller.
+func (cm *ConversionManager) removeThumbnail(key string, thumb *Thumbnail, olderThan time.Time) bool {
+	if _, pinned := cm.pinned.Load(thumb.video); pinned {
+		return false
+	}
+	thumb.mu.Lock()
+	defer thumb.mu.Unlock()
+	if thumb.Generating || thumb.LastAccessed.After(olderThan) {
+		return false
+	}
+	thumb.removed = true
+	cm.thumbnails.CompareAndDelete(key, thumb)
+	return true
+}
+
+// generateThumbnail generates thumb, or waits for its running generation.
+// It is cancelled with ctx, in which case a waiting request takes over.
+func (cm *ConversionManager) generateThumbnail(ctx context.Context, did, cid string, thumb *Thumbnail) error {
+	return cm.convertAll(ctx, did, cid, nil, thumb)
+}
+
+// getOrCreateConversion returns the conversion of did/cid, creating it if
+// needed. It is kept from being cleaned up until release is called.
+func (cm *ConversionManager) getOrCreateConversion(did, cid string) (conv *Conversion, release func(), err error) {
+	return cm.getOrCreateOutput(fmt.Sprintf("%s/%s", did, cid), fmt.Sprintf("hls_%s_%s_*", did, cid))
+}
+
+// getOrCreateOutput is getOrCreateConversion for any output cached in
+// conversions, creating its directory from dirPattern.
+func (cm *ConversionManager) getOrCreateOutput(key, dirPattern string) (conv *Conversion, release func(), err error) {
+	for {
+		conv, release, ok := cm.lookupOutput(key)
+		if ok {
+			// the output was deleted from under us, recreate the directory
+			// so that the conversion runs again
+			conv.mu.Lock()
+			_, err := os.Stat(conv.OutputDir)
+			if os.IsNotExist(err) && !conv.Converting {
+				err = os.MkdirAll(conv.OutputDir, 0o700)
+			} else {
+				err = nil
+			}
+			conv.mu.Unlock()
+			if err != nil {
+				release()
+				return nil, nil, fmt.Errorf("failed to recreate temp directory: %w", err)
+			}
+			return conv, release, nil
+		}
+
+		if cm.diskFull() {
+			return nil, nil, errDiskFull
+		}
+
+		// Create new temporary directory
+		tmpDir, err := cm.config.mkdirTemp(dirPattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create temp directory: %w", err)
+		}
+
+		conv = &Conversion{
+			OutputDir:    tmpDir,
+			LastAccessed: time.Now(),
+			Converting:   false,
+		}
+		// held until acquired, so that eviction can't pick it meanwhile
+		conv.mu.Lock()
+		if _, loaded := cm.conversions.LoadOrStore(key, conv); loaded {
+			// another request created it meanwhile, use theirs
+			conv.mu.Unlock()
+			os.RemoveAll(tmpDir)
+			continue
+		}
+		release = cm.acquire(conv)
+		conv.mu.Unlock()
+		cm.evictConversions()
+		return conv, release, nil
+	}
+}
+
+// acquire marks conv as in use, so that neither the cleanup routine nor
+// eviction remove its files while they are being served. Must be called
+// with conv.mu held, the returned release must be called once done.
+func (cm *ConversionManager) acquire(conv *Conversion) (release func()) {
+	conv.users++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			conv.mu.Lock()
+			defer conv.mu.Unlock()
+			conv.users--
+			conv.LastAccessed = time.Now()
+		})
+	}
+}
+
+// removeConversion drops conv from the cache unless it is in use or was
+// accessed after olderThan, reporting whether it did. Removing its output
+// is left to the caller.
+func (cm *ConversionManager) removeConversion(key string, conv *Conversion, olderThan time.Time) bool {
+	if _, pinned := cm.pinned.Load(key); pinned {
+		return false
+	}
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+	if conv.Converting || conv.users > 0 || conv.LastAccessed.After(olderThan) {
+		return false
+	}
+	conv.removed = true
+	cm.conversions.CompareAndDelete(key, conv)
+	return true
+}
 
-		// Cleanup conversions
-		keysToRemove := make([]string, 0)
+// evictConversions brings the cache back to MaxConversions, by removing
+// the least recently accessed conversions that aren't in use.
+func (cm *ConversionManager) evictConversions() {
+	if cm.config.MaxConversions <= 0 {
+		return
+	}
+	for {
+		count := 0
+		var oldestKey string
+		var oldest *Conversion
+		var oldestAccessed time.Time
 		cm.conversions.Range(func(keyA any, convA any) bool {
-			key := keyA.(string)
 			conv := convA.(*Conversion)
-
-			if now.Sub(conv.LastAccessed) > 30*time.Minute {
-				keysToRemove = append(keysToRemove, key)
-				os.RemoveAll(conv.OutputDir)
+			count++
+			if _, pinned := cm.pinned.Load(keyA); pinned {
+				return true
 			}
-			return true
-		})
-		for _, k := range keysToRemove {
-			cm.conversions.Delete(k)
-		}
-
-		// Cleanup thumbnails
-		thumbsToRemove := make([]string, 0)
-		cm.thumbnails.Range(func(keyA any, thumbA any) bool {
-			key := keyA.(string)
-			thumb := thumbA.(*Thumbnail)
-
-			if now.Sub(thumb.LastAccessed) > 30*time.Minute {
-				thumbsToRemove = append(thumbsToRemove, key)
-				os.RemoveAll(filepath.Dir(thumb.Path))
+			// a locked conversion is being used, don't wait for it
+			if !conv.mu.TryLock() {
+				return true
+			}
+			idle, accessed := !conv.Converting && conv.users == 0, conv.LastAccessed
+			conv.mu.Unlock()
+			if idle && (oldest == nil || accessed.Before(oldestAccessed)) {
+				oldestKey, oldest, oldestAccessed = keyA.(string), conv, accessed
 			}
 			return true
 		})
-		for _, k := range thumbsToRemove {
-			cm.thumbnails.Delete(k)
+		if count <= cm.config.MaxConversions || oldest == nil {
+			return
+		}
+		// it may have been used since, then pick again
+		if cm.removeConversion(oldestKey, oldest, oldestAccessed) {
+			log.Printf("Evicting conversion %s, %d conversions cached", oldestKey, count)
+			os.RemoveAll(oldest.OutputDir)
 		}
-
-		cm.mu.Unlock()
 	}
 }
 
-// Add this method to ConversionManager
-func (cm *ConversionManager) getOrCreateThumbnail(did, cid string) (*Thumbnail, error) {
-	key := fmt.Sprintf("thumb_%s_%s", did, cid)
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+// lookupConversion returns an existing conversion without creating one.
+// Like getOrCreateConversion, it is held until release is called.
+func (cm *ConversionManager) lookupConversion(did, cid string) (conv *Conversion, release func(), ok bool) {
+	return cm.lookupOutput(fmt.Sprintf("%s/%s", did, cid))
+}
 
-	if thumbA, exists := cm.thumbnails.Load(key); exists {
-		thumb := thumbA.(*Thumbnail)
-		thumb.LastAccessed = time.Now()
-		return thumb, nil
+// lookupOutput is lookupConversion for any output cached in conversions.
+func (cm *ConversionManager) lookupOutput(key string) (conv *Conversion, release func(), ok bool) {
+	for {
+		convA, exists := cm.conversions.Load(key)
+		if !exists {
+			return nil, nil, false
+		}
+		conv = convA.(*Conversion)
+		conv.mu.Lock()
+		if conv.removed {
+			// evicted since we loaded it, look again
+			conv.mu.Unlock()
+			continue
+		}
+		conv.LastAccessed = time.Now()
+		release = cm.acquire(conv)
+		conv.mu.Unlock()
+		return conv, release, true
 	}
+}
 
-	// Create new temporary directory for thumbnail
-	tmpDir, err := os.MkdirTemp("", fmt.Sprintf("thumb_%s_%s_*", did, cid))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory for thumbnail: %w", err)
+// flush removes every conversion and thumbnail that isn't in use, and
+// every cached blob, returning how many of each it removed.
+func (cm *ConversionManager) flush() (conversions, thumbnails, blobs int) {
+	// anything accessed since then is skipped, like in-progress work
+	now := time.Now()
+	dirsToRemove := make([]string, 0)
+	cm.conversions.Range(func(keyA any, convA any) bool {
+		conv := convA.(*Conversion)
+		if cm.removeConversion(keyA.(string), conv, now) {
+			dirsToRemove = append(dirsToRemove, conv.OutputDir)
+			conversions++
+		}
+		return true
+	})
+	cm.thumbnails.Range(func(keyA any, thumbA any) bool {
+		thumb := thumbA.(*Thumbnail)
+		if cm.removeThumbnail(keyA.(string), thumb, now) {
+			dirsToRemove = append(dirsToRemove, filepath.Dir(thumb.Path))
+			thumbnails++
+		}
+		return true
+	})
+	for _, dir := range dirsToRemove {
+		os.RemoveAll(dir)
 	}
-
-	thumb := &Thumbnail{
-		Path:         filepath.Join(tmpDir, "thumbnail.jpg"),
-		LastAccessed: time.Now(),
-		Generating:   false,
+	if cm.blobCache != nil {
+		blobs = cm.blobCache.clear()
 	}
-	cm.thumbnails.Store(key, thumb)
-	return thumb, nil
+	return conversions, thumbnails, blobs
 }
 
-// Add thumbnail generation method
-func (cm *ConversionManager) generateThumbnail(did, cid string, thumb *Thumbnail) error {
-	cm.mu.Lock()
-	if thumb.Generating {
-		cm.mu.Unlock()
-		return nil // Generation already in progress
+var errInvalidateRunning = errors.New("video is being converted")
+
+// invalidate throws away everything cached about did/cid, its blob, HLS
+// and MP4 output and thumbnails, so that the next request downloads and
+// converts it again. Requests using the conversion meanwhile may see its
+// files go away.
+func (cm *ConversionManager) invalidate(did, cid string) error {
+	for _, key := range []string{fmt.Sprintf("%s/%s", did, cid), mp4Key(did, cid)} {
+		convA, ok := cm.conversions.Load(key)
+		if !ok {
+			continue
+		}
+		if err := cm.resetConversion(convA.(*Conversion)); err != nil {
+			return err
+		}
 	}
-	thumb.Generating = true
-	cm.mu.Unlock()
 
-	defer func() {
-		cm.mu.Lock()
-		thumb.Generating = false
-		cm.mu.Unlock()
-	}()
-
-	sourceURL := fmt.Sprintf("%s/blob/%s/%s", cm.config.AppviewURL, did, cid)
-
-	// Download blob to temporary storage
-	tmpFile, err := cm.downloadBlob(sourceURL)
+	prefix := thumbnailKeyPrefix(did, cid)
+	var err error
+	cm.thumbnails.Range(func(keyA, thumbA any) bool {
+		if !strings.HasPrefix(keyA.(string), prefix) {
+			return true
+		}
+		err = cm.resetThumbnail(thumbA.(*Thumbnail))
+		return err == nil
+	})
 	if err != nil {
-		thumb.Error = fmt.Errorf("failed to download blob for thumbnail: %w", err)
-		return thumb.Error
+		return err
 	}
-	defer os.Remove(tmpFile)
-
-	// Generate thumbnail using ffmpeg
-	// This command will extract a frame at 1 second mark and create a thumbnail
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", tmpFile,
-		"-ss", "00:00:01.000",
-		"-vframes", "1",
-		"-vf", "scale=480:-1",
-		"-y",
-		thumb.Path,
-	)
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		thumb.Error = fmt.Errorf("ffmpeg thumbnail error: %v, output: %s", err, output)
-		return thumb.Error
+	if cm.blobCache != nil {
+		_, err := cm.blobCache.remove(cid)
+		return err
 	}
-
 	return nil
 }
 
-func (cm *ConversionManager) getOrCreateConversion(did, cid string) (*Conversion, error) {
-	key := fmt.Sprintf("%s/%s", did, cid)
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	if convA, exists := cm.conversions.Load(key); exists {
-		conv := convA.(*Conversion)
-		conv.LastAccessed = time.Now()
-		return conv, nil
-	}
-
-	// Create new temporary directory
-	tmpDir, err := os.MkdirTemp("", fmt.Sprintf("hls_%s_%s_*", did, cid))
+// downloadBlob saves the blob at sourceURL, checked by guard, into a temp
+// file and returns its path, sending authorization if set. The caller owns the file, on
+// error no file is left behind.
+func (cm *ConversionManager) downloadBlob(ctx context.Context, guard *blobGuard, sourceURL, authorization string) (path string, err error) {
+	// Create temporary file for the downloaded blob
+	tmpFile, err := cm.config.createTemp("blob_*")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		return "", fmt.Errorf("failed to create temp file: %w", err)
 	}
+	defer func() {
+		closeErr := tmpFile.Close()
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to save blob: %w", closeErr)
+		}
+		if err != nil {
+			os.Remove(tmpFile.Name())
+			path = ""
+		}
+	}()
 
-	conv := &Conversion{
-		OutputDir:    tmpDir,
-		LastAccessed: time.Now(),
-		Converting:   false,
+	if err := guard.checkBlobHost(sourceURL); err != nil {
+		return "", err
 	}
-	cm.conversions.Store(key, conv)
-	return conv, nil
-}
 
-func (cm *ConversionManager) downloadBlob(sourceURL string) (string, error) {
-	// Create temporary file for the downloaded blob
-	tmpFile, err := os.CreateTemp("", "blob_*")
+	// Download the blob
+	req, err := http.NewRequestWithContext(ctx, "GET", sourceURL, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		return "", fmt.Errorf("failed to download blob: %w", err)
 	}
-	defer tmpFile.Close()
-
-	// Download the blob
-	resp, err := http.Get(sourceURL)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := guard.client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to download blob: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download blob: HTTP %d", resp.StatusCode)
+		return "", fmt.Errorf("failed to download blob: %w", &HTTPStatusError{StatusCode: resp.StatusCode})
 	}
 
 	// Copy the blob to temporary file
@@ -477,55 +1794,98 @@ func (cm *ConversionManager) downloadBlob(sourceURL string) (string, error) {
 	return tmpFile.Name(), nil
 }
 
-func (cm *ConversionManager) convertToHLS(did, cid string, conv *Conversion) error {
-	cm.mu.Lock()
-	if conv.Converting {
-		cm.mu.Unlock()
-		return nil // Conversion already in progress
+// resetDir empties dir, keeping the directory itself.
+func resetDir(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to clear %s: %s", dir, err)
 	}
-	conv.Converting = true
-	cm.mu.Unlock()
-
-	defer func() {
-		cm.mu.Lock()
-		conv.Converting = false
-		cm.mu.Unlock()
-	}()
-
-	sourceURL := fmt.Sprintf("%s/blob/%s/%s", cm.config.AppviewURL, did, cid)
-
-	// Download blob to temporary storage
-	tmpFile, err := cm.downloadBlob(sourceURL)
-	if err != nil {
-		conv.Error = fmt.Errorf("failed to download blob: %w", err)
-		return conv.Error
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("Failed to recreate %s: %s", dir, err)
 	}
-	// Clean up the temporary file when done
-	defer os.Remove(tmpFile)
+}
 
-	log.Printf("Converted %s to HLS", cid)
-	log.Printf("temp stored at: %s", tmpFile)
+// convertToHLS converts did/cid into conv, or waits for its running
+// conversion. It is cancelled with ctx, in which case a waiting request
+// takes over.
+func (cm *ConversionManager) convertToHLS(ctx context.Context, did, cid string, conv *Conversion) error {
+	return cm.convertAll(ctx, did, cid, conv, nil)
+}
 
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", tmpFile,
-		"-profile:v", "baseline",
-		"-level", "3.0",
-		"-start_number", "0",
-		"-hls_time", "10", // TODO segment length configurable?
-		"-hls_list_size", "0",
-		"-f", "hls",
-		"-hls_segment_filename", filepath.Join(conv.OutputDir, "segment%d.ts"),
-		filepath.Join(conv.OutputDir, "playlist.m3u8"),
-	)
+// conversionRetryAfter is the Retry-After of watch requests that gave up
+// waiting on a conversion after CONVERSION_WAIT_TIMEOUT.
+const conversionRetryAfter = 5 * time.Second
+
+// convertOrTimeout runs convert for a watch request. Without
+// CONVERSION_WAIT_TIMEOUT it is bound to the request, otherwise it runs
+// in the background and errWaitTimeout is returned once the timeout
+// passes, leaving it to finish for a later request. conv, if set, is
+// what it converts, kept from being evicted until it is done.
+func (s *State) convertOrTimeout(c *gin.Context, conv *Conversion, convert func(ctx context.Context) error) error {
+	if s.config.ConversionWaitTimeout == 0 {
+		return convert(c.Request.Context())
+	}
+	release := func() {}
+	if conv != nil {
+		// the request's own hold goes away with it
+		conv.mu.Lock()
+		release = s.cm.acquire(conv)
+		conv.mu.Unlock()
+	}
+	// joins the conversion if it is already running. It outlives the
+	// request, but keeps what it carries, see withBlobAuth. c is reused
+	// once the request is answered, so it is taken from it right away
+	ctx := context.WithoutCancel(c.Request.Context())
+	done := make(chan error, 1)
+	go func() {
+		defer release()
+		done <- convert(ctx)
+	}()
+	timer := time.NewTimer(s.config.ConversionWaitTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errWaitTimeout
+	case <-c.Request.Context().Done():
+		return c.Request.Context().Err()
+	}
+}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		conv.Error = fmt.Errorf("ffmpeg error: %v, output: %s", err, output)
-		return conv.Error
+// respondConversionError answers a watch request whose conversion failed
+// with err.
+func (s *State) respondConversionError(c *gin.Context, err error) {
+	if errors.Is(err, errWaitTimeout) {
+		c.Header("Retry-After", fmt.Sprintf("%.0f", conversionRetryAfter.Seconds()))
+		// the source plays meanwhile
+		c.Header("Link", fmt.Sprintf(`</watch/%s/%s/%s>; rel="alternate"`, c.Param("did"), c.Param("cid"), sourceFilename))
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+	if respondDryRun(c, err) {
+		return
 	}
+	c.AbortWithError(errorStatus(err), err)
+}
 
-	return nil
+// respondRecentFailure answers with the error of conv if it failed within
+// CONVERSION_RETRY_COOLDOWN, reporting whether it did. Don't rerun a
+// conversion that just failed, every request would download the source
+// and run ffmpeg again only to fail the same way.
+func (s *State) respondRecentFailure(c *gin.Context, conv *Conversion) bool {
+	conv.mu.Lock()
+	convErr, wait := conv.Error, s.cm.retryAfter(conv.FailedAt)
+	conv.mu.Unlock()
+	if convErr == nil || wait <= 0 {
+		return false
+	}
+	if status := errorStatus(convErr); status < 500 {
+		c.AbortWithError(status, convErr)
+		return true
+	}
+	c.Header("Retry-After", fmt.Sprintf("%.0f", math.Ceil(wait.Seconds())))
+	c.AbortWithError(http.StatusServiceUnavailable, convErr)
+	return true
 }
 
 func (s *State) getVideoOrThumbnail(c *gin.Context) {
@@ -543,48 +1903,312 @@ func (s *State) getVideoOrThumbnail(c *gin.Context) {
 		c.AbortWithError(http.StatusForbidden, fmt.Errorf("DID not allowed"))
 		return
 	}
+	refresh, ok := s.refreshRequested(c)
+	if !ok || (refresh && !s.refresh(c, did, cid)) {
+		return
+	}
+	if s.config.PDSBlobAuth && !s.authorizeBlob(c, did, cid) {
+		return
+	}
 
 	filename := filepath.Base(c.Param("filepath"))
 	if filename == "thumbnail.jpg" {
 		s.getThumbnail(c)
 		return
 	}
+	if filename == "poster.jpg" {
+		s.getPoster(c)
+		return
+	}
+	if filename == "segments.json" {
+		s.getSegments(c)
+		return
+	}
+	if filename == mp4Filename {
+		s.getMP4(c)
+		return
+	}
+	if filename == sourceFilename {
+		s.getSource(c)
+		return
+	}
 
 	// Validate that we're only serving allowed files
-	if filename != "playlist.m3u8" && filepath.Ext(filename) != ".ts" {
+	if _, ok := contentTypes[filepath.Ext(filename)]; !ok {
 		c.AbortWithError(http.StatusBadRequest, errors.New("invalid file request"))
 		return
 	}
+	// hashed names are served like the segment they name, converting it
+	// again if needed, once its content is checked
+	segmentHash := ""
+	if s.config.HashedSegments {
+		if plain, hash, ok := splitHashedName(filename); ok {
+			filename, segmentHash = plain, hash
+		}
+	}
+
+	// HEAD only reports on files that already exist, it never starts
+	// or waits on a conversion
+	if c.Request.Method == http.MethodHead {
+		conv, release, ok := s.cm.lookupConversion(did, cid)
+		if !ok {
+			c.AbortWithError(http.StatusNotFound, errors.New("conversion not found"))
+			return
+		}
+		defer release()
+		if _, err := os.Stat(filepath.Join(conv.OutputDir, filename)); err != nil {
+			c.AbortWithError(http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		if !s.checkSegmentHash(c, conv, filename, segmentHash) {
+			return
+		}
+		s.serveConversionFile(c, conv, filename)
+		return
+	}
 
-	conv, err := s.cm.getOrCreateConversion(did, cid)
+	conv, release, err := s.cm.getOrCreateConversion(did, cid)
+	if errors.Is(err, errDiskFull) {
+		c.Header("Retry-After", fmt.Sprintf("%.0f", diskUsageInterval.Seconds()))
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	defer release()
+	if s.respondRecentFailure(c, conv) {
+		return
+	}
+
+	// hashed names are only listed by finished playlists
+	if s.config.LowLatencyHLS && segmentHash == "" {
+		s.serveLowLatency(c, did, cid, conv, filename)
+		return
+	}
 
-	// Check if we need to start conversion
-	if _, err := os.Stat(filepath.Join(conv.OutputDir, "playlist.m3u8")); os.IsNotExist(err) {
-		if err := s.cm.convertToHLS(did, cid, conv); err != nil {
+	// Check if we need to start conversion, or wait for a running one
+	// (e.g. from prepare) that may have only written part of the playlist
+	conv.mu.Lock()
+	converting := conv.Converting
+	conv.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(conv.OutputDir, "playlist.m3u8")); os.IsNotExist(err) || converting {
+		// players show the thumbnail next, take it from the same download
+		thumb, err := s.cm.getOrCreateThumbnail(did, cid, s.cm.thumbnailFormat(c), thumbnailAt, s.config.ThumbnailSeek == "accurate")
+		if err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
+		if _, err := os.Stat(thumb.Path); err == nil {
+			thumb = nil
+		}
+		err = s.convertOrTimeout(c, conv, func(ctx context.Context) error {
+			return s.cm.convertAll(ctx, did, cid, conv, thumb)
+		})
+		if err != nil {
+			s.respondConversionError(c, err)
+			return
+		}
 	}
 
-	// Set appropriate headers
+	if !s.checkSegmentHash(c, conv, filename, segmentHash) {
+		return
+	}
+	s.serveConversionFile(c, conv, filename)
+}
+
+// contentTypes maps the extensions of every file we serve to their
+// content type. Requests for other extensions are rejected.
+var contentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".vtt":  "text/vtt",
+	".jpg":  "image/jpeg",
+	".webp": "image/webp",
+	".avif": "image/avif",
+}
+
+func (s *State) serveConversionFile(c *gin.Context, conv *Conversion, filename string) {
 	if filepath.Ext(filename) == ".m3u8" {
-		c.Header("Content-Type", "application/vnd.apple.mpegurl")
-	} else {
-		c.Header("Content-Type", "video/mp2t")
+		playlist, err := os.ReadFile(filepath.Join(conv.OutputDir, filename))
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		// only list the renditions that were actually encoded
+		if isMasterPlaylist(playlist) {
+			var ok bool
+			playlist, ok = filterMasterPlaylist(playlist, func(uri string) bool {
+				_, err := os.Stat(filepath.Join(conv.OutputDir, filepath.Base(uri)))
+				return err == nil
+			})
+			if !ok {
+				c.AbortWithError(http.StatusNotFound, errors.New("no rendition of this video was encoded"))
+				return
+			}
+		} else if s.config.HashedSegments {
+			playlist, err = s.cm.hashSegmentURIs(playlist, conv.OutputDir)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+		s.servePlaylist(c, playlist)
+		return
 	}
 
-	c.Header("Access-Control-Allow-Origin", "*")
+	// Set appropriate headers
+	c.Header("Content-Type", contentTypes[filepath.Ext(filename)])
+	s.setCacheControl(c, fileCacheCategory(filename))
 
 	// Serve the file
 	c.File(filepath.Join(conv.OutputDir, filename))
 }
 
-// Add getThumbnail handler to State
+// getSegments lists the segments of a finished conversion, so that players
+// can prefetch them. It never starts a conversion.
+func (s *State) getSegments(c *gin.Context) {
+	did := c.Param("did")
+	cid := c.Param("cid")
+
+	conv, release, ok := s.cm.lookupConversion(did, cid)
+	if !ok {
+		c.AbortWithError(http.StatusNotFound, errors.New("conversion not found"))
+		return
+	}
+	defer release()
+	conv.mu.Lock()
+	converting := conv.Converting
+	conv.mu.Unlock()
+	if converting {
+		c.AbortWithError(http.StatusNotFound, errors.New("conversion in progress"))
+		return
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(conv.OutputDir, "playlist.m3u8"))
+	if err == nil && isMasterPlaylist(playlist) {
+		// variants whose encode failed aren't listed, like when serving it
+		var out SegmentList
+		for _, uri := range variantURIs(playlist) {
+			if _, err := os.Stat(filepath.Join(conv.OutputDir, filepath.Base(uri))); os.IsNotExist(err) {
+				continue
+			}
+			variant, err := s.segmentList(conv.OutputDir, uri)
+			if err != nil {
+				s.abortSegmentList(c, err)
+				return
+			}
+			if out.Variants == nil {
+				out = variant
+			}
+			out.Variants = append(out.Variants, VariantSegmentList{Playlist: uri, SegmentList: variant})
+		}
+		if out.Variants == nil {
+			c.AbortWithError(http.StatusNotFound, errors.New("conversion not found"))
+			return
+		}
+		s.setCacheControl(c, cachePlaylist)
+		c.JSON(200, out)
+		return
+	}
+	out, err := s.segmentList(conv.OutputDir, "playlist.m3u8")
+	if err != nil {
+		s.abortSegmentList(c, err)
+		return
+	}
+
+	s.setCacheControl(c, cachePlaylist)
+	c.JSON(200, out)
+}
+
+var errConversionInProgress = errors.New("conversion in progress")
+
+// segmentList lists the segments of the media playlist name in
+// outputDir, failing with errConversionInProgress if it isn't finished.
+func (s *State) segmentList(outputDir, name string) (SegmentList, error) {
+	playlist, err := os.ReadFile(filepath.Join(outputDir, filepath.Base(name)))
+	if err != nil {
+		return SegmentList{}, err
+	}
+	segments, ended, err := parsePlaylist(playlist)
+	if err != nil {
+		return SegmentList{}, err
+	}
+	if !ended {
+		return SegmentList{}, errConversionInProgress
+	}
+
+	out := SegmentList{Segments: segments}
+	for i := range out.Segments {
+		path := filepath.Join(outputDir, filepath.Base(out.Segments[i].Filename))
+		// byte ranges already have their size
+		if out.Segments[i].Offset == nil {
+			info, err := os.Stat(path)
+			if err != nil {
+				return SegmentList{}, err
+			}
+			out.Segments[i].Size = info.Size()
+		}
+		out.TotalDuration += out.Segments[i].Duration
+		if s.config.HashedSegments {
+			hash, err := s.cm.segmentHash(path)
+			if err != nil {
+				return SegmentList{}, err
+			}
+			out.Segments[i].Filename = hashedName(out.Segments[i].Filename, hash)
+		}
+	}
+	out.TotalSegments = len(out.Segments)
+	return out, nil
+}
+
+// abortSegmentList answers a segments.json request that segmentList
+// failed with err.
+func (s *State) abortSegmentList(c *gin.Context, err error) {
+	switch {
+	case os.IsNotExist(err):
+		c.AbortWithError(http.StatusNotFound, errors.New("conversion not found"))
+	case errors.Is(err, errConversionInProgress):
+		c.AbortWithError(http.StatusNotFound, err)
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
+
+var errTimestampOutOfRange = errors.New("timestamp out of range")
+
+// getThumbnail serves the thumbnail of a video, at thumbnailAt.
 func (s *State) getThumbnail(c *gin.Context) {
+	if !s.checkSignature(c, "thumbnail.jpg") {
+		return
+	}
+	s.serveThumbnail(c, thumbnailAt)
+}
+
+// getPoster serves the frame at the t second mark, for picking a custom
+// poster.
+func (s *State) getPoster(c *gin.Context) {
+	if !s.checkSignature(c, "poster.jpg") {
+		return
+	}
+	at := thumbnailAt
+	if t := c.Query("t"); t != "" {
+		var err error
+		at, err = strconv.ParseFloat(t, 64)
+		if err != nil || at < 0 || math.IsInf(at, 0) || math.IsNaN(at) {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid timestamp %q", t))
+			return
+		}
+	}
+	s.serveThumbnail(c, at)
+}
+
+// serveThumbnail serves the frame at the at second mark, generating it
+// if needed.
+func (s *State) serveThumbnail(c *gin.Context, at float64) {
 	did := c.Param("did")
 	cid := c.Param("cid")
 
@@ -597,24 +2221,76 @@ func (s *State) getThumbnail(c *gin.Context) {
 		return
 	}
 
-	thumb, err := s.cm.getOrCreateThumbnail(did, cid)
+	if c.Request.Method == http.MethodHead {
+		thumb, ok := s.cm.lookupThumbnail(did, cid, s.cm.thumbnailFormat(c), at, s.cm.thumbnailAccurate(c))
+		if !ok {
+			c.AbortWithError(http.StatusNotFound, errors.New("thumbnail not found"))
+			return
+		}
+		if _, err := os.Stat(thumb.Path); err != nil {
+			c.AbortWithError(http.StatusNotFound, errors.New("thumbnail not found"))
+			return
+		}
+		s.serveThumbnailFile(c, thumb)
+		return
+	}
+
+	thumb, err := s.cm.getOrCreateThumbnail(did, cid, s.cm.thumbnailFormat(c), at, s.cm.thumbnailAccurate(c))
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	// Check if we need to generate thumbnail
+	thumb.mu.Lock()
+	thumbErr, wait := thumb.Error, s.cm.retryAfter(thumb.FailedAt)
+	thumb.mu.Unlock()
+	if errors.Is(thumbErr, errTimestampOutOfRange) {
+		c.AbortWithError(http.StatusBadRequest, thumbErr)
+		return
+	}
+	if status := errorStatus(thumbErr); thumbErr != nil && wait > 0 && status < 500 {
+		c.AbortWithError(status, thumbErr)
+		return
+	}
+	if thumbErr != nil && wait > 0 {
+		c.Header("Retry-After", fmt.Sprintf("%.0f", math.Ceil(wait.Seconds())))
+		c.AbortWithError(http.StatusServiceUnavailable, thumbErr)
+		return
+	}
+
+	// Check if we need to generate thumbnail, or wait for a running one
 	if _, err := os.Stat(thumb.Path); os.IsNotExist(err) {
-		if err := s.cm.generateThumbnail(did, cid, thumb); err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+		err := s.convertOrTimeout(c, nil, func(ctx context.Context) error {
+			return s.cm.generateThumbnail(ctx, did, cid, thumb)
+		})
+		if errors.Is(err, errWaitTimeout) {
+			c.Header("Retry-After", fmt.Sprintf("%.0f", conversionRetryAfter.Seconds()))
+			c.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+		if err != nil {
+			if respondDryRun(c, err) {
+				return
+			}
+			c.AbortWithError(errorStatus(err), err)
 			return
 		}
 	}
 
+	s.serveThumbnailFile(c, thumb)
+}
+
+func (s *State) serveThumbnailFile(c *gin.Context, thumb *Thumbnail) {
 	// Set appropriate headers
-	c.Header("Content-Type", "image/jpeg")
-	c.Header("Cache-Control", "public, max-age=31536000")
-	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Content-Type", thumb.Format.ContentType)
+	c.Header("Vary", "Accept")
+	s.setCacheControl(c, cacheThumbnail)
+	// validators for conditional requests, which c.File answers with 304:
+	// it sets Last-Modified and checks If-Modified-Since and, given an
+	// ETag, If-None-Match
+	if info, err := os.Stat(thumb.Path); err == nil {
+		c.Header("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	}
 
 	// Serve the thumbnail
 	c.File(thumb.Path)
@@ -622,68 +2298,211 @@ func (s *State) getThumbnail(c *gin.Context) {
 
 func main() {
 	// Initialize configuration
+	if path := strings.TrimSpace(os.Getenv("CONFIG_FILE")); path != "" {
+		settings, err := loadConfigFile(path)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		fileSettings = settings
+	}
 	config := Config{
-		ServerHostname: getEnvOrDefault("SERVER_HOSTNAME", "chat.example.net"),
-		Port:           getEnvOrDefault("PORT", "3000"),
-		DBPath:         getEnvOrDefault("DB_PATH", "data.db"),
-		AppviewURL:     getEnvOrDefault("APPVIEW_URL", ""),
-		FrontendURL:    getEnvOrDefault("FRONTEND_URL", ""),
-		PLCUrl:         getEnvOrDefault("ATPROTO_PLC_URL", ""),
-		AllowedDIDs:    getEnvOrDefault("ALLOWED_DIDS", ""),
+		ServerHostname:            getEnvOrDefault("SERVER_HOSTNAME", "chat.example.net"),
+		DIDServices:               getEnvOrDefault("DID_SERVICES", ""),
+		BindAddress:               strings.Trim(getEnvOrDefault("BIND_ADDRESS", "0.0.0.0"), "[]"),
+		TLSCert:                   getEnvOrDefault("TLS_CERT", ""),
+		TLSKey:                    getEnvOrDefault("TLS_KEY", ""),
+		Port:                      getEnvOrDefault("PORT", "3000"),
+		DBPath:                    getEnvOrDefault("DB_PATH", "data.db"),
+		DatabaseURL:               getEnvOrDefault("DATABASE_URL", ""),
+		AppviewURL:                getEnvOrDefault("APPVIEW_URL", ""),
+		BlobSource:                getEnvOrDefault("BLOB_SOURCE", "appview"),
+		PDSBlobAuth:               getEnvBoolOrDefault("PDS_BLOB_AUTH", false),
+		AppviewFailureCooldown:    getEnvDurationOrDefault("APPVIEW_FAILURE_COOLDOWN", 30*time.Second),
+		BlobHosts:                 getEnvOrDefault("BLOB_HOSTS", ""),
+		FrontendURL:               getEnvOrDefault("FRONTEND_URL", ""),
+		PLCUrl:                    getEnvOrDefault("ATPROTO_PLC_URL", ""),
+		AllowedDIDs:               getEnvOrDefault("ALLOWED_DIDS", ""),
+		TrustedProxies:            getEnvOrDefault("TRUSTED_PROXIES", ""),
+		RetryCooldown:             getEnvDurationOrDefault("CONVERSION_RETRY_COOLDOWN", time.Minute),
+		SegmentLength:             getEnvIntOrDefault("HLS_SEGMENT_LENGTH", 10),
+		FastStartSegmentLength:    getEnvIntOrDefault("FAST_START_SEGMENT_LENGTH", 0),
+		MaxSegments:               getEnvIntOrDefault("MAX_SEGMENTS", 0),
+		SegmentLimitAction:        getEnvOrDefault("SEGMENT_LIMIT_ACTION", "adjust"),
+		GOPSize:                   getEnvIntOrDefault("GOP_SIZE", 0),
+		SegmentFilename:           getEnvOrDefault("SEGMENT_FILENAME", "segment%d.ts"),
+		SingleFileHLS:             getEnvBoolOrDefault("SINGLE_FILE_HLS", false),
+		SegmentStartNumber:        getEnvIntOrDefault("SEGMENT_START_NUMBER", 0),
+		SentryDSN:                 getEnvOrDefault("SENTRY_DSN", ""),
+		VerifyBlobCID:             getEnvBoolOrDefault("VERIFY_BLOB_CID", false),
+		UploadThumbnail:           getEnvBoolOrDefault("UPLOAD_THUMBNAIL", false),
+		AdminToken:                getEnvOrDefault("ADMIN_TOKEN", ""),
+		ThumbnailSigningKey:       getEnvOrDefault("THUMBNAIL_SIGNING_KEY", ""),
+		FailedSourceRetention:     getEnvDurationOrDefault("FAILED_SOURCE_RETENTION", time.Hour),
+		FailedSourceMaxBytes:      int64(getEnvIntOrDefault("FAILED_SOURCE_MAX_BYTES", 1<<30)),
+		FailedConversionRetention: getEnvDurationOrDefault("FAILED_CONVERSION_RETENTION", 0),
+		FailedConversionMaxBytes:  int64(getEnvIntOrDefault("FAILED_CONVERSION_MAX_BYTES", 1<<30)),
+		LowLatencyHLS:             getEnvBoolOrDefault("LL_HLS", false),
+		LowLatencyPartLength:      getEnvDurationOrDefault("LL_HLS_PART_LENGTH", time.Second),
+		DailyByteLimit:            int64(getEnvIntOrDefault("DAILY_BYTE_LIMIT", 10000000)),
+		DailyVideoLimit:           int64(getEnvIntOrDefault("DAILY_VIDEO_LIMIT", 2000)),
+		MaxUploadBytes:            int64(getEnvIntOrDefault("MAX_UPLOAD_BYTES", 100000000)),
+		ForceYUV420P:              getEnvBoolOrDefault("FORCE_YUV420P", true),
+		TonemapHDR:                getEnvBoolOrDefault("TONEMAP_HDR", false),
+		AudioRenditions:           getEnvBoolOrDefault("AUDIO_RENDITIONS", false),
+		AudioOnlyRendition:        getEnvBoolOrDefault("AUDIO_ONLY_RENDITION", false),
+		RenditionsFile:            getEnvOrDefault("RENDITIONS_FILE", ""),
+		ProgramDateTime:           getEnvBoolOrDefault("PROGRAM_DATE_TIME", false),
+		FFmpegDryRun:              getEnvBoolOrDefault("FFMPEG_DRY_RUN", false),
+		FFmpegLogLevel:            getEnvOrDefault("FFMPEG_LOGLEVEL", ""),
+		// half the cores, leaving room for other conversions and serving
+		FFmpegThreads:           getEnvIntOrDefault("FFMPEG_THREADS", max(runtime.NumCPU()/2, 1)),
+		FFmpegNetworkOptions:    getEnvOrDefault("FFMPEG_NETWORK_OPTIONS", ""),
+		FFmpegNice:              getEnvIntOrDefault("FFMPEG_NICE", 0),
+		Gzip:                    getEnvBoolOrDefault("GZIP", false),
+		CDNBaseURL:              strings.TrimRight(getEnvOrDefault("CDN_BASE_URL", ""), "/"),
+		SegmentLogSampleRate:    getEnvIntOrDefault("SEGMENT_LOG_SAMPLE_RATE", 1),
+		JobPollInterval:         getEnvDurationOrDefault("JOB_POLL_INTERVAL", 2*time.Second),
+		JobProgressInterval:     getEnvDurationOrDefault("JOB_PROGRESS_INTERVAL", time.Second),
+		StreamSource:            getEnvBoolOrDefault("STREAM_SOURCE", false),
+		ConversionWaitTimeout:   getEnvDurationOrDefault("CONVERSION_WAIT_TIMEOUT", 0),
+		ProgressiveMP4:          getEnvBoolOrDefault("PROGRESSIVE_MP4", false),
+		VerifyOutputDuration:    getEnvBoolOrDefault("VERIFY_OUTPUT_DURATION", false),
+		OutputDurationTolerance: getEnvDurationOrDefault("OUTPUT_DURATION_TOLERANCE", time.Second),
+		CacheControlSegment:     getEnvOrDefault("CACHE_CONTROL_SEGMENT", "public, max-age=31536000, immutable"),
+		HashedSegments:          getEnvBoolOrDefault("HASHED_SEGMENTS", false),
+		CacheControlThumbnail:   getEnvOrDefault("CACHE_CONTROL_THUMBNAIL", "public, max-age=31536000"),
+		Watermark:               getEnvOrDefault("WATERMARK", ""),
+		WatermarkPosition:       getEnvOrDefault("WATERMARK_POSITION", "bottom-right"),
+		WatermarkOpacity:        getEnvIntOrDefault("WATERMARK_OPACITY", 100),
+		ThumbnailBaseURL:        strings.TrimRight(getEnvOrDefault("THUMBNAIL_BASE_URL", ""), "/"),
+		AllowedUploadTypes:      getEnvOrDefault("ALLOWED_UPLOAD_TYPES", "video/mp4,video/quicktime,video/webm,video/x-matroska,video/mpeg,video/x-m4v,video/3gpp"),
+		ScaleMode:               getEnvOrDefault("SCALE_MODE", "fit"),
+		VideoSize:               getEnvOrDefault("VIDEO_SIZE", ""),
+		ThumbnailSize:           getEnvOrDefault("THUMBNAIL_SIZE", "480x270"),
+		ThumbnailQuality:        getEnvIntOrDefault("THUMBNAIL_QUALITY", 4),
+		ThumbnailSeek:           getEnvOrDefault("THUMBNAIL_SEEK", "fast"),
+		WatchCORSOrigins:        getEnvOrDefault("WATCH_CORS_ORIGINS", "*"),
+		WatchCORSMethods:        getEnvOrDefault("WATCH_CORS_METHODS", "GET,HEAD,POST"),
+		WatchCORSHeaders:        getEnvOrDefault("WATCH_CORS_HEADERS", "Origin,Range,Content-Type"),
+		WatchCORSMaxAge:         getEnvDurationOrDefault("WATCH_CORS_MAX_AGE", 12*time.Hour),
+		APICORSMethods:          getEnvOrDefault("API_CORS_METHODS", "GET,HEAD,POST,PUT,PATCH,DELETE"),
+		APICORSHeaders:          getEnvOrDefault("API_CORS_HEADERS", "Origin,Authorization,atproto-accept-labelers,content-type,content-length,upload-length,upload-offset,idempotency-key"),
+		APICORSMaxAge:           getEnvDurationOrDefault("API_CORS_MAX_AGE", 12*time.Hour),
+		UploadExpiry:            getEnvDurationOrDefault("UPLOAD_EXPIRY", 24*time.Hour),
+		UploadMode:              getEnvOrDefault("UPLOAD_MODE", "pds"),
+		IdempotencyKeyTTL:       getEnvDurationOrDefault("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		JobTTL:                  getEnvDurationOrDefault("JOB_TTL", 48*time.Hour),
+		DiskHighWaterBytes:      int64(getEnvIntOrDefault("DISK_HIGH_WATER_BYTES", 0)),
+		DiskCriticalBytes:       int64(getEnvIntOrDefault("DISK_CRITICAL_BYTES", 0)),
+		TempSweepAge:            getEnvDurationOrDefault("TEMP_SWEEP_AGE", time.Hour),
+		MaxConversions:          getEnvIntOrDefault("MAX_CONVERSIONS", 1000),
+		PrepareConcurrency:      getEnvIntOrDefault("PREPARE_CONCURRENCY", 2),
+		UploadConcurrency:       getEnvIntOrDefault("UPLOAD_CONCURRENCY", 8),
+		UploadQueueSize:         getEnvIntOrDefault("UPLOAD_QUEUE_SIZE", 100),
+		MaxConcurrentDownloads:  getEnvIntOrDefault("MAX_CONCURRENT_DOWNLOADS", 8),
+		WorkDir:                 getEnvOrDefault("WORK_DIR", os.TempDir()),
+		BlobCache:               getEnvBoolOrDefault("BLOB_CACHE", false),
+		BlobCacheTTL:            getEnvDurationOrDefault("BLOB_CACHE_TTL", 24*time.Hour),
+		BlobCacheMaxBytes:       int64(getEnvIntOrDefault("BLOB_CACHE_MAX_BYTES", 5000000000)),
+		EncodePreset:            getEnvOrDefault("ENCODE_PRESET", "veryfast"),
+		CRF:                     getEnvIntOrDefault("CRF", 23),
+		MaxBitrate:              getEnvOrDefault("MAX_BITRATE", ""),
+	}
+	config.KeyframeInterval = getEnvIntOrDefault("KEYFRAME_INTERVAL", config.SegmentLength)
+	if config.LowLatencyHLS {
+		config.PlaylistType = getEnvOrDefault("HLS_PLAYLIST_TYPE", "event")
+		// reloaded every segment while converting
+		config.CacheControlPlaylist = getEnvOrDefault("CACHE_CONTROL_PLAYLIST", "public, max-age=1")
+	} else {
+		config.PlaylistType = getEnvOrDefault("HLS_PLAYLIST_TYPE", "vod")
+		config.CacheControlPlaylist = getEnvOrDefault("CACHE_CONTROL_PLAYLIST", "public, max-age=300")
+	}
+	renditions, err := loadRenditions(config.RenditionsFile)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	// the default ladder gives way to the options needing a single
+	// rendition
+	if config.RenditionsFile == "" && (config.LowLatencyHLS || config.AudioRenditions || config.AudioOnlyRendition || config.VideoSize != "") {
+		renditions = nil
+	}
+	config.Renditions = renditions
+	if err := config.validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	logSettings()
+	var tlsConfig *tls.Config
+	if config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			log.Fatalf("Invalid configuration: failed to load TLS_CERT and TLS_KEY: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
 
-	db, err := sql.Open("sqlite3", config.DBPath)
+	store, err := openStore(config)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Error opening database: %v", err)
 	}
-	defer db.Close()
+	defer store.Close()
 
-	_, err = db.Exec(`
-	PRAGMA journal_mode=WAL;
-	PRAGMA busy_timeout = 5000;
-	PRAGMA synchronous = NORMAL;
-	PRAGMA cache_size = 1000000000;
-	PRAGMA foreign_keys = true;
-	PRAGMA temp_store = memory;
+	allowedDIDs := splitList(config.AllowedDIDs)
 
-	CREATE TABLE IF NOT EXISTS users (
-		did text primary key,
-		handle text
-	) STRICT;
-	`)
+	reporter, err := newErrorReporter(config.SentryDSN)
 	if err != nil {
-		log.Fatalf("Error creating tables: %v", err)
+		log.Fatalf("Failed to create error reporter: %v", err)
 	}
-
-	allowedDIDs := make([]string, 0)
-	if config.AllowedDIDs != "" {
-		for _, did := range strings.Split(config.AllowedDIDs, ",") {
-			allowedDIDs = append(allowedDIDs, did)
+	defer reporter.Flush(2 * time.Second)
+
+	storage := Storage{jobs: store, users: store, pins: store, resolver: newIdentityResolver(config.PLCUrl)}
+	cm := NewConversionManager(config, reporter)
+	cm.jobs = store
+	cm.userPDS = func(ctx context.Context, did string) (string, error) {
+		u, err := storage.fetchUser(ctx, did)
+		if err != nil {
+			return "", err
 		}
+		if u.pdsUrl == "" {
+			return "", fmt.Errorf("user %s has no PDS", did)
+		}
+		return u.pdsUrl, nil
 	}
-
-	storage := Storage{db: db, appviewUrl: config.AppviewURL, plcUrl: config.PLCUrl}
-	cm := NewConversionManager(config)
-	state := State{storage: &storage, cm: cm, allowedDIDs: allowedDIDs}
+	if config.TempSweepAge > 0 {
+		sweepTempFiles(config, time.Now().Add(-config.TempSweepAge))
+	}
+	if config.BlobCache {
+		cm.blobCache, err = NewBlobCache(filepath.Join(config.WorkDir, "blobs"), config.BlobCacheTTL, config.BlobCacheMaxBytes)
+		if err != nil {
+			log.Fatalf("Error opening blob cache: %v", err)
+		}
+	}
+	state := State{
+		storage:     &storage,
+		cm:          cm,
+		allowedDIDs: allowedDIDs,
+		reporter:    reporter,
+		config:      config,
+		queue:       NewJobQueue(config.UploadConcurrency, config.UploadQueueSize),
+	}
+	state.loadPins()
 
 	// Create Gin router
 	r := gin.New()
 
+	// gin trusts X-Forwarded-For from everyone by default, which lets any
+	// client pick its own c.ClientIP()
+	if err := r.SetTrustedProxies(splitList(config.TrustedProxies)); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Middleware
-	r.Use(gin.Recovery())
-	r.Use(gin.Logger())
-
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{config.AppviewURL, config.FrontendURL},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH"},
-		AllowHeaders:     []string{"Origin", "Authorization", "atproto-accept-labelers", "content-type", "content-length"},
-		ExposeHeaders:    []string{"Content-Length", "Content-Type"},
-		AllowCredentials: true,
-		AllowOriginFunc: func(origin string) bool {
-			return origin == config.AppviewURL || origin == config.FrontendURL
-		},
-		MaxAge: 12 * time.Hour,
-	}))
+	r.Use(recoverAndReport(reporter))
+	r.Use(requestLogger(config.SegmentLogSampleRate))
+	if config.Gzip {
+		r.Use(gzipText())
+	}
+
+	r.Use(corsByRoute(apiCORS(config), watchCORS(config)))
 
 	serviceWebDID := "did:web:" + config.ServerHostname
 	auther, err := NewAuth(
@@ -699,28 +2518,111 @@ func main() {
 	authGroup.Use(auther.AuthenticateGinRequestViaJWT)
 	authGroup.GET("/xrpc/app.bsky.video.getUploadLimits", state.getUploadLimits)
 	authGroup.GET("/xrpc/app.bsky.video.getJobStatus", state.getJobStatus)
-	r.POST("/xrpc/app.bsky.video.uploadVideo", state.uploadVideo)
+	authGroup.GET("/xrpc/pm.l4.douga.getJobStatusByBlob", state.getJobStatusByBlob)
+	// local uploads never reach a PDS to check their tokens, so those must
+	// be meant for us
+	auther.LocalUploads = config.UploadMode == "local"
+	uploadAuth := auther.AuthenticateUploader
+	r.POST("/xrpc/app.bsky.video.uploadVideo", uploadAuth, limitBody(config.MaxUploadBytes), state.uploadVideo)
+	r.POST("/xrpc/pm.l4.douga.createUpload", uploadAuth, state.createUpload)
+	r.DELETE("/xrpc/pm.l4.douga.deleteUserData", adminOrUser(config.AdminToken, auther), state.deleteUserData)
+	r.HEAD("/uploads/:id", uploadAuth, state.getUploadOffset)
+	r.PATCH("/uploads/:id", uploadAuth, limitBody(config.MaxUploadBytes), state.uploadChunk)
+
+	if config.AdminToken != "" {
+		adminGroup := r.Group("/admin")
+		adminGroup.Use(requireAdmin(config.AdminToken))
+		adminGroup.POST("/jobs/:id/retry", state.retryJob)
+		adminGroup.GET("/conversions/:did/:cid", state.getConversionStatus)
+		adminGroup.GET("/thumbnails/:did/:cid/sign", state.signThumbnail)
+		adminGroup.POST("/flush", state.flush)
+		adminGroup.GET("/pins", state.listPins)
+		adminGroup.PUT("/pins/:did/:cid", state.pinVideo)
+		adminGroup.DELETE("/pins/:did/:cid", state.unpinVideo)
+		r.GET("/selftest", requireAdmin(config.AdminToken), state.selfTest)
+	}
 
 	// TODO implement
 	r.GET("/watch/:did/:cid/*filepath", state.getVideoOrThumbnail)
-
-	r.GET("/", func(c *gin.Context) {
-		c.String(200, "https://github.com/lun-4/douga -- a reimplementation of video.bsky.app for the bit")
-	})
+	r.HEAD("/watch/:did/:cid/*filepath", state.getVideoOrThumbnail)
+	r.POST("/watch/:did/:cid/prepare", state.prepareVideo)
+	r.POST("/watch/prepare", limitBody(maxPrepareBodyBytes), state.prepareVideos)
+	r.OPTIONS("/watch/:did/:cid/*filepath", allowMethods("GET", "HEAD", "POST"))
+	r.OPTIONS("/watch/prepare", allowMethods("POST"))
+
+	r.GET("/", state.getStatus)
+	r.NoRoute(notFound)
+	didServices, err := parseDIDServices(config.DIDServices)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 	r.GET("/.well-known/did.json", func(c *gin.Context) {
-		didDoc := newDIDDocument(config.ServerHostname)
+		didDoc := newDIDDocument(config.ServerHostname, didServices)
 		c.JSON(200, didDoc)
 	})
 
 	// Start server
-	addr := ":" + config.Port
-	fmt.Printf("Server starting on %s\n", addr)
-	r.Run(addr)
+	addr := net.JoinHostPort(config.BindAddress, config.Port)
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   r.Handler(),
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		// HTTP/2 is negotiated over TLS, so players can fetch many
+		// segments over one connection
+		fmt.Printf("Server starting on %s (TLS)\n", addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		fmt.Printf("Server starting on %s\n", addr)
+		err = server.ListenAndServe()
+	}
+	log.Fatal(err)
 }
 
+// getEnvOrDefault reads the setting key from the environment, falling back
+// to CONFIG_FILE and then defaultValue.
 func getEnvOrDefault(key, defaultValue string) string {
-	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
-		return value
+	value, source := lookupSetting(key)
+	if value == "" {
+		value, source = defaultValue, "default"
+	}
+	recordSetting(key, value, source)
+	return value
+}
+
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value := getEnvOrDefault(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return d
+}
+
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value := getEnvOrDefault(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return n
+}
+
+func getEnvBoolOrDefault(key string, defaultValue bool) bool {
+	value := getEnvOrDefault(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
 	}
-	return defaultValue
+	return b
 }
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConfigLists(t *testing.T) {
+	if got := splitList(" a, ,b ,"); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("splitList: got %q", got)
+	}
+	config := Config{AppviewURL: "https://appview.example, http://localhost:8080/", BlobSource: "appview"}
+	if got := config.blobHosts(); !slices.Equal(got, []string{"appview.example", "localhost:8080"}) {
+		t.Errorf("appview blob hosts: got %q", got)
+	}
+	config.BlobHosts = " cdn.example ,"
+	if got := config.blobHosts(); !slices.Equal(got, []string{"cdn.example"}) {
+		t.Errorf("BLOB_HOSTS: got %q", got)
+	}
+	config = Config{BlobSource: "pds"}
+	if got := config.blobHosts(); got != nil {
+		t.Errorf("any PDS: got %q", got)
+	}
+}
+
+func TestEvictConversions(t *testing.T) {
+	config := testConfig(t)
+	config.MaxConversions = 2
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+
+	var dirs []string
+	for i := range 3 {
+		conv, release, err := cm.getOrCreateConversion("did:plc:a", fmt.Sprintf("cid%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, conv.OutputDir)
+		release()
+		// LastAccessed orders them
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := cm.conversions.Load("did:plc:a/cid0"); ok {
+		t.Errorf("expected the least recently accessed conversion to be evicted")
+	}
+	if _, err := os.Stat(dirs[0]); !os.IsNotExist(err) {
+		t.Errorf("expected the output of the evicted conversion to be removed, got %v", err)
+	}
+	for _, cid := range []string{"cid1", "cid2"} {
+		if _, ok := cm.conversions.Load("did:plc:a/" + cid); !ok {
+			t.Errorf("expected %s to stay cached", cid)
+		}
+	}
+
+	// conversions in use are never evicted
+	_, release, ok := cm.lookupConversion("did:plc:a", "cid1")
+	if !ok {
+		t.Fatal("expected cid1 to be cached")
+	}
+	defer release()
+	if _, release, err := cm.getOrCreateConversion("did:plc:a", "cid3"); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+	if _, ok := cm.conversions.Load("did:plc:a/cid1"); !ok {
+		t.Errorf("expected the conversion in use to stay cached")
+	}
+	if _, ok := cm.conversions.Load("did:plc:a/cid2"); ok {
+		t.Errorf("expected the idle conversion to be evicted instead")
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	config := testConfig(t)
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+	idle, release, err := cm.getOrCreateConversion("did:plc:a", "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	inUse, release, err := cm.getOrCreateConversion("did:plc:a", "inuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	cm.removeExpired(time.Now())
+	if _, ok := cm.conversions.Load("did:plc:a/idle"); ok {
+		t.Errorf("expected the expired conversion to be removed")
+	}
+	if _, err := os.Stat(idle.OutputDir); !os.IsNotExist(err) {
+		t.Errorf("expected the output of the expired conversion to be removed, got %v", err)
+	}
+	if _, err := os.Stat(inUse.OutputDir); err != nil {
+		t.Errorf("expected the conversion in use to be kept, got %v", err)
+	}
+}
+
+// BenchmarkCleanupLockHold measures how long removing an expired
+// conversion holds its lock, blocking requests for its video: only while
+// removeConversion picks it, as removeExpired does, or for the whole
+// removal of its directory, as cleanup used to.
+func BenchmarkCleanupLockHold(b *testing.B) {
+	const conversions = 20
+	const filesPerConversion = 100
+	for _, underLock := range []bool{false, true} {
+		name := "outside"
+		if underLock {
+			name = "under"
+		}
+		b.Run(name, func(b *testing.B) {
+			config := testConfig(b)
+			config.MaxConversions = 0
+			cm := NewConversionManager(config, noopReporter{})
+			defer cm.cleanupTicker.Stop()
+			held := time.Duration(0)
+			for range b.N {
+				b.StopTimer()
+				keys := make([]string, 0, conversions)
+				for i := range conversions {
+					conv, release, err := cm.getOrCreateConversion("did:plc:a", fmt.Sprintf("cid%d", i))
+					if err != nil {
+						b.Fatal(err)
+					}
+					for j := range filesPerConversion {
+						if err := os.WriteFile(fmt.Sprintf("%s/segment%d.ts", conv.OutputDir, j), []byte("segment"), 0o600); err != nil {
+							b.Fatal(err)
+						}
+					}
+					release()
+					keys = append(keys, fmt.Sprintf("did:plc:a/cid%d", i))
+				}
+				expired := time.Now()
+				b.StartTimer()
+
+				for _, key := range keys {
+					convA, _ := cm.conversions.Load(key)
+					conv := convA.(*Conversion)
+					started := time.Now()
+					if underLock {
+						conv.mu.Lock()
+						conv.removed = true
+						cm.conversions.CompareAndDelete(key, conv)
+						os.RemoveAll(conv.OutputDir)
+						conv.mu.Unlock()
+						held += time.Since(started)
+						continue
+					}
+					removed := cm.removeConversion(key, conv, expired)
+					held += time.Since(started)
+					if removed {
+						os.RemoveAll(conv.OutputDir)
+					}
+				}
+			}
+			b.ReportMetric(float64(held.Nanoseconds())/float64(b.N*conversions), "lock-ns/conversion")
+		})
+	}
+}
+
+func TestRetryCooldown(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	config.RetryCooldown = 50 * time.Millisecond
+	runner := &fakeRunner{err: errors.New("exit status 1")}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/watch/%s/%s/playlist.m3u8", did, blobCID)
+
+	get(r, "GET", path)
+	runs := runner.runs("ffmpeg")
+	w := get(r, "GET", path)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("during the cooldown: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if runner.runs("ffmpeg") != runs {
+		t.Errorf("expected no conversion during the cooldown")
+	}
+	time.Sleep(config.RetryCooldown)
+	get(r, "GET", path)
+	if runner.runs("ffmpeg") == runs {
+		t.Errorf("expected the conversion to be retried after the cooldown")
+	}
+}
+
+func TestWatchHead(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	runner := &fakeRunner{}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+
+	for _, filename := range []string{"playlist.m3u8", "segment0.ts", "thumbnail.jpg"} {
+		if w := get(r, "HEAD", base+filename); w.Code != http.StatusNotFound {
+			t.Errorf("HEAD %s before converting: got %d", filename, w.Code)
+		}
+	}
+	if runner.runs("ffmpeg") != 0 || runner.runs("ffprobe") != 0 {
+		t.Fatalf("expected HEAD not to start a conversion")
+	}
+
+	get(r, "GET", base+"playlist.m3u8")
+	for filename, contentType := range map[string]string{"segment0.ts": "video/mp2t", "thumbnail.jpg": "image/jpeg"} {
+		w := get(r, "HEAD", base+filename)
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Errorf("HEAD %s: got %d with %d bytes", filename, w.Code, w.Body.Len())
+		}
+		if w.Header().Get("Content-Type") != contentType || w.Header().Get("Content-Length") == "" {
+			t.Errorf("HEAD %s: Content-Type %q, Content-Length %q", filename, w.Header().Get("Content-Type"), w.Header().Get("Content-Length"))
+		}
+	}
+}
+
+// collidingJobs is a JobStore whose next CreateJob calls find their job
+// ID taken.
+type collidingJobs struct {
+	JobStore
+	collisions int
+}
+
+func (j *collidingJobs) CreateJob(job Job, idempotencyKey string, keysExpiredBefore time.Time) (string, error) {
+	if j.collisions > 0 {
+		j.collisions--
+		return "", errJobExists
+	}
+	return j.JobStore.CreateJob(job, idempotencyKey, keysExpiredBefore)
+}
+
+func TestCreateJobCollision(t *testing.T) {
+	jobs := &collidingJobs{JobStore: newTestStore(t), collisions: 2}
+	s := &State{storage: &Storage{jobs: jobs}}
+	job := testJob("", "did:plc:a")
+	id, err := s.createJob(&job, "")
+	if err != nil || id != job.ID {
+		t.Fatalf("after collisions: got %q %v, job %q", id, err, job.ID)
+	}
+	if _, err := jobs.GetJob(id); err != nil {
+		t.Errorf("expected the job to be stored: %s", err)
+	}
+
+	jobs.collisions = 100
+	if _, err := s.createJob(&job, ""); err == nil {
+		t.Errorf("expected giving up after too many collisions")
+	}
+}
+
+func TestServeConversionFileContentTypes(t *testing.T) {
+	s, r := newTestState(t, testConfig(t), &fakeRunner{})
+	conv := &Conversion{OutputDir: t.TempDir()}
+	r.GET("/files/:did/:cid/:filename", func(c *gin.Context) {
+		s.serveConversionFile(c, conv, c.Param("filename"))
+	})
+
+	for filename, contentType := range map[string]string{
+		"playlist.m3u8":  "application/vnd.apple.mpegurl",
+		"segment0.ts":    "video/mp2t",
+		"segment0.m4s":   "video/iso.segment",
+		"init.mp4":       "video/mp4",
+		"subtitles.vtt":  "text/vtt",
+		"thumbnail.jpg":  "image/jpeg",
+		"thumbnail.webp": "image/webp",
+		"thumbnail.avif": "image/avif",
+	} {
+		content := "data"
+		if filepath.Ext(filename) == ".m3u8" {
+			content = "#EXTM3U\n#EXTINF:1,\nsegment0.ts\n#EXT-X-ENDLIST\n"
+		}
+		if err := os.WriteFile(filepath.Join(conv.OutputDir, filename), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		w := get(r, "GET", "/files/did/cid/"+filename)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Errorf("%s: got %d %q, expected %q", filename, w.Code, w.Header().Get("Content-Type"), contentType)
+		}
+	}
+
+	// the watch routes refuse anything else
+	for _, filename := range []string{"source.exe", "playlist.m3u8.bak", "notes.txt"} {
+		if w := get(r, "GET", "/watch/did:plc:a/cid/"+filename); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, expected 400", filename, w.Code)
+		}
+	}
+}
+
+func TestDownloadBlobCleanup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		// promise more than is sent, the copy fails midway
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("partial"))
+	}))
+	defer server.Close()
+	config := testConfig(t)
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+	guard := newBlobGuard([]string{strings.TrimPrefix(server.URL, "http://")})
+
+	for _, path := range []string{"/partial", "/missing"} {
+		if _, err := cm.downloadBlob(context.Background(), guard, server.URL+path, ""); err == nil {
+			t.Fatalf("%s: expected the download to fail", path)
+		}
+		entries, err := os.ReadDir(config.tempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%s: expected no temp file left behind, found %s", path, entries[0].Name())
+		}
+	}
+}
+
+func TestOutputDeletedMidServe(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	runner := &fakeRunner{}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+	if w := get(r, "GET", base+"playlist.m3u8"); w.Code != http.StatusOK {
+		t.Fatalf("playlist: got %d", w.Code)
+	}
+
+	// a conversion being served is never cleaned up, however old
+	conv, release, ok := s.cm.lookupConversion(did, blobCID.String())
+	if !ok {
+		t.Fatal("expected the conversion to be cached")
+	}
+	s.cm.removeExpired(time.Now().Add(time.Hour))
+	if _, err := os.Stat(filepath.Join(conv.OutputDir, "segment1.ts")); err != nil {
+		t.Fatalf("expected the served conversion to be kept: %s", err)
+	}
+	release()
+
+	// its output going away anyway converts it again
+	runs := runner.runs("ffmpeg")
+	if err := os.RemoveAll(conv.OutputDir); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(r, "GET", base+"segment1.ts"); w.Code != http.StatusOK || w.Body.String() != "segment 1" {
+		t.Fatalf("segment after its output was deleted: got %d %q", w.Code, w.Body)
+	}
+	if runner.runs("ffmpeg") == runs {
+		t.Errorf("expected the video to be converted again")
+	}
+}
+
+func TestThumbnailConditionalRequests(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	s, r := newTestState(t, config, &fakeRunner{})
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/watch/%s/%s/thumbnail.jpg", did, blobCID)
+
+	w := get(r, "GET", path)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("expected a thumbnail with validators, got %d, ETag %q, Last-Modified %q", w.Code, etag, lastModified)
+	}
+
+	for _, tc := range []struct {
+		header, value string
+		code          int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"stale"`, http.StatusOK},
+		{"If-Modified-Since", lastModified, http.StatusNotModified},
+		{"If-Modified-Since", time.Unix(0, 0).UTC().Format(http.TimeFormat), http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(tc.header, tc.value)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("%s: %s: expected %d, got %d", tc.header, tc.value, tc.code, w.Code)
+		}
+		if tc.code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s: expected no body with 304, got %d bytes", tc.header, w.Body.Len())
+		}
+	}
+}
+
+// progressJobs is a JobStore keeping the progress of every saved job.
+type progressJobs struct {
+	JobStore
+	mu       sync.Mutex
+	progress []int64
+}
+
+func (j *progressJobs) SaveJob(job Job) error {
+	j.mu.Lock()
+	j.progress = append(j.progress, job.progress)
+	j.mu.Unlock()
+	return j.JobStore.SaveJob(job)
+}
+
+func TestUploadProgress(t *testing.T) {
+	body := make([]byte, 4<<20)
+	var received int
+	pds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// read slowly, so that the body is sent in many reads
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := r.Body.Read(buf)
+			received += n
+			if err != nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"blob":{"$type":"blob","ref":{"$link":"bafkreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},"mimeType":"video/mp4","size":%d}}`, received)
+	}))
+	defer pds.Close()
+	store := newTestStore(t)
+	jobs := &progressJobs{JobStore: store}
+	s := &State{
+		storage:  &Storage{jobs: jobs, users: store, resolver: staticResolver(pds.URL)},
+		config:   Config{JobProgressInterval: 0},
+		reporter: noopReporter{},
+	}
+	job := testJob("job1", "did:plc:a")
+	job.contentType = "video/mp4"
+	if err := s.processJob(context.Background(), job, body); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	var uploading int
+	for i, progress := range jobs.progress {
+		if i > 0 && progress < jobs.progress[i-1] {
+			t.Errorf("progress went back: %v", jobs.progress)
+			break
+		}
+		if progress > 10 && progress < 90 {
+			uploading++
+		}
+	}
+	if uploading == 0 || jobs.progress[len(jobs.progress)-1] != 100 {
+		t.Errorf("expected progress between 10 and 90 while uploading, then 100, got %v", jobs.progress)
+	}
+}
+
+// panickingResolver panics resolving any DID, like a bug deep in a job.
+type panickingResolver struct{}
+
+func (panickingResolver) ResolvePDS(ctx context.Context, did string) (string, error) {
+	var user *User
+	return user.pdsUrl, nil
+}
+
+func TestProcessPanic(t *testing.T) {
+	store := newTestStore(t)
+	reporter := &recordingReporter{}
+	s := &State{
+		storage:  &Storage{jobs: store, users: store, resolver: panickingResolver{}},
+		config:   testConfig(t),
+		reporter: reporter,
+	}
+	job := testJob("job1", "did:plc:a")
+	job.contentType = "video/mp4"
+	s.process(job, []byte("a video"))
+
+	saved, err := store.GetJob("job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.state != "JOB_STATE_FAILED" || saved.err == nil || !strings.Contains(saved.err.Error(), "internal error") {
+		t.Errorf("expected the job to be failed with an internal error, got %s, %v", saved.state, saved.err)
+	}
+	if reporter.reported() != 1 {
+		t.Errorf("expected the panic to be reported, got %v", reporter.errs)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mp4Filename is the progressive MP4 of a video, for clients that can't
+// play HLS.
+const mp4Filename = "video.mp4"
+
+// mp4Key identifies the progressive MP4 of did/cid in conversions.
+func mp4Key(did, cid string) string {
+	return fmt.Sprintf("%s/%s/mp4", did, cid)
+}
+
+// mp4Compatible reports whether the source already plays as a progressive
+// MP4 everywhere, and only needs its moov atom moved to the front: an MP4
+// with H.264 4:2:0 video and AAC audio, if any. A WATERMARK needs a
+// transcode regardless.
+func (p *ProbeResult) mp4Compatible() bool {
+	if !slices.Contains(strings.Split(p.Format.FormatName, ","), "mp4") {
+		return false
+	}
+	video, ok := p.videoStream()
+	if !ok || video.CodecName != "h264" || video.PixFmt != "yuv420p" {
+		return false
+	}
+	audio := p.audioStreams()
+	return len(audio) == 0 || audio[0].CodecName == "aac"
+}
+
+// mp4Args builds the ffmpeg arguments converting input into a faststart
+// MP4 at output, with its first video and audio stream. probe is the
+// ffprobe result of input, which may be nil.
+func (cm *ConversionManager) mp4Args(input, output string, probe *ProbeResult) []string {
+	maps := []string{"-map", "0:v:0?", "-map", "0:a:0?"}
+	faststart := []string{"-movflags", "+faststart", "-f", "mp4", "-y", output}
+	if probe != nil && probe.mp4Compatible() && cm.config.Watermark == "" {
+		args := append(cm.inputArgs(input), maps...)
+		args = append(args, "-c", "copy")
+		return append(args, faststart...)
+	}
+
+	args, rotate := rotationArgs(probe)
+	args = append(args, cm.inputArgs(input)...)
+	args = append(args, maps...)
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", cm.config.EncodePreset,
+		"-crf", strconv.Itoa(cm.config.CRF),
+	)
+	if cm.config.MaxBitrate != "" {
+		args = append(args, "-maxrate", cm.config.MaxBitrate, "-bufsize", cm.config.MaxBitrate)
+	}
+	args = append(args, cm.threadArgs()...)
+
+	var filters []string
+	if rotate != "" {
+		filters = append(filters, rotate)
+	}
+	if cm.config.TonemapHDR && probe != nil && probe.isHDR() {
+		filters = append(filters, tonemapFilter)
+	}
+	if cm.config.VideoSize != "" {
+		filters = append(filters, scaleFilter(cm.config.ScaleMode, cm.config.VideoSize))
+	}
+	// unlike HLS players, not every progressive player decodes 4:2:2/4:4:4
+	filters = append(filters, "format=yuv420p")
+	args = append(args, "-vf", cm.videoFilterGraph(filters), "-c:a", "aac")
+	return append(args, faststart...)
+}
+
+// convertToMP4 is convertToHLS for the progressive MP4 of did/cid.
+func (cm *ConversionManager) convertToMP4(ctx context.Context, did, cid string, conv *Conversion) error {
+	claimed, err := cm.claimConversion(ctx, conv)
+	if !claimed {
+		return err
+	}
+	defer cm.finishConversion(ctx, conv)
+
+	source, probeResult, cleanup, err := cm.openSource(ctx, did, cid)
+	if err != nil {
+		return cm.failConversion(conv, err, nil)
+	}
+	defer cleanup()
+
+	output, err := cm.runFFmpeg(ctx, cm.mp4Args(source, filepath.Join(conv.OutputDir, mp4Filename), probeResult)...)
+	var dryRun *DryRunError
+	if errors.As(err, &dryRun) {
+		return err
+	}
+	if err != nil {
+		log.Printf("ffmpeg failed converting %s/%s to MP4: %s, output:\n%s", did, cid, err, output)
+		cm.report(ctx, fmt.Errorf("ffmpeg mp4 error: %w", err), map[string]string{
+			"did":           did,
+			"cid":           cid,
+			"ffmpeg_output": outputTail(output, ffmpegOutputTail),
+		})
+		return cm.failConversion(conv, &ConversionError{Kind: transcodeErrorKind(ctx), Err: fmt.Errorf("ffmpeg mp4 error: %v", err)}, output)
+	}
+	log.Printf("Converted %s to MP4", cid)
+	return nil
+}
+
+// getMP4 serves the progressive MP4 of a video, converting it first if
+// needed. Range requests are supported, for seeking.
+func (s *State) getMP4(c *gin.Context) {
+	if !s.config.ProgressiveMP4 {
+		c.AbortWithError(http.StatusNotFound, errors.New("progressive MP4 is disabled"))
+		return
+	}
+	did := c.Param("did")
+	cid := c.Param("cid")
+
+	if c.Request.Method == http.MethodHead {
+		conv, release, ok := s.cm.lookupOutput(mp4Key(did, cid))
+		if !ok {
+			c.AbortWithError(http.StatusNotFound, errors.New("conversion not found"))
+			return
+		}
+		defer release()
+		conv.mu.Lock()
+		converting := conv.Converting
+		conv.mu.Unlock()
+		if _, err := os.Stat(filepath.Join(conv.OutputDir, mp4Filename)); err != nil || converting {
+			c.AbortWithError(http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		s.serveConversionFile(c, conv, mp4Filename)
+		return
+	}
+
+	conv, release, err := s.cm.getOrCreateOutput(mp4Key(did, cid), fmt.Sprintf("mp4_%s_%s_*", did, cid))
+	if errors.Is(err, errDiskFull) {
+		c.Header("Retry-After", fmt.Sprintf("%.0f", diskUsageInterval.Seconds()))
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer release()
+	if s.respondRecentFailure(c, conv) {
+		return
+	}
+
+	// ffmpeg writes the file as it goes, it is only complete once the
+	// conversion is done
+	conv.mu.Lock()
+	converting := conv.Converting
+	conv.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(conv.OutputDir, mp4Filename)); os.IsNotExist(err) || converting {
+		err := s.convertOrTimeout(c, conv, func(ctx context.Context) error {
+			return s.cm.convertToMP4(ctx, did, cid, conv)
+		})
+		if err != nil {
+			s.respondConversionError(c, err)
+			return
+		}
+	}
+
+	s.serveConversionFile(c, conv, mp4Filename)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gin-gonic/gin"
+	"github.com/ipfs/go-cid"
+)
+
+// Pinned videos (e.g. of a pinned post) are converted ahead of time and
+// never evicted, along with their thumbnail, so that they always play
+// right away. Pins are kept in the database, which instances sharing it
+// reload them from.
+
+// pinWarmInterval is how often pins are reloaded, and pinned videos
+// checked to still be converted, e.g. after a refresh threw their
+// conversion away.
+const pinWarmInterval = 5 * time.Minute
+
+// loadPins marks the pinned videos of the database as never evicted and
+// warms them, then keeps them warm.
+func (s *State) loadPins() {
+	if n, ok := s.reloadPins(); ok {
+		log.Printf("Loaded %d pinned videos", n)
+	}
+	go s.pinRoutine()
+}
+
+func (s *State) pinRoutine() {
+	s.warmPins()
+	for range time.Tick(pinWarmInterval) {
+		// pinned or unpinned on another instance meanwhile
+		s.reloadPins()
+		s.warmPins()
+	}
+}
+
+// reloadPins makes the pinned videos those of the database, returning
+// how many there are. On error, the pins are left as they were.
+func (s *State) reloadPins() (int, bool) {
+	pins, err := s.storage.pins.ListPins()
+	if err != nil {
+		log.Printf("Failed to load pins: %s", err)
+		return 0, false
+	}
+	keys := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		key := fmt.Sprintf("%s/%s", pin.DID, pin.CID)
+		keys[key] = true
+		s.cm.pinned.Store(key, struct{}{})
+	}
+	s.cm.pinned.Range(func(keyA, _ any) bool {
+		if !keys[keyA.(string)] {
+			s.cm.pinned.Delete(keyA)
+		}
+		return true
+	})
+	return len(pins), true
+}
+
+// warmPins prepares the pinned videos that aren't converted.
+func (s *State) warmPins() {
+	s.cm.pinned.Range(func(keyA, _ any) bool {
+		// neither DIDs nor CIDs contain a slash
+		did, cid, _ := strings.Cut(keyA.(string), "/")
+		if _, _, err := s.prepare(did, cid, thumbnailJPEG); err != nil {
+			log.Printf("Failed to warm pinned video %s: %s", keyA, err)
+		}
+		return true
+	})
+}
+
+// pinParams parses the did and cid of a pin request.
+func pinParams(c *gin.Context) (string, string, bool) {
+	did, err := syntax.ParseDID(c.Param("did"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid did: %w", err))
+		return "", "", false
+	}
+	blobCID, err := cid.Decode(c.Param("cid"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid cid: %w", err))
+		return "", "", false
+	}
+	return did.String(), blobCID.String(), true
+}
+
+// pinVideo pins a video and starts converting it.
+func (s *State) pinVideo(c *gin.Context) {
+	did, cid, ok := pinParams(c)
+	if !ok {
+		return
+	}
+	if err := s.storage.pins.AddPin(did, cid); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.cm.pinned.Store(fmt.Sprintf("%s/%s", did, cid), struct{}{})
+	status, _, err := s.prepare(did, cid, thumbnailJPEG)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Pinned %s/%s", did, cid)
+	c.JSON(http.StatusOK, gin.H{"did": did, "cid": cid, "status": status})
+}
+
+// unpinVideo unpins a video, which is then evicted like any other.
+func (s *State) unpinVideo(c *gin.Context) {
+	did, cid, ok := pinParams(c)
+	if !ok {
+		return
+	}
+	removed, err := s.storage.pins.RemovePin(did, cid)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if !removed {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("%s/%s is not pinned", did, cid))
+		return
+	}
+	s.cm.pinned.Delete(fmt.Sprintf("%s/%s", did, cid))
+	log.Printf("Unpinned %s/%s", did, cid)
+	c.Status(http.StatusNoContent)
+}
+
+func (s *State) listPins(c *gin.Context) {
+	pins, err := s.storage.pins.ListPins()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, pins)
+}
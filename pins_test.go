@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPins(t *testing.T) {
+	s, _ := newTestState(t, testConfig(t), &fakeRunner{})
+	store := newTestStore(t)
+	s.storage = &Storage{pins: store}
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+
+	// pinned on another instance
+	if err := store.AddPin(did, "cid1"); err != nil {
+		t.Fatal(err)
+	}
+	s.cm.pinned.Store(did+"/cid2", struct{}{})
+	if n, ok := s.reloadPins(); !ok || n != 1 {
+		t.Fatalf("expected 1 pin, got %d", n)
+	}
+	if _, ok := s.cm.pinned.Load(did + "/cid1"); !ok {
+		t.Error("expected the pin of the database to be loaded")
+	}
+	if _, ok := s.cm.pinned.Load(did + "/cid2"); ok {
+		t.Error("expected the pin missing from the database to be dropped")
+	}
+
+	// thumbnails of pinned videos are kept like their conversion
+	for cid, kept := range map[string]bool{"cid1": true, "cid2": false} {
+		thumb, err := s.cm.getOrCreateThumbnail(did, cid, thumbnailJPEG, thumbnailAt, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		removed := s.cm.removeThumbnail(thumbnailKey(did, cid, thumbnailJPEG, thumbnailAt, false), thumb, time.Now())
+		if removed == kept {
+			t.Errorf("%s: expected kept to be %v", cid, kept)
+		}
+	}
+}
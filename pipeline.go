@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A conversion and a thumbnail each run in three steps: claiming them
+// (or waiting for whoever already runs them), opening the source, and
+// running ffmpeg on it. convertAll runs both from a single download of
+// the source, convertToHLS and generateThumbnail only one of them.
+
+// claimConversion waits for the running conversion of conv, if any, and
+// reports whether the caller is to run it now, in which case it must call
+// finishConversion once done. Otherwise err is the result of the
+// conversion that ran.
+func (cm *ConversionManager) claimConversion(ctx context.Context, conv *Conversion) (claimed bool, err error) {
+	conv.mu.Lock()
+	for conv.Converting {
+		// Conversion already in progress, wait for it instead
+		done := conv.done
+		conv.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		conv.mu.Lock()
+		if !conv.Converting && !conv.interrupted {
+			err := conv.Error
+			conv.mu.Unlock()
+			return false, err
+		}
+		// it was interrupted and we take over, unless another request
+		// already did
+	}
+	conv.Converting = true
+	conv.Error = nil
+	conv.FFmpegOutput = ""
+	conv.ffmpegLog = ""
+	conv.retainedDir = ""
+	conv.interrupted = false
+	conv.done = make(chan struct{})
+	conv.mu.Unlock()
+	return true, nil
+}
+
+// finishConversion ends a conversion claimed with ctx, waking up those
+// waiting for it.
+func (cm *ConversionManager) finishConversion(ctx context.Context, conv *Conversion) {
+	// the output is ours until Converting is cleared, clean it up first
+	// without holding conv.mu
+	conv.mu.Lock()
+	convErr, ffmpegLog := conv.Error, conv.ffmpegLog
+	conv.mu.Unlock()
+	retainedDir := ""
+	if convErr != nil {
+		if ctx.Err() == nil && cm.config.FailedConversionRetention > 0 {
+			retainedDir = cm.retainFailure(conv.OutputDir, convErr, ffmpegLog)
+			// keep within FAILED_CONVERSION_MAX_BYTES right away
+			cm.pruneFailures()
+		}
+		// a partial playlist would otherwise be served as if complete
+		resetDir(conv.OutputDir)
+	}
+
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+	conv.Converting = false
+	if conv.Error != nil {
+		conv.retainedDir = retainedDir
+		if ctx.Err() != nil {
+			// the request went away, that's not the video's fault
+			conv.interrupted = true
+			conv.Error = nil
+		} else {
+			conv.FailedAt = time.Now()
+		}
+	}
+	close(conv.done)
+}
+
+// failConversion records err as the result of the conversion claimed in
+// conv, with the output of ffmpeg if it ran. Requests read these while it
+// runs, so they are set under conv.mu.
+func (cm *ConversionManager) failConversion(conv *Conversion, err error, output []byte) error {
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+	conv.Error = err
+	if output != nil {
+		conv.FFmpegOutput = outputTail(output, ffmpegOutputTail)
+		if cm.config.FailedConversionRetention > 0 {
+			conv.ffmpegLog = string(output)
+		}
+	}
+	return err
+}
+
+// claimThumbnail is claimConversion for thumbnails.
+func (cm *ConversionManager) claimThumbnail(ctx context.Context, thumb *Thumbnail) (claimed bool, err error) {
+	thumb.mu.Lock()
+	for thumb.Generating {
+		// Generation already in progress, wait for it instead
+		done := thumb.done
+		thumb.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		thumb.mu.Lock()
+		if !thumb.Generating && !thumb.interrupted {
+			err := thumb.Error
+			thumb.mu.Unlock()
+			return false, err
+		}
+		// it was interrupted and we take over, unless another request
+		// already did
+	}
+	thumb.Generating = true
+	thumb.Error = nil
+	thumb.FFmpegOutput = ""
+	thumb.interrupted = false
+	thumb.done = make(chan struct{})
+	thumb.mu.Unlock()
+	return true, nil
+}
+
+// finishThumbnail is finishConversion for thumbnails.
+func (cm *ConversionManager) finishThumbnail(ctx context.Context, thumb *Thumbnail) {
+	thumb.mu.Lock()
+	failed := thumb.Error != nil
+	thumb.mu.Unlock()
+	if failed {
+		// don't serve what ffmpeg may have left behind
+		os.Remove(thumb.Path)
+	}
+
+	thumb.mu.Lock()
+	defer thumb.mu.Unlock()
+	thumb.Generating = false
+	if thumb.Error != nil {
+		if ctx.Err() != nil {
+			// the request went away, that's not the video's fault
+			thumb.interrupted = true
+			thumb.Error = nil
+		} else {
+			thumb.FailedAt = time.Now()
+		}
+	}
+	close(thumb.done)
+}
+
+// failThumbnail is failConversion for thumbnails.
+func (cm *ConversionManager) failThumbnail(thumb *Thumbnail, err error, output []byte) error {
+	thumb.mu.Lock()
+	defer thumb.mu.Unlock()
+	thumb.Error = err
+	if output != nil {
+		thumb.FFmpegOutput = outputTail(output, ffmpegOutputTail)
+	}
+	return err
+}
+
+// resetConversion throws away the output and error of conv, failing with
+// errInvalidateRunning if it is converting or queued. Like a conversion,
+// it keeps others off the output while removing it, and those waiting on
+// it convert again.
+func (cm *ConversionManager) resetConversion(conv *Conversion) error {
+	conv.mu.Lock()
+	if conv.Converting || conv.queued {
+		conv.mu.Unlock()
+		return errInvalidateRunning
+	}
+	conv.Converting = true
+	conv.Error = nil
+	conv.FFmpegOutput = ""
+	conv.FailedAt = time.Time{}
+	conv.done = make(chan struct{})
+	conv.mu.Unlock()
+
+	resetDir(conv.OutputDir)
+
+	conv.mu.Lock()
+	defer conv.mu.Unlock()
+	conv.Converting = false
+	conv.interrupted = true
+	close(conv.done)
+	return nil
+}
+
+// resetThumbnail is resetConversion for thumbnails.
+func (cm *ConversionManager) resetThumbnail(thumb *Thumbnail) error {
+	thumb.mu.Lock()
+	if thumb.Generating {
+		thumb.mu.Unlock()
+		return errInvalidateRunning
+	}
+	thumb.Generating = true
+	thumb.Error = nil
+	thumb.FFmpegOutput = ""
+	thumb.FailedAt = time.Time{}
+	thumb.done = make(chan struct{})
+	thumb.mu.Unlock()
+
+	os.Remove(thumb.Path)
+
+	thumb.mu.Lock()
+	defer thumb.mu.Unlock()
+	thumb.Generating = false
+	thumb.interrupted = true
+	close(thumb.done)
+	return nil
+}
+
+// openSource downloads the blob did/cid, or opens a stream of it with
+// STREAM_SOURCE, and probes it. cleanup removes the download or closes the
+// stream. Errors are *ConversionError.
+func (cm *ConversionManager) openSource(ctx context.Context, did, cid string) (source string, probeResult *ProbeResult, cleanup func(), err error) {
+	if cm.config.StreamSource {
+		source, cleanup, err = cm.openStream(ctx, did, cid)
+	} else {
+		source, err = cm.downloadSource(ctx, did, cid)
+		cleanup = func() { os.Remove(source) }
+	}
+	if err != nil {
+		convErr := downloadError(fmt.Errorf("failed to download blob: %w", err))
+		cm.report(ctx, convErr, map[string]string{"did": did, "cid": cid})
+		return "", nil, nil, convErr
+	}
+	log.Printf("Source of %s/%s at %s", did, cid, source)
+
+	// needed for the rotation of the video, HDR and audio renditions
+	probeResult, err = cm.probe(ctx, source)
+	if err != nil {
+		cleanup()
+		convErr := &ConversionError{Kind: KindProbeFailed, Err: err}
+		cm.report(ctx, convErr, map[string]string{"did": did, "cid": cid})
+		return "", nil, nil, convErr
+	}
+	// fail early instead of deep into the transcode
+	if err := probeResult.checkDecodable(); err != nil {
+		cleanup()
+		return "", nil, nil, &ConversionError{Kind: KindUnsupportedSource, Err: err}
+	}
+	return source, probeResult, cleanup, nil
+}
+
+// transcodeHLS runs ffmpeg converting source into conv.
+func (cm *ConversionManager) transcodeHLS(ctx context.Context, did, cid string, conv *Conversion, source string, probeResult *ProbeResult) error {
+	if err := cm.checkSegmentCount(did, cid, probeResult); err != nil {
+		return cm.failConversion(conv, err, nil)
+	}
+	conv.mu.Lock()
+	conv.segmentLength = cm.segmentLength(probeResult)
+	conv.mu.Unlock()
+	output, err := cm.runFFmpeg(ctx, cm.hlsArgs(source, conv.OutputDir, probeResult)...)
+	var dryRun *DryRunError
+	if errors.As(err, &dryRun) {
+		return err
+	}
+	if err != nil {
+		log.Printf("ffmpeg failed converting %s/%s: %s, output:\n%s", did, cid, err, output)
+		cm.report(ctx, fmt.Errorf("ffmpeg error: %w", err), map[string]string{
+			"did":           did,
+			"cid":           cid,
+			"ffmpeg_output": outputTail(output, ffmpegOutputTail),
+		})
+		return cm.failConversion(conv, &ConversionError{Kind: transcodeErrorKind(ctx), Err: fmt.Errorf("ffmpeg error: %v", err)}, output)
+	}
+	if cm.config.LowLatencyHLS {
+		if err := cm.finishLowLatency(conv); err != nil {
+			log.Printf("Failed to finish the playlist of %s/%s: %s", did, cid, err)
+			return cm.failConversion(conv, &ConversionError{Kind: transcodeErrorKind(ctx), Err: err}, nil)
+		}
+	}
+	if cm.config.VerifyOutputDuration {
+		if err := cm.verifyOutputDuration(ctx, conv.OutputDir, probeResult); err != nil {
+			log.Printf("Conversion of %s/%s failed verification: %s", did, cid, err)
+			cm.report(ctx, err, map[string]string{"did": did, "cid": cid})
+			return cm.failConversion(conv, &ConversionError{Kind: transcodeErrorKind(ctx), Err: err}, nil)
+		}
+	}
+	log.Printf("Converted %s to HLS", cid)
+	return nil
+}
+
+// renderThumbnail runs ffmpeg taking thumb out of source.
+func (cm *ConversionManager) renderThumbnail(ctx context.Context, did, cid string, thumb *Thumbnail, source string, probeResult *ProbeResult) error {
+	// posters can be anywhere in the video, check they aren't past its end
+	if thumb.At != thumbnailAt {
+		duration, ok := probeResult.duration()
+		if ok && thumb.At > duration {
+			return cm.failThumbnail(thumb, &ConversionError{
+				Kind: KindOutOfRange,
+				Err:  fmt.Errorf("%w: %.1fs is past the end of the video (%.1fs)", errTimestampOutOfRange, thumb.At, duration),
+			}, nil)
+		}
+	}
+
+	output, err := cm.runFFmpeg(ctx, cm.thumbnailArgs(source, thumb.Path, thumb.Format, thumb.At, thumb.Accurate, probeResult)...)
+	var dryRun *DryRunError
+	if errors.As(err, &dryRun) {
+		return err
+	}
+	if err != nil {
+		log.Printf("ffmpeg failed generating thumbnail of %s/%s: %s, output:\n%s", did, cid, err, output)
+		cm.report(ctx, fmt.Errorf("ffmpeg thumbnail error: %w", err), map[string]string{
+			"did":           did,
+			"cid":           cid,
+			"ffmpeg_output": outputTail(output, ffmpegOutputTail),
+		})
+		return cm.failThumbnail(thumb, &ConversionError{Kind: transcodeErrorKind(ctx), Err: fmt.Errorf("ffmpeg thumbnail error: %v", err)}, output)
+	}
+	return nil
+}
+
+// convertAll converts did/cid into conv and generates thumb at once, from
+// a single download of the source, or waits for them if they are already
+// running. Either may be nil to skip it. The conversion is required: when
+// it fails the thumbnail is cancelled and left to run again on the next
+// request, while a failed thumbnail doesn't stop the conversion. It
+// returns the error of the conversion, or of the thumbnail without one.
+func (cm *ConversionManager) convertAll(ctx context.Context, did, cid string, conv *Conversion, thumb *Thumbnail) error {
+	var convErr, thumbErr error
+	result := func() error {
+		if conv != nil {
+			return convErr
+		}
+		return thumbErr
+	}
+	runConv, runThumb := conv, thumb
+	if conv != nil {
+		if claimed, err := cm.claimConversion(ctx, conv); !claimed {
+			runConv, convErr = nil, err
+		}
+	}
+	if thumb != nil {
+		if claimed, err := cm.claimThumbnail(ctx, thumb); !claimed {
+			runThumb, thumbErr = nil, err
+		}
+	}
+	// done between our caller looking and claiming them, e.g. by a
+	// conversion we didn't have to wait for
+	if runConv != nil {
+		if _, err := os.Stat(filepath.Join(runConv.OutputDir, "playlist.m3u8")); err == nil {
+			cm.finishConversion(ctx, runConv)
+			runConv = nil
+		}
+	}
+	if runThumb != nil {
+		if _, err := os.Stat(runThumb.Path); err == nil {
+			cm.finishThumbnail(ctx, runThumb)
+			runThumb = nil
+		}
+	}
+	if runConv == nil && runThumb == nil {
+		return result()
+	}
+
+	source, probeResult, cleanup, err := cm.openSource(ctx, did, cid)
+	if err != nil {
+		if runConv != nil {
+			convErr = cm.failConversion(runConv, err, nil)
+			cm.finishConversion(ctx, runConv)
+		}
+		if runThumb != nil {
+			thumbErr = cm.failThumbnail(runThumb, err, nil)
+			cm.finishThumbnail(ctx, runThumb)
+		}
+		return result()
+	}
+	defer cleanup()
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	if runConv != nil {
+		group.Go(func() error {
+			return cm.transcodeHLS(groupCtx, did, cid, runConv, source, probeResult)
+		})
+	}
+	if runThumb != nil {
+		group.Go(func() error {
+			thumbErr = cm.renderThumbnail(groupCtx, did, cid, runThumb, source, probeResult)
+			return nil
+		})
+	}
+	if err := group.Wait(); runConv != nil {
+		convErr = err
+		cm.finishConversion(ctx, runConv)
+	}
+	if runThumb != nil {
+		// groupCtx is done now, finishing with it marks the thumbnail as
+		// interrupted, which is right if the conversion failing cancelled
+		// it
+		finishCtx := ctx
+		if convErr != nil {
+			finishCtx = groupCtx
+		}
+		cm.finishThumbnail(finishCtx, runThumb)
+	}
+	return result()
+}
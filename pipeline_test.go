@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingReporter keeps the errors reported to it.
+type recordingReporter struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (r *recordingReporter) Report(err error, fields map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+func (r *recordingReporter) Flush(timeout time.Duration) {}
+
+func (r *recordingReporter) reported() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.errs)
+}
+
+func TestCancelledConversion(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	s, _ := newTestState(t, config, &fakeRunner{err: errors.New("signal: killed")})
+	reporter := &recordingReporter{}
+	s.cm.reporter = reporter
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv, release, err := s.cm.getOrCreateConversion(did, blobCID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.cm.convertToHLS(ctx, did, blobCID.String(), conv); err == nil {
+		t.Fatal("expected the conversion to fail")
+	}
+	if reporter.reported() != 0 {
+		t.Errorf("expected a client going away not to be reported, got %v", reporter.errs)
+	}
+	conv.mu.Lock()
+	convErr, failedAt, interrupted := conv.Error, conv.FailedAt, conv.interrupted
+	conv.mu.Unlock()
+	if convErr != nil || !failedAt.IsZero() || !interrupted {
+		t.Errorf("expected the conversion to be left for the next request, got %v", convErr)
+	}
+
+	// failing on its own is reported
+	err = s.cm.convertToHLS(context.Background(), did, blobCID.String(), conv)
+	if err == nil || reporter.reported() != 1 {
+		t.Errorf("expected the failure to be reported, got %v after %d reports", err, reporter.reported())
+	}
+}
+
+// blockingRunner is a fakeRunner whose first ffmpeg run waits for
+// release, like a long transcode.
+type blockingRunner struct {
+	*fakeRunner
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingRunner) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	first := false
+	b.once.Do(func() { first = true })
+	if first {
+		close(b.started)
+		<-b.release
+	}
+	return b.fakeRunner.CombinedOutput(ctx, name, args...)
+}
+
+func TestIndependentConversions(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	runner := &blockingRunner{fakeRunner: &fakeRunner{}, started: make(chan struct{}), release: make(chan struct{})}
+	s, _ := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	slow, err := s.cm.storeLocalBlob(did, []byte("a slow video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := s.cm.storeLocalBlob(did, []byte("a fast video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slowConv, slowRelease, err := s.cm.getOrCreateConversion(did, slow.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowRelease()
+	slowDone := make(chan error, 1)
+	go func() { slowDone <- s.cm.convertToHLS(context.Background(), did, slow.String(), slowConv) }()
+	<-runner.started
+
+	// neither looking up the slow video nor converting another one waits
+	// on the slow conversion
+	fastDone := make(chan error, 1)
+	go func() {
+		if _, release, ok := s.cm.lookupConversion(did, slow.String()); ok {
+			release()
+		}
+		conv, release, err := s.cm.getOrCreateConversion(did, fast.String())
+		if err != nil {
+			fastDone <- err
+			return
+		}
+		defer release()
+		fastDone <- s.cm.convertToHLS(context.Background(), did, fast.String(), conv)
+	}()
+	select {
+	case err := <-fastDone:
+		if err != nil {
+			t.Errorf("converting another video: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("converting another video waited on the slow conversion")
+	}
+
+	close(runner.release)
+	if err := <-slowDone; err != nil {
+		t.Errorf("slow conversion: %v", err)
+	}
+}
+
+// outputProbeRunner is a fakeRunner whose ffprobe reports a duration of
+// its own for the playlists ffmpeg wrote.
+type outputProbeRunner struct {
+	*fakeRunner
+	outputDuration string
+}
+
+func (o *outputProbeRunner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	if name == "ffprobe" && strings.HasSuffix(args[len(args)-1], ".m3u8") {
+		o.record(name, args)
+		return []byte(fmt.Sprintf(`{"streams": [], "format": {"format_name": "hls", "duration": %q}}`, o.outputDuration)), nil
+	}
+	return o.fakeRunner.Output(ctx, name, args...)
+}
+
+// TestFailedConversionState reads the state of failing conversions while
+// they run, as requests do, which the race detector checks.
+func TestFailedConversionState(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	config.FailedConversionRetention = time.Hour
+	s, _ := newTestState(t, config, &fakeRunner{err: errors.New("exit status 1"), delay: 10 * time.Millisecond})
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a broken video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv, release, err := s.cm.getOrCreateConversion(did, blobCID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	thumb, err := s.cm.getOrCreateThumbnail(did, blobCID.String(), thumbnailJPEG, thumbnailAt, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.cm.convertAll(context.Background(), did, blobCID.String(), conv, thumb) }()
+	for {
+		conv.mu.Lock()
+		_, _ = conv.Error, conv.FFmpegOutput
+		conv.mu.Unlock()
+		thumb.mu.Lock()
+		_, _ = thumb.Error, thumb.FFmpegOutput
+		thumb.mu.Unlock()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("expected the conversion to fail")
+			}
+			conv.mu.Lock()
+			defer conv.mu.Unlock()
+			if conv.Error == nil || conv.FFmpegOutput != "fake ffmpeg failed" || conv.retainedDir == "" {
+				t.Errorf("got error %v, output %q, retained in %q", conv.Error, conv.FFmpegOutput, conv.retainedDir)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestVerifyOutputDuration(t *testing.T) {
+	for outputDuration, ok := range map[string]bool{"25.000000": true, "24.400000": true, "12.000000": false, "": false} {
+		config := testConfig(t)
+		config.UploadMode = "local"
+		config.VerifyOutputDuration = true
+		config.OutputDurationTolerance = time.Second
+		s, r := newTestState(t, config, &outputProbeRunner{fakeRunner: &fakeRunner{}, outputDuration: outputDuration})
+		const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+		blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conv, release, err := s.cm.getOrCreateConversion(did, blobCID.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+
+		err = s.cm.convertToHLS(context.Background(), did, blobCID.String(), conv)
+		if ok && err != nil {
+			t.Errorf("output of %q seconds: %v", outputDuration, err)
+		}
+		if !ok {
+			conv.mu.Lock()
+			convErr := conv.Error
+			conv.mu.Unlock()
+			if !errors.Is(err, errOutputDuration) || !errors.Is(convErr, errOutputDuration) {
+				t.Errorf("output of %q seconds: expected the conversion to fail verification, got %v", outputDuration, err)
+			}
+			if w := get(r, "GET", fmt.Sprintf("/watch/%s/%s/playlist.m3u8", did, blobCID)); w.Code == http.StatusOK {
+				t.Errorf("output of %q seconds: expected the playlist not to be served", outputDuration)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PrepareStatus is what a prepare request did for a video.
+type PrepareStatus string
+
+const (
+	// the conversion is already done
+	PrepareReady PrepareStatus = "ready"
+	// the conversion is already running or waiting for a slot
+	PrepareInProgress PrepareStatus = "inProgress"
+	// the conversion was queued by this request
+	PrepareQueued PrepareStatus = "queued"
+	// the conversion recently failed and won't be retried yet
+	PrepareFailed PrepareStatus = "failed"
+)
+
+// most videos accepted by a single batch prepare request
+const maxPrepareBatch = 50
+
+// a batch of maxPrepareBatch is far smaller than this
+const maxPrepareBodyBytes = 1 << 20
+
+// prepare queues the conversion and thumbnail of a video in the
+// background, so that they are ready once the video is watched. At most
+// PrepareConcurrency prepared conversions run at once. When the
+// conversion recently failed, retryAfter is how long until it's retried.
+func (s *State) prepare(did, cid string, format ThumbnailFormat) (status PrepareStatus, retryAfter time.Duration, err error) {
+	thumb, err := s.cm.getOrCreateThumbnail(did, cid, format, thumbnailAt, s.config.ThumbnailSeek == "accurate")
+	if err != nil {
+		return "", 0, err
+	}
+	conv, release, err := s.cm.getOrCreateConversion(did, cid)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// the queued conversion looks again, being off here only changes the
+	// status answered
+	_, playlistErr := os.Stat(filepath.Join(conv.OutputDir, "playlist.m3u8"))
+	_, thumbErr := os.Stat(thumb.Path)
+	thumb.mu.Lock()
+	thumbMissing := thumbErr != nil && !thumb.Generating
+	thumb.mu.Unlock()
+
+	conv.mu.Lock()
+	convErr, wait := conv.Error, s.cm.retryAfter(conv.FailedAt)
+	inProgress := conv.Converting || conv.queued
+	if convErr != nil && wait > 0 {
+		conv.mu.Unlock()
+		release()
+		return PrepareFailed, wait, nil
+	}
+	if inProgress {
+		conv.mu.Unlock()
+		release()
+		return PrepareInProgress, 0, nil
+	}
+	// a video is only ready with its thumbnail, which may have been
+	// evicted since
+	if playlistErr == nil && !thumbMissing {
+		conv.mu.Unlock()
+		release()
+		return PrepareReady, 0, nil
+	}
+	conv.queued = true
+	conv.mu.Unlock()
+
+	go func() {
+		defer release()
+		s.cm.prepareSlots <- struct{}{}
+		defer func() { <-s.cm.prepareSlots }()
+
+		conv.mu.Lock()
+		conv.queued = false
+		conv.mu.Unlock()
+		// a watch request may have converted it while we were queued,
+		// and both join what is already running instead of starting
+		// another
+		pendingConv, pendingThumb := conv, thumb
+		if _, err := os.Stat(filepath.Join(conv.OutputDir, "playlist.m3u8")); err == nil {
+			pendingConv = nil
+		}
+		if _, err := os.Stat(thumb.Path); err == nil {
+			pendingThumb = nil
+		}
+		s.cm.convertAll(context.Background(), did, cid, pendingConv, pendingThumb)
+	}()
+	return PrepareQueued, 0, nil
+}
+
+// prepareVideo prepares a single video.
+func (s *State) prepareVideo(c *gin.Context) {
+	did := c.Param("did")
+	cid := c.Param("cid")
+	if len(s.allowedDIDs) > 0 && !slices.Contains(s.allowedDIDs, did) {
+		c.AbortWithError(http.StatusForbidden, fmt.Errorf("DID not allowed"))
+		return
+	}
+	refresh, ok := s.refreshRequested(c)
+	if !ok || (refresh && !s.refresh(c, did, cid)) {
+		return
+	}
+
+	status, wait, err := s.prepare(did, cid, s.cm.thumbnailFormat(c))
+	if errors.Is(err, errDiskFull) {
+		c.Header("Retry-After", fmt.Sprintf("%.0f", diskUsageInterval.Seconds()))
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if status == PrepareFailed {
+		c.Header("Retry-After", fmt.Sprintf("%.0f", math.Ceil(wait.Seconds())))
+		c.AbortWithError(http.StatusServiceUnavailable, errors.New("conversion recently failed"))
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": status})
+}
+
+type PrepareItem struct {
+	DID string `json:"did"`
+	CID string `json:"cid"`
+}
+
+type PrepareResult struct {
+	PrepareItem
+	Status PrepareStatus `json:"status,omitempty"`
+	// seconds until a failed conversion is retried
+	RetryAfter int64  `json:"retryAfter,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// prepareVideos prepares a batch of videos, e.g. the visible posts of a
+// feed, reporting what happened to each of them.
+func (s *State) prepareVideos(c *gin.Context) {
+	var items []PrepareItem
+	if err := c.ShouldBindJSON(&items); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("expected a list of {did, cid}: %w", err))
+		return
+	}
+	if len(items) > maxPrepareBatch {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("at most %d videos can be prepared at once", maxPrepareBatch))
+		return
+	}
+	refresh, ok := s.refreshRequested(c)
+	if !ok {
+		return
+	}
+
+	format := s.cm.thumbnailFormat(c)
+	results := make([]PrepareResult, 0, len(items))
+	for _, item := range items {
+		result := PrepareResult{PrepareItem: item}
+		switch {
+		case item.DID == "" || item.CID == "":
+			result.Error = "did and cid are required"
+		case len(s.allowedDIDs) > 0 && !slices.Contains(s.allowedDIDs, item.DID):
+			result.Error = "DID not allowed"
+		default:
+			if refresh {
+				if err := s.cm.invalidate(item.DID, item.CID); err != nil {
+					result.Error = err.Error()
+					break
+				}
+			}
+			status, wait, err := s.prepare(item.DID, item.CID, format)
+			if err != nil {
+				result.Error = err.Error()
+				break
+			}
+			result.Status = status
+			result.RetryAfter = int64(math.Ceil(wait.Seconds()))
+		}
+		results = append(results, result)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"results": results})
+}
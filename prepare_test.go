@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPrepareWarmsThumbnail(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	runner := &fakeRunner{}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := blobCID.String()
+	format := thumbnailJPEG
+
+	if w := get(r, "GET", fmt.Sprintf("/watch/%s/%s/playlist.m3u8", did, cid)); w.Code != http.StatusOK {
+		t.Fatalf("playlist: got %d", w.Code)
+	}
+	if status, _, err := s.prepare(did, cid, format); err != nil || status != PrepareReady {
+		t.Fatalf("prepare after watching: got %s, %v", status, err)
+	}
+	// the thumbnail is evicted, but not the conversion
+	thumb, ok := s.cm.lookupThumbnail(did, cid, format, thumbnailAt, false)
+	if !ok {
+		t.Fatal("expected watching to generate the thumbnail")
+	}
+	if err := os.Remove(thumb.Path); err != nil {
+		t.Fatal(err)
+	}
+	status, _, err := s.prepare(did, cid, format)
+	if err != nil || status != PrepareQueued {
+		t.Fatalf("prepare without a thumbnail: got %s, %v", status, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status, _, err = s.prepare(did, cid, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == PrepareReady {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the video to become ready, got %s", status)
+		}
+	}
+	if _, err := os.Stat(thumb.Path); err != nil {
+		t.Errorf("expected the thumbnail to be generated: %s", err)
+	}
+	if runner.runs("ffmpeg") != 3 {
+		t.Errorf("expected the conversion not to run again, ffmpeg ran %d times", runner.runs("ffmpeg"))
+	}
+}
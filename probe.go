@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+)
+
+// ProbeResult is the subset of `ffprobe -show_streams -show_format` we use.
+type ProbeResult struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  ProbeFormat   `json:"format"`
+}
+
+type ProbeStream struct {
+	Index     int    `json:"index"`
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	// e.g. encv or enca for encrypted (CENC) streams
+	CodecTagString string `json:"codec_tag_string"`
+	PixFmt         string `json:"pix_fmt"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	ColorTransfer  string `json:"color_transfer"`
+	ColorPrimaries string `json:"color_primaries"`
+	// e.g. language, as ISO 639-2 codes
+	Tags map[string]string `json:"tags"`
+	// carries the display matrix of rotated (e.g. phone) videos
+	SideDataList []ProbeSideData `json:"side_data_list"`
+}
+
+type ProbeSideData struct {
+	SideDataType string `json:"side_data_type"`
+	// counterclockwise, in degrees
+	Rotation float64 `json:"rotation"`
+}
+
+var (
+	errEncryptedSource   = errors.New("unsupported source: the video is encrypted")
+	errNoDecodableStream = errors.New("unsupported source: no decodable audio or video stream")
+)
+
+// encrypted reports whether the stream is encrypted, e.g. DRM protected.
+func (s ProbeStream) encrypted() bool {
+	if s.CodecTagString == "encv" || s.CodecTagString == "enca" {
+		return true
+	}
+	for _, sideData := range s.SideDataList {
+		if sideData.SideDataType == "Encryption Initialization Info" || sideData.SideDataType == "Encryption info" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDecodable fails for sources ffmpeg can't convert: encrypted ones,
+// and ones without any audio or video stream it has a decoder for.
+func (p *ProbeResult) checkDecodable() error {
+	decodable := false
+	for _, stream := range p.Streams {
+		if stream.CodecType != "video" && stream.CodecType != "audio" {
+			continue
+		}
+		if stream.encrypted() {
+			return errEncryptedSource
+		}
+		if stream.CodecName != "" && stream.CodecName != "none" {
+			decodable = true
+		}
+	}
+	if !decodable {
+		return errNoDecodableStream
+	}
+	return nil
+}
+
+type ProbeFormat struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+}
+
+func (cm *ConversionManager) probe(ctx context.Context, input string) (*ProbeResult, error) {
+	args := []string{
+		"-v", "error",
+		"-show_streams",
+		"-show_format",
+		"-of", "json",
+	}
+	output, err := cm.runner.Output(ctx, "ffprobe", append(args, cm.inputArgs(input)...)...)
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe error: %w", err)
+	}
+	var result ProbeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return &result, nil
+}
+
+// duration returns the duration of the video in seconds, if known.
+func (p *ProbeResult) duration() (float64, bool) {
+	duration, err := strconv.ParseFloat(p.Format.Duration, 64)
+	return duration, err == nil
+}
+
+var errOutputDuration = errors.New("output duration doesn't match the source")
+
+// verifyOutputDuration probes the playlist of a finished conversion and
+// checks that its duration is the source's, within
+// OUTPUT_DURATION_TOLERANCE, to catch encodes ffmpeg cut short but still
+// exited 0 on. Sources of unknown duration aren't checked.
+func (cm *ConversionManager) verifyOutputDuration(ctx context.Context, outputDir string, source *ProbeResult) error {
+	expected, ok := source.duration()
+	if !ok {
+		return nil
+	}
+	output, err := cm.probe(ctx, filepath.Join(outputDir, "playlist.m3u8"))
+	if err != nil {
+		return fmt.Errorf("failed to probe output: %w", err)
+	}
+	actual, ok := output.duration()
+	if !ok {
+		return fmt.Errorf("%w: output has no duration", errOutputDuration)
+	}
+	if math.Abs(actual-expected) > cm.config.OutputDurationTolerance.Seconds() {
+		return fmt.Errorf("%w: output is %.2fs long, the source %.2fs", errOutputDuration, actual, expected)
+	}
+	return nil
+}
+
+// videoStream returns the first video stream, if any.
+func (p *ProbeResult) videoStream() (ProbeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "video" {
+			return stream, true
+		}
+	}
+	return ProbeStream{}, false
+}
+
+// audioStreams returns the audio streams, in order.
+func (p *ProbeResult) audioStreams() []ProbeStream {
+	streams := make([]ProbeStream, 0)
+	for _, stream := range p.Streams {
+		if stream.CodecType == "audio" {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// displayHeight returns the height of the video once upright, 0 if
+// unknown.
+func (p *ProbeResult) displayHeight() int {
+	stream, ok := p.videoStream()
+	if !ok {
+		return 0
+	}
+	if rotation := p.rotation(); rotation == 90 || rotation == 270 {
+		return stream.Width
+	}
+	return stream.Height
+}
+
+// isHDR reports whether the video uses an HDR transfer function
+// (PQ or HLG).
+func (p *ProbeResult) isHDR() bool {
+	stream, ok := p.videoStream()
+	if !ok {
+		return false
+	}
+	return stream.ColorTransfer == "smpte2084" || stream.ColorTransfer == "arib-std-b67"
+}
+
+// rotation returns how many degrees the video must be turned clockwise to
+// be displayed upright: 0, 90, 180 or 270.
+func (p *ProbeResult) rotation() int {
+	stream, ok := p.videoStream()
+	if !ok {
+		return 0
+	}
+	var degrees float64
+	// older ffprobe versions report a clockwise rotate tag
+	if rotate, ok := stream.Tags["rotate"]; ok {
+		degrees, _ = strconv.ParseFloat(rotate, 64)
+	}
+	for _, sideData := range stream.SideDataList {
+		if sideData.SideDataType == "Display Matrix" {
+			degrees = -sideData.Rotation
+		}
+	}
+	quarters := int(math.Round(degrees / 90))
+	return (quarters%4 + 4) % 4 * 90
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+var errQueueFull = errors.New("too many uploads are queued, try again later")
+
+// uploadQueueRetryAfter is the Retry-After of uploads rejected because the
+// queue is full.
+const uploadQueueRetryAfter = 30 * time.Second
+
+// JobQueue runs upload jobs on UPLOAD_CONCURRENCY workers in the order
+// they were queued, keeping at most UPLOAD_QUEUE_SIZE of them waiting.
+// Positions are local to this instance, like the upload bodies spooled to
+// its disk while jobs wait.
+type JobQueue struct {
+	// guards the fields below
+	mu       sync.Mutex
+	ready    *sync.Cond
+	waiting  []queuedJob
+	capacity int
+}
+
+type queuedJob struct {
+	id  string
+	run func()
+}
+
+func NewJobQueue(workers, capacity int) *JobQueue {
+	q := &JobQueue{capacity: capacity}
+	q.ready = sync.NewCond(&q.mu)
+	for range max(workers, 1) {
+		go q.worker()
+	}
+	return q
+}
+
+func (q *JobQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.waiting) == 0 {
+			q.ready.Wait()
+		}
+		job := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.mu.Unlock()
+		q.run(job)
+	}
+}
+
+// run runs job, recovering from a panic so that the worker survives it.
+func (q *JobQueue) run(job queuedJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Queued job %s panicked: %v\n%s", job.id, r, debug.Stack())
+		}
+	}()
+	job.run()
+}
+
+// full reports whether enqueue would fail right now.
+func (q *JobQueue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting) >= q.capacity
+}
+
+// enqueue queues run as the job id, failing with errQueueFull if the
+// queue is full.
+func (q *JobQueue) enqueue(id string, run func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) >= q.capacity {
+		return errQueueFull
+	}
+	q.waiting = append(q.waiting, queuedJob{id: id, run: run})
+	q.ready.Signal()
+	return nil
+}
+
+// position returns where the job id is in the queue, starting at 1 for
+// the next job to run, or false if it isn't waiting here.
+func (q *JobQueue) position(id string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.IndexFunc(q.waiting, func(job queuedJob) bool { return job.id == id })
+	return i + 1, i >= 0
+}
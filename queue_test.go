@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobQueue(t *testing.T) {
+	q := NewJobQueue(1, 2)
+	started, unblock := make(chan struct{}), make(chan struct{})
+	if err := q.enqueue("running", func() { close(started); <-unblock }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	ran := make(chan string, 2)
+	for _, id := range []string{"a", "b"} {
+		if err := q.enqueue(id, func() { ran <- id }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if position, ok := q.position("b"); !ok || position != 2 {
+		t.Fatalf("position of b: got %d %v", position, ok)
+	}
+	if _, ok := q.position("running"); ok {
+		t.Errorf("expected the running job to have no position")
+	}
+	if !q.full() || q.enqueue("c", func() {}) != errQueueFull {
+		t.Fatal("expected a full queue to reject jobs")
+	}
+	close(unblock)
+	if first, second := <-ran, <-ran; first != "a" || second != "b" {
+		t.Errorf("expected jobs to run in order, got %s, %s", first, second)
+	}
+}
+
+func TestJobQueuePanic(t *testing.T) {
+	q := NewJobQueue(1, 2)
+	if err := q.enqueue("panics", func() { panic("bad job") }); err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan struct{})
+	if err := q.enqueue("next", func() { close(ran) }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the worker to survive a panicking job")
+	}
+}
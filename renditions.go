@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// VideoRendition is a variant of the ABR ladder of RENDITIONS_FILE.
+type VideoRendition struct {
+	// used in the names of its playlist and segments
+	Name      string `json:"name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	VideoKbps int    `json:"videoKbps"`
+	AudioKbps int    `json:"audioKbps"`
+	// rate control, 0 for VideoKbps and twice VideoKbps respectively
+	MaxrateKbps int `json:"maxrateKbps"`
+	BufsizeKbps int `json:"bufsizeKbps"`
+}
+
+var renditionName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// defaultRenditions is the ladder used without RENDITIONS_FILE, the same
+// as renditions.example.json.
+var defaultRenditions = []VideoRendition{
+	{Name: "360p", Width: 640, Height: 360, VideoKbps: 800, AudioKbps: 96, MaxrateKbps: 856, BufsizeKbps: 1200},
+	{Name: "480p", Width: 854, Height: 480, VideoKbps: 1400, AudioKbps: 128, MaxrateKbps: 1498, BufsizeKbps: 2100},
+	{Name: "720p", Width: 1280, Height: 720, VideoKbps: 2800, AudioKbps: 128, MaxrateKbps: 2996, BufsizeKbps: 4200},
+	{Name: "1080p", Width: 1920, Height: 1080, VideoKbps: 5000, AudioKbps: 192, MaxrateKbps: 5350, BufsizeKbps: 7500},
+}
+
+// noRenditions is the RENDITIONS_FILE encoding a single rendition instead
+// of a ladder.
+const noRenditions = "none"
+
+// loadRenditions reads the ABR ladder of RENDITIONS_FILE, a JSON array of
+// renditions. An empty path is defaultRenditions, noRenditions no ladder.
+func loadRenditions(path string) ([]VideoRendition, error) {
+	switch path {
+	case "":
+		return defaultRenditions, nil
+	case noRenditions:
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RENDITIONS_FILE: %w", err)
+	}
+	var renditions []VideoRendition
+	if err := json.Unmarshal(data, &renditions); err != nil {
+		return nil, fmt.Errorf("failed to parse RENDITIONS_FILE: %w", err)
+	}
+	if len(renditions) == 0 {
+		return nil, fmt.Errorf("RENDITIONS_FILE %s has no renditions", path)
+	}
+	if err := validateRenditions(renditions); err != nil {
+		return nil, err
+	}
+	return renditions, nil
+}
+
+// validateRenditions checks that renditions can be encoded and told apart.
+func validateRenditions(renditions []VideoRendition) error {
+	names := make(map[string]bool)
+	for _, rendition := range renditions {
+		if !renditionName.MatchString(rendition.Name) || names[rendition.Name] {
+			return fmt.Errorf("rendition names must be unique and made of letters, digits, _ and -, got %q", rendition.Name)
+		}
+		names[rendition.Name] = true
+		if _, _, err := parseSize(fmt.Sprintf("%dx%d", rendition.Width, rendition.Height)); err != nil {
+			return fmt.Errorf("rendition %s: %w", rendition.Name, err)
+		}
+		if rendition.VideoKbps <= 0 || rendition.AudioKbps <= 0 {
+			return fmt.Errorf("rendition %s: videoKbps and audioKbps must be positive", rendition.Name)
+		}
+		if rendition.MaxrateKbps < 0 || rendition.BufsizeKbps < 0 {
+			return fmt.Errorf("rendition %s: maxrateKbps and bufsizeKbps can't be negative", rendition.Name)
+		}
+		if rendition.MaxrateKbps > 0 && rendition.MaxrateKbps < rendition.VideoKbps {
+			return fmt.Errorf("rendition %s: maxrateKbps must be at least videoKbps", rendition.Name)
+		}
+	}
+	return nil
+}
+
+// sourceRenditions returns the renditions worth encoding the video of
+// probe to: those no taller than it, as upscaling only costs bandwidth. The
+// lowest rendition is always kept, so that there is something to play.
+func (cm *ConversionManager) sourceRenditions(probe *ProbeResult) []VideoRendition {
+	if probe == nil || probe.displayHeight() == 0 {
+		return cm.config.Renditions
+	}
+	height := probe.displayHeight()
+	lowest := 0
+	for i, rendition := range cm.config.Renditions {
+		if rendition.Height < cm.config.Renditions[lowest].Height {
+			lowest = i
+		}
+	}
+	renditions := make([]VideoRendition, 0, len(cm.config.Renditions))
+	for i, rendition := range cm.config.Renditions {
+		if rendition.Height <= height || i == lowest {
+			renditions = append(renditions, rendition)
+		}
+	}
+	return renditions
+}
+
+// ladderArgs encodes the video of input once per rendition, each a variant
+// of the master playlist.m3u8 with its own media playlist,
+// stream_<name>.m3u8. filters run before the video is split and scaled.
+// Renditions taller than the source are skipped, see sourceRenditions.
+func (cm *ConversionManager) ladderArgs(outputDir string, filters []string, probe *ProbeResult) []string {
+	renditions := cm.sourceRenditions(probe)
+	hasAudio := probe != nil && len(probe.audioStreams()) > 0
+
+	graph := make([]string, 0, len(renditions)+3)
+	split := "[0:v:0]"
+	if cm.config.Watermark != "" {
+		// overlaid before the split, so that it scales with each rendition
+		graph = append(graph, cm.watermarkSource())
+		if len(filters) > 0 {
+			graph = append(graph, split+strings.Join(filters, ",")+"[base]")
+			split = "[base]"
+		}
+		split += "[wm]" + cm.watermarkOverlay() + ","
+	} else if len(filters) > 0 {
+		split += strings.Join(filters, ",") + ","
+	}
+	split += "split=" + strconv.Itoa(len(renditions))
+	for i := range renditions {
+		split += fmt.Sprintf("[v%d]", i)
+	}
+	graph = append(graph, split)
+	for i, rendition := range renditions {
+		scale := scaleFilter(cm.config.ScaleMode, fmt.Sprintf("%dx%d", rendition.Width, rendition.Height))
+		if cm.config.ForceYUV420P {
+			scale += ",format=yuv420p"
+		}
+		graph = append(graph, fmt.Sprintf("[v%d]%s[out%d]", i, scale, i))
+	}
+
+	args := []string{"-filter_complex", strings.Join(graph, ";")}
+	streamMap := make([]string, 0, len(renditions))
+	for i, rendition := range renditions {
+		maxrate := rendition.MaxrateKbps
+		if maxrate == 0 {
+			maxrate = rendition.VideoKbps
+		}
+		bufsize := rendition.BufsizeKbps
+		if bufsize == 0 {
+			bufsize = 2 * rendition.VideoKbps
+		}
+		args = append(args,
+			"-map", fmt.Sprintf("[out%d]", i),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", rendition.VideoKbps),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", maxrate),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", bufsize),
+		)
+		entry := fmt.Sprintf("v:%d,name:%s", i, rendition.Name)
+		if hasAudio {
+			args = append(args,
+				"-map", "0:a:0",
+				fmt.Sprintf("-b:a:%d", i), fmt.Sprintf("%dk", rendition.AudioKbps),
+			)
+			entry = fmt.Sprintf("v:%d,a:%d,name:%s", i, i, rendition.Name)
+		}
+		streamMap = append(streamMap, entry)
+	}
+	if hasAudio {
+		args = append(args, "-c:a", "aac")
+	}
+	return append(args,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		"-master_pl_name", "playlist.m3u8",
+		"-hls_segment_filename", filepath.Join(outputDir, "stream_%v_"+cm.segmentFilename()),
+		filepath.Join(outputDir, "stream_%v.m3u8"),
+	)
+}
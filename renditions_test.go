@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadRenditions(t *testing.T) {
+	renditions, err := loadRenditions("")
+	if err != nil || !slices.Equal(renditions, defaultRenditions) {
+		t.Fatalf("expected the default ladder, got %v, %v", renditions, err)
+	}
+	if err := validateRenditions(defaultRenditions); err != nil {
+		t.Errorf("invalid default ladder: %s", err)
+	}
+	if renditions, err := loadRenditions(noRenditions); err != nil || renditions != nil {
+		t.Errorf("expected no ladder, got %v, %v", renditions, err)
+	}
+	example, err := loadRenditions("renditions.example.json")
+	if err != nil || !slices.Equal(example, defaultRenditions) {
+		t.Errorf("expected renditions.example.json to be the default ladder, got %v, %v", example, err)
+	}
+
+	invalid := map[string]string{
+		"empty":        `[]`,
+		"duplicate":    `[{"name": "a", "width": 640, "height": 360, "videoKbps": 800, "audioKbps": 96}, {"name": "a", "width": 640, "height": 360, "videoKbps": 800, "audioKbps": 96}]`,
+		"name":         `[{"name": "../a", "width": 640, "height": 360, "videoKbps": 800, "audioKbps": 96}]`,
+		"bitrate":      `[{"name": "a", "width": 640, "height": 360, "videoKbps": 0, "audioKbps": 96}]`,
+		"maxrate":      `[{"name": "a", "width": 640, "height": 360, "videoKbps": 800, "audioKbps": 96, "maxrateKbps": 400}]`,
+		"size":         `[{"name": "a", "width": 0, "height": 360, "videoKbps": 800, "audioKbps": 96}]`,
+		"not an array": `{}`,
+	}
+	for name, data := range invalid {
+		path := filepath.Join(t.TempDir(), "renditions.json")
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadRenditions(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSourceRenditions(t *testing.T) {
+	config := testConfig(t)
+	config.Renditions = defaultRenditions
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+
+	video := func(width, height int, sideData ...ProbeSideData) *ProbeResult {
+		return &ProbeResult{Streams: []ProbeStream{{CodecType: "video", Width: width, Height: height, SideDataList: sideData}}}
+	}
+	portrait := ProbeSideData{SideDataType: "Display Matrix", Rotation: -90}
+	for _, tc := range []struct {
+		name  string
+		probe *ProbeResult
+		want  []string
+	}{
+		{"1080p", video(1920, 1080), []string{"360p", "480p", "720p", "1080p"}},
+		{"above 1080p", video(3840, 2160), []string{"360p", "480p", "720p", "1080p"}},
+		{"between rungs", video(1000, 600), []string{"360p", "480p"}},
+		{"below the lowest rung", video(320, 180), []string{"360p"}},
+		{"rotated", video(1920, 540, portrait), []string{"360p", "480p", "720p", "1080p"}},
+		{"unknown size", video(0, 0), []string{"360p", "480p", "720p", "1080p"}},
+		{"no probe", nil, []string{"360p", "480p", "720p", "1080p"}},
+	} {
+		var names []string
+		for _, rendition := range cm.sourceRenditions(tc.probe) {
+			names = append(names, rendition.Name)
+		}
+		if !slices.Equal(names, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, names)
+		}
+	}
+
+	// only the renditions kept are encoded
+	streamMap := argAfter(cm.ladderArgs(t.TempDir(), nil, video(1280, 720)), "-var_stream_map")
+	if streamMap != "v:0,name:360p v:1,name:480p v:2,name:720p" {
+		t.Errorf("got -var_stream_map %q", streamMap)
+	}
+	if graph := argAfter(cm.ladderArgs(t.TempDir(), nil, video(1280, 720)), "-filter_complex"); !strings.Contains(graph, "split=3[v0][v1][v2];") {
+		t.Errorf("got -filter_complex %q", graph)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorReporter sends errors to an external error tracking service.
+// fields carries context such as the did, cid or job id.
+type ErrorReporter interface {
+	Report(err error, fields map[string]string)
+	Flush(timeout time.Duration)
+}
+
+// newErrorReporter returns a Sentry backed reporter if a DSN is configured,
+// and a reporter that does nothing otherwise.
+func newErrorReporter(sentryDSN string) (ErrorReporter, error) {
+	if sentryDSN == "" {
+		return noopReporter{}, nil
+	}
+	err := sentry.Init(sentry.ClientOptions{Dsn: sentryDSN})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init sentry: %w", err)
+	}
+	return sentryReporter{}, nil
+}
+
+// report reports err of work running under ctx, unless ctx was cancelled,
+// e.g. by the client going away, which isn't the video's fault.
+func (cm *ConversionManager) report(ctx context.Context, err error, fields map[string]string) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	cm.reporter.Report(err, fields)
+}
+
+type noopReporter struct{}
+
+func (noopReporter) Report(err error, fields map[string]string) {}
+func (noopReporter) Flush(timeout time.Duration)                {}
+
+type sentryReporter struct{}
+
+func (sentryReporter) Report(err error, fields map[string]string) {
+	sentry.WithScope(func(scope *sentry.Scope) {
+		for k, v := range fields {
+			scope.SetExtra(k, v)
+		}
+		sentry.CaptureException(err)
+	})
+}
+
+func (sentryReporter) Flush(timeout time.Duration) {
+	sentry.Flush(timeout)
+}
+
+// recoverAndReport replaces gin.Recovery, reporting handler panics before
+// answering with a 500.
+func recoverAndReport(reporter ErrorReporter) gin.HandlerFunc {
+	return gin.CustomRecovery(func(c *gin.Context, recovered any) {
+		reporter.Report(fmt.Errorf("panic: %v", recovered), map[string]string{
+			"method": c.Request.Method,
+			"path":   c.Request.URL.Path,
+		})
+		c.AbortWithStatus(500)
+	})
+}
+
+// how much of the ffmpeg output is kept when it fails
+const ffmpegOutputTail = 2048
+
+// outputTail returns at most the last n bytes of a command's output, which
+// is where ffmpeg puts the reason it failed.
+func outputTail(output []byte, n int) string {
+	if len(output) <= n {
+		return string(output)
+	}
+	return string(output[len(output)-n:])
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// Resolver finds the PDS hosting a DID.
+type Resolver interface {
+	ResolvePDS(ctx context.Context, did string) (string, error)
+}
+
+// flushableResolver is a Resolver with a cache that can be emptied.
+type flushableResolver interface {
+	Resolver
+	Flush()
+}
+
+// identityResolver resolves DIDs through the indigo identity directory,
+// which handles did:plc (against ATPROTO_PLC_URL) and did:web, and caches
+// DID documents.
+type identityResolver struct {
+	base *identity.BaseDirectory
+	dir  atomic.Pointer[identity.CacheDirectory]
+}
+
+func newIdentityResolver(plcURL string) *identityResolver {
+	if plcURL == "" {
+		plcURL = identity.DefaultPLCURL
+	}
+	r := &identityResolver{
+		base: &identity.BaseDirectory{
+			PLCURL:     plcURL,
+			HTTPClient: http.Client{Timeout: 10 * time.Second},
+		},
+	}
+	r.Flush()
+	return r
+}
+
+// Flush forgets every cached DID document.
+func (r *identityResolver) Flush() {
+	dir := identity.NewCacheDirectory(r.base, 10_000, time.Hour, 2*time.Minute, time.Hour)
+	r.dir.Store(&dir)
+}
+
+func (r *identityResolver) ResolvePDS(ctx context.Context, did string) (string, error) {
+	parsed, err := syntax.ParseDID(did)
+	if err != nil {
+		return "", fmt.Errorf("invalid DID %q: %w", did, err)
+	}
+	ident, err := r.dir.Load().LookupDID(ctx, parsed)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s failed: %w", did, err)
+	}
+	return ident.PDSEndpoint(), nil
+}
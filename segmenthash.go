@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With HASHED_SEGMENTS, finished playlists name their segments after their
+// content, e.g. segment_001.ts as segment_001.3f2a9c1b7e4d5a60.ts, so that
+// CDNs can cache them forever without serving the segments of an older
+// encode of the video. Only the served playlists are rewritten, the files
+// on disk keep the names ffmpeg gave them.
+
+// hex digits of the sha256 of a segment put in its name
+const segmentHashLength = 16
+
+type segmentHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// hashedName inserts hash before the extension of name.
+func hashedName(name, hash string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// splitHashedName is the reverse of hashedName.
+func splitHashedName(name string) (plain, hash string, ok bool) {
+	ext := filepath.Ext(name)
+	stem, hash, ok := cutLast(strings.TrimSuffix(name, ext), ".")
+	if !ok || len(hash) != segmentHashLength {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", "", false
+	}
+	return stem + ext, hash, true
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// segmentHash returns the hash of the segment at path, which is only
+// computed again if the file changed.
+func (cm *ConversionManager) segmentHash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if cachedA, ok := cm.segmentHashes.Load(path); ok {
+		cached := cachedA.(segmentHash)
+		if cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+			return cached.hash, nil
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))[:segmentHashLength]
+	cm.segmentHashes.Store(path, segmentHash{size: info.Size(), modTime: info.ModTime(), hash: hash})
+	return hash, nil
+}
+
+// pruneSegmentHashes forgets the hashes of segments that were removed.
+func (cm *ConversionManager) pruneSegmentHashes() {
+	cm.segmentHashes.Range(func(pathA, _ any) bool {
+		if _, err := os.Stat(pathA.(string)); os.IsNotExist(err) {
+			cm.segmentHashes.Delete(pathA)
+		}
+		return true
+	})
+}
+
+// hashSegmentURIs names the segments of a finished media playlist of
+// outputDir after their content, both URI lines and URI attributes (e.g.
+// of #EXT-X-MAP). Playlists that aren't finished yet are returned as is,
+// as their last segment may still be written.
+func (cm *ConversionManager) hashSegmentURIs(playlist []byte, outputDir string) ([]byte, error) {
+	if _, ended, err := parsePlaylist(playlist); err != nil || !ended {
+		return playlist, err
+	}
+	var hashErr error
+	hashed := func(uri string) string {
+		// only our own flat files, not other playlists
+		if uri == "" || strings.ContainsAny(uri, "/:?") || filepath.Ext(uri) == ".m3u8" {
+			return uri
+		}
+		hash, err := cm.segmentHash(filepath.Join(outputDir, uri))
+		if err != nil {
+			hashErr = err
+			return uri
+		}
+		return hashedName(uri, hash)
+	}
+
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			lines[i] = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := uriAttribute.FindStringSubmatch(attr)[1]
+				return `URI="` + hashed(uri) + `"`
+			})
+		default:
+			lines[i] = hashed(trimmed)
+		}
+	}
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// checkSegmentHash checks that the segment plain of conv, requested by
+// its hashed name, still has hash, answering 404 if it changed, e.g.
+// because the video was converted again and the encode differs. Requests
+// for plain names, without hash, always pass.
+func (s *State) checkSegmentHash(c *gin.Context, conv *Conversion, plain, hash string) bool {
+	if hash == "" {
+		return true
+	}
+	current, err := s.cm.segmentHash(filepath.Join(conv.OutputDir, plain))
+	if err != nil || current != hash {
+		c.AbortWithError(http.StatusNotFound, errors.New("file not found"))
+		return false
+	}
+	return true
+}
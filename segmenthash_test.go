@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSplitHashedName(t *testing.T) {
+	name := hashedName("segment_001.ts", "3f2a9c1b7e4d5a60")
+	if name != "segment_001.3f2a9c1b7e4d5a60.ts" {
+		t.Fatalf("hashedName: got %s", name)
+	}
+	if plain, hash, ok := splitHashedName(name); !ok || plain != "segment_001.ts" || hash != "3f2a9c1b7e4d5a60" {
+		t.Fatalf("splitHashedName: got %s %s %v", plain, hash, ok)
+	}
+	for _, name := range []string{"segment_001.ts", "segment.3f2a9c1b.ts", "segment.3f2a9c1b7e4d5zzz.ts", "playlist.m3u8"} {
+		if _, _, ok := splitHashedName(name); ok {
+			t.Errorf("splitHashedName(%s): expected no hash", name)
+		}
+	}
+}
+
+func TestHashedSegments(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	config.HashedSegments = true
+	runner := &fakeRunner{}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+
+	w := get(r, "GET", base+"playlist.m3u8")
+	if w.Code != http.StatusOK {
+		t.Fatalf("playlist: got %d %q", w.Code, w.Body)
+	}
+	segment := regexp.MustCompile(`segment1\.[0-9a-f]{16}\.ts`).FindString(w.Body.String())
+	if segment == "" || strings.Contains(w.Body.String(), "segment1.ts") {
+		t.Fatalf("expected hashed segment names, got %q", w.Body)
+	}
+	if w := get(r, "GET", base+segment); w.Code != http.StatusOK || w.Body.String() != "segment 1" {
+		t.Fatalf("hashed segment: got %d %q", w.Code, w.Body)
+	}
+	if w := get(r, "GET", base+"segment1.0000000000000000.ts"); w.Code != http.StatusNotFound {
+		t.Fatalf("stale hash: got %d", w.Code)
+	}
+
+	// evicted videos are converted again for their hashed segments, like
+	// for plain ones
+	if err := s.cm.invalidate(did, blobCID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(r, "GET", base+segment); w.Code != http.StatusOK || w.Body.String() != "segment 1" {
+		t.Fatalf("hashed segment after eviction: got %d %q", w.Code, w.Body)
+	}
+	if runner.runs("ffmpeg") < 3 {
+		t.Errorf("expected the video to be converted again, ffmpeg ran %d times", runner.runs("ffmpeg"))
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// selfTestClip is a 2 second, 64x36 raw video, small enough to convert
+// in a moment anywhere.
+//
+//go:embed assets/selftest.y4m
+var selfTestClip []byte
+
+// selfTestTimeout bounds a whole self test.
+const selfTestTimeout = 2 * time.Minute
+
+type SelfTestStep struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// selfTest runs the conversion pipeline on selfTestClip: probing it,
+// converting it to HLS, checking the playlist and its segments, fetching
+// them over HTTP, and generating a thumbnail. It answers 200 if every step passed, 500
+// otherwise, with the timing of each step.
+func (s *State) selfTest(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), selfTestTimeout)
+	defer cancel()
+
+	started := time.Now()
+	dir, err := s.config.mkdirTemp("selftest_*")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to create temp directory: %w", err))
+		return
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "source.y4m")
+	outputDir := filepath.Join(dir, "hls")
+
+	var probeResult *ProbeResult
+	steps := make([]SelfTestStep, 0)
+	pass := true
+	for _, step := range []struct {
+		name string
+		run  func() error
+	}{
+		{"write", func() error {
+			if err := os.WriteFile(input, selfTestClip, 0o600); err != nil {
+				return err
+			}
+			return os.Mkdir(outputDir, 0o700)
+		}},
+		{"probe", func() (err error) {
+			probeResult, err = s.cm.probe(ctx, input)
+			return err
+		}},
+		{"convert", func() error {
+			output, err := s.cm.runFFmpeg(ctx, s.cm.hlsArgs(input, outputDir, probeResult)...)
+			if err != nil {
+				return fmt.Errorf("ffmpeg error: %w, output: %s", err, outputTail(output, ffmpegOutputTail))
+			}
+			return nil
+		}},
+		{"playlist", func() error {
+			return checkSelfTestPlaylist(outputDir)
+		}},
+		{"serve", func() error {
+			return s.checkSelfTestServing(ctx, outputDir)
+		}},
+		{"thumbnail", func() error {
+			thumbPath := filepath.Join(dir, "thumbnail.jpg")
+			output, err := s.cm.runFFmpeg(ctx, s.cm.thumbnailArgs(input, thumbPath, thumbnailJPEG, thumbnailAt, false, probeResult)...)
+			if err != nil {
+				return fmt.Errorf("ffmpeg thumbnail error: %w, output: %s", err, outputTail(output, ffmpegOutputTail))
+			}
+			if info, err := os.Stat(thumbPath); err != nil || info.Size() == 0 {
+				return errors.New("no thumbnail was written")
+			}
+			return nil
+		}},
+	} {
+		stepStarted := time.Now()
+		err := step.run()
+		result := SelfTestStep{
+			Name:       step.name,
+			OK:         err == nil,
+			DurationMs: time.Since(stepStarted).Milliseconds(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		steps = append(steps, result)
+		if err != nil {
+			pass = false
+			break
+		}
+	}
+
+	status := http.StatusOK
+	if !pass {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, gin.H{
+		"pass":       pass,
+		"durationMs": time.Since(started).Milliseconds(),
+		"steps":      steps,
+	})
+}
+
+// checkSelfTestPlaylist checks that the conversion in outputDir has a
+// playlist listing segments that were all written.
+func checkSelfTestPlaylist(outputDir string) error {
+	playlistPath := filepath.Join(outputDir, "playlist.m3u8")
+	playlist, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return err
+	}
+	if isMasterPlaylist(playlist) {
+		// check the first variant instead
+		playlistPath = filepath.Join(outputDir, firstURI(playlist))
+		if playlist, err = os.ReadFile(playlistPath); err != nil {
+			return err
+		}
+	}
+	segments, ended, err := parsePlaylist(playlist)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 || !ended {
+		return errors.New("playlist is empty or unfinished")
+	}
+	for _, segment := range segments {
+		info, err := os.Stat(filepath.Join(filepath.Dir(playlistPath), segment.Filename))
+		if err != nil {
+			return fmt.Errorf("segment %s is missing: %w", segment.Filename, err)
+		}
+		if info.Size() == 0 {
+			return fmt.Errorf("segment %s is empty", segment.Filename)
+		}
+		if segment.Offset != nil && info.Size() < *segment.Offset+segment.Size {
+			return fmt.Errorf("segment %s is shorter than its byte range", segment.Filename)
+		}
+	}
+	return nil
+}
+
+// firstURI returns the first URI line of a playlist, e.g. its first
+// variant or segment.
+func firstURI(playlist []byte) string {
+	for _, line := range strings.Split(string(playlist), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
+
+// checkSelfTestServing serves the conversion in outputDir on a loopback
+// address the way watch requests are, and fetches its playlist and first
+// segment back.
+func (s *State) checkSelfTestServing(ctx context.Context, outputDir string) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	conv := &Conversion{OutputDir: outputDir}
+	r := gin.New()
+	r.GET("/watch/:did/:cid/*filepath", func(c *gin.Context) {
+		filename := filepath.Base(c.Param("filepath"))
+		segmentHash := ""
+		if s.config.HashedSegments {
+			if plain, hash, ok := splitHashedName(filename); ok {
+				filename, segmentHash = plain, hash
+			}
+		}
+		if _, err := os.Stat(filepath.Join(outputDir, filename)); err != nil {
+			c.AbortWithError(http.StatusNotFound, errors.New("file not found"))
+			return
+		}
+		if !s.checkSegmentHash(c, conv, filename, segmentHash) {
+			return
+		}
+		s.serveConversionFile(c, conv, filename)
+	})
+	server := &http.Server{Handler: r}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// URIs may point at CDN_BASE_URL, only their file name is fetched here
+	base := fmt.Sprintf("http://%s/watch/selftest/selftest/", listener.Addr())
+	playlist, err := fetchSelfTest(ctx, base+"playlist.m3u8")
+	if err != nil {
+		return err
+	}
+	if isMasterPlaylist(playlist) {
+		if playlist, err = fetchSelfTest(ctx, base+path.Base(firstURI(playlist))); err != nil {
+			return err
+		}
+	}
+	segments, _, err := parsePlaylist(playlist)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return errors.New("served playlist has no segments")
+	}
+	segment, err := fetchSelfTest(ctx, base+path.Base(segments[0].Filename))
+	if err != nil {
+		return err
+	}
+	if len(segment) == 0 {
+		return fmt.Errorf("served segment %s is empty", segments[0].Filename)
+	}
+	return nil
+}
+
+// fetchSelfTest fetches url, which must answer 200 with the content type
+// of its extension.
+func fetchSelfTest(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: HTTP %d", url, resp.StatusCode)
+	}
+	if expected := contentTypes[path.Ext(url)]; resp.Header.Get("Content-Type") != expected {
+		return nil, fmt.Errorf("GET %s: Content-Type %q, expected %q", url, resp.Header.Get("Content-Type"), expected)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	for _, hashed := range []bool{false, true} {
+		config := testConfig(t)
+		config.HashedSegments = hashed
+		s, r := newTestState(t, config, &fakeRunner{})
+		r.GET("/selftest", s.selfTest)
+
+		w := get(r, "GET", "/selftest")
+		var result struct {
+			Pass  bool           `json:"pass"`
+			Steps []SelfTestStep `json:"steps"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || !result.Pass {
+			t.Fatalf("hashed segments %v: got %d %s", hashed, w.Code, w.Body)
+		}
+		served := false
+		for _, step := range result.Steps {
+			served = served || step.Name == "serve" && step.OK
+		}
+		if !served {
+			t.Errorf("expected the output to be served over HTTP, got %s", w.Body)
+		}
+	}
+}
+
+func TestSelfTestFailure(t *testing.T) {
+	s, r := newTestState(t, testConfig(t), &fakeRunner{err: errors.New("exit status 1")})
+	r.GET("/selftest", s.selfTest)
+	if w := get(r, "GET", "/selftest"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("failing ffmpeg: got %d %s", w.Code, w.Body)
+	}
+}
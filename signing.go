@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Thumbnail URLs can be signed, so that they can be handed out to third
+// parties without opening the thumbnail endpoint to everyone. A signed URL
+// carries its expiry as a unix timestamp and an HMAC-SHA256 over the
+// video, the file and the poster timestamp.
+
+// minSigningKeyLength is the shortest THUMBNAIL_SIGNING_KEY accepted.
+const minSigningKeyLength = 32
+
+var (
+	errSignatureMissing = errors.New("thumbnail URL must be signed")
+	errSignatureInvalid = errors.New("invalid thumbnail URL signature")
+	errSignatureExpired = errors.New("thumbnail URL expired")
+)
+
+func thumbnailSignature(key []byte, did, cid, name, t string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%d", did, cid, name, t, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signThumbnailURL mints a URL of a thumbnail under baseURL that is valid
+// until expires. name is thumbnail.jpg, or poster.jpg with t as its
+// timestamp.
+func signThumbnailURL(key []byte, baseURL, did, cid, name, t string, expires time.Time) string {
+	query := url.Values{}
+	if t != "" {
+		query.Set("t", t)
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", thumbnailSignature(key, did, cid, name, t, expires.Unix()))
+	return fmt.Sprintf("%s/watch/%s/%s/%s?%s", baseURL, did, cid, name, query.Encode())
+}
+
+// verifyThumbnailURL checks the signature of a thumbnail request.
+func verifyThumbnailURL(key []byte, c *gin.Context, name string) error {
+	sig, expiresParam := c.Query("sig"), c.Query("expires")
+	if sig == "" || expiresParam == "" {
+		return errSignatureMissing
+	}
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	expected := thumbnailSignature(key, c.Param("did"), c.Param("cid"), name, c.Query("t"), expires)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return errSignatureExpired
+	}
+	return nil
+}
+
+// checkSignature rejects thumbnail requests without a valid signature
+// when THUMBNAIL_SIGNING_KEY is set, reporting whether to go on.
+func (s *State) checkSignature(c *gin.Context, name string) bool {
+	if s.config.ThumbnailSigningKey == "" {
+		return true
+	}
+	if err := verifyThumbnailURL([]byte(s.config.ThumbnailSigningKey), c, name); err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+// signThumbnail answers with a signed URL of a thumbnail, valid for ?ttl
+// (default 1h). ?t asks for a poster at that timestamp instead.
+func (s *State) signThumbnail(c *gin.Context) {
+	if s.config.ThumbnailSigningKey == "" {
+		c.AbortWithError(http.StatusNotFound, errors.New("thumbnail signing is disabled"))
+		return
+	}
+	ttl := time.Hour
+	if param := c.Query("ttl"); param != "" {
+		var err error
+		ttl, err = time.ParseDuration(param)
+		if err != nil || ttl <= 0 {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid ttl %q", param))
+			return
+		}
+	}
+	name := "thumbnail.jpg"
+	t := c.Query("t")
+	if t != "" {
+		if _, err := strconv.ParseFloat(t, 64); err != nil {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid timestamp %q", t))
+			return
+		}
+		name = "poster.jpg"
+	}
+
+	expires := time.Now().Add(ttl)
+	c.JSON(http.StatusOK, gin.H{
+		"url":     signThumbnailURL([]byte(s.config.ThumbnailSigningKey), s.config.publicBaseURL(), c.Param("did"), c.Param("cid"), name, t, expires),
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+}
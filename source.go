@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sourceFilename serves the original blob of a video, for players to fall
+// back to while its HLS conversion runs.
+const sourceFilename = "source"
+
+// proxiedRequestHeaders are passed on to upstream when proxying a source,
+// for range requests and revalidation.
+var proxiedRequestHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+
+// proxiedResponseHeaders are passed back from upstream when proxying a
+// source.
+var proxiedResponseHeaders = []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}
+
+// sourceCheckTTL is how long the outcome of checking a source is reused,
+// as players fetch it with many range requests.
+const sourceCheckTTL = 10 * time.Minute
+
+// sourceCheck is whether the blob of a video may be served as its source,
+// and as what: only videos ffprobe recognized are, with the type of their
+// container, whatever type upstream claims.
+type sourceCheck struct {
+	contentType string
+	// where it is proxied from, unless it was local when checked
+	url   string
+	guard *blobGuard
+	err   error
+
+	checkedAt time.Time
+}
+
+var errNotVideoSource = errors.New("unsupported source: not a video")
+
+// sourceContentTypes are the types sources are served as, by the format
+// names ffprobe reports.
+var sourceContentTypes = map[string]string{
+	"mp4":      "video/mp4",
+	"mov":      "video/mp4",
+	"webm":     "video/webm",
+	"matroska": "video/x-matroska",
+	"mpegts":   "video/mp2t",
+}
+
+// sourceContentType is the type a probed source is served as, failing for
+// anything but a video in one of sourceContentTypes.
+func sourceContentType(probeResult *ProbeResult) (string, error) {
+	if !slices.ContainsFunc(probeResult.Streams, func(stream ProbeStream) bool { return stream.CodecType == "video" }) {
+		return "", errNotVideoSource
+	}
+	// e.g. mov,mp4,m4a,3gp,3g2,mj2 or matroska,webm
+	for _, name := range strings.Split(probeResult.Format.FormatName, ",") {
+		if contentType, ok := sourceContentTypes[name]; ok {
+			return contentType, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", errNotVideoSource, probeResult.Format.FormatName)
+}
+
+// getSource streams the original blob of a video with range support, so
+// that playback can start right away, and prepares its HLS conversion in
+// the background for the player to switch to. Local uploads and cached
+// blobs are served from disk, others are proxied from the appview or PDS.
+// Blobs are probed first, and only served if they are videos.
+func (s *State) getSource(c *gin.Context) {
+	did := c.Param("did")
+	cid := c.Param("cid")
+
+	check, fresh := s.cm.checkSourceType(c.Request.Context(), did, cid)
+	if check.err != nil {
+		c.AbortWithError(errorStatus(check.err), check.err)
+		return
+	}
+	if fresh && c.Request.Method != http.MethodHead {
+		if _, _, err := s.prepare(did, cid, s.cm.thumbnailFormat(c)); err != nil {
+			log.Printf("Failed to prepare %s/%s while serving its source: %s", did, cid, err)
+		}
+	}
+
+	c.Header("Content-Type", check.contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": cid + sourceExtension(check.contentType)}))
+	// blobs are content addressed, like segments they never change
+	s.setCacheControl(c, cacheSegment)
+	if path, ok := s.cm.localSourceFile(did, cid); ok {
+		defer os.Remove(path)
+		c.File(path)
+		return
+	}
+
+	sourceURL, guard := check.url, check.guard
+	if sourceURL == "" {
+		// it was local when checked, and since evicted from the blob cache
+		var err error
+		sourceURL, guard, err = s.cm.streamSource(c.Request.Context(), did, cid)
+		if err != nil {
+			convErr := downloadError(fmt.Errorf("failed to find blob: %w", err))
+			c.AbortWithError(convErr.HTTPStatus(), convErr)
+			return
+		}
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, sourceURL, nil)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	for _, header := range proxiedRequestHeaders {
+		if value := c.GetHeader(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	resp, err := guard.client.Do(req)
+	if err != nil {
+		c.AbortWithError(http.StatusBadGateway, fmt.Errorf("failed to fetch blob: %w", err))
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+	default:
+		c.AbortWithError(http.StatusBadGateway, fmt.Errorf("failed to fetch blob: %w", &HTTPStatusError{StatusCode: resp.StatusCode}))
+		return
+	}
+
+	for _, header := range proxiedResponseHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			c.Header(header, value)
+		}
+	}
+	c.Status(resp.StatusCode)
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil && !errors.Is(err, c.Request.Context().Err()) {
+		log.Printf("Failed to proxy the source of %s/%s: %s", did, cid, err)
+	}
+}
+
+// localSourceFile returns a temporary link to the blob did/cid if it is a
+// local upload or cached, which the caller removes once done.
+func (cm *ConversionManager) localSourceFile(did, cid string) (string, bool) {
+	if cm.config.UploadMode == "local" {
+		if path, ok := cm.localSource(did, cid); ok {
+			return path, true
+		}
+	}
+	if cm.blobCache != nil {
+		return cm.blobCache.get(cid)
+	}
+	return "", false
+}
+
+// checkSourceType probes the blob did/cid, unless it was checked in the
+// last sourceCheckTTL, and reports whether it was just checked. Remote
+// blobs are probed through the source proxy, so that ffprobe only reads
+// what the blobGuard allows.
+func (cm *ConversionManager) checkSourceType(ctx context.Context, did, cid string) (sourceCheck, bool) {
+	key := did + "/" + cid
+	if checkA, ok := cm.sourceChecks.Load(key); ok {
+		if check := checkA.(sourceCheck); time.Since(check.checkedAt) < sourceCheckTTL {
+			return check, false
+		}
+	}
+
+	var check sourceCheck
+	input, ok := cm.localSourceFile(did, cid)
+	if ok {
+		defer os.Remove(input)
+	} else {
+		var err error
+		check.url, check.guard, err = cm.streamSource(ctx, did, cid)
+		if err != nil {
+			// not cached, the blob may show up or upstream recover
+			return sourceCheck{err: downloadError(fmt.Errorf("failed to find blob: %w", err))}, true
+		}
+		proxyURL, remove, err := cm.streams.add(streamedSource{url: check.url, guard: check.guard})
+		if err != nil {
+			return sourceCheck{err: err}, true
+		}
+		defer remove()
+		input = proxyURL
+	}
+
+	probeResult, err := cm.probe(ctx, input)
+	if err != nil {
+		if ctx.Err() != nil {
+			return sourceCheck{err: ctx.Err()}, true
+		}
+		check.err = &ConversionError{Kind: KindProbeFailed, Err: err}
+	} else if check.contentType, err = sourceContentType(probeResult); err != nil {
+		check.err = &ConversionError{Kind: KindUnsupportedSource, Err: err}
+	}
+	check.checkedAt = time.Now()
+	cm.sourceChecks.Store(key, check)
+	return check, true
+}
+
+// pruneSourceChecks forgets the source checks older than sourceCheckTTL.
+func (cm *ConversionManager) pruneSourceChecks() {
+	cm.sourceChecks.Range(func(key, checkA any) bool {
+		if time.Since(checkA.(sourceCheck).checkedAt) >= sourceCheckTTL {
+			cm.sourceChecks.CompareAndDelete(key, checkA)
+		}
+		return true
+	})
+}
+
+// sourceExtension is the file extension of sources served as contentType.
+func sourceExtension(contentType string) string {
+	switch contentType {
+	case "video/webm":
+		return ".webm"
+	case "video/x-matroska":
+		return ".mkv"
+	case "video/mp2t":
+		return ".ts"
+	default:
+		return ".mp4"
+	}
+}
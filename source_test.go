@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestGetSource(t *testing.T) {
+	config := testConfig(t)
+	config.UploadMode = "local"
+	runner := &fakeRunner{}
+	s, r := newTestState(t, config, runner)
+	const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	blobCID, err := s.cm.storeLocalBlob(did, []byte("a video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("/watch/%s/%s/", did, blobCID)
+
+	w := get(r, "GET", base+"source")
+	if w.Code != http.StatusOK || w.Body.String() != "a video" {
+		t.Fatalf("source: got %d %q", w.Code, w.Body)
+	}
+	expected := map[string]string{
+		"Content-Type":           "video/mp4",
+		"X-Content-Type-Options": "nosniff",
+		"Content-Disposition":    "inline; filename=" + blobCID.String() + ".mp4",
+	}
+	for header, value := range expected {
+		if got := w.Header().Get(header); got != value {
+			t.Errorf("%s: got %q, expected %q", header, got, value)
+		}
+	}
+	// wait for the conversion the first request prepared
+	if w := get(r, "GET", base+"playlist.m3u8"); w.Code != http.StatusOK {
+		t.Fatalf("playlist: got %d", w.Code)
+	}
+
+	probes, conversions := runner.runs("ffprobe"), runner.runs("ffmpeg")
+	for range 3 {
+		if w := get(r, "GET", base+"source"); w.Code != http.StatusOK {
+			t.Fatalf("source: got %d", w.Code)
+		}
+	}
+	if runner.runs("ffprobe") != probes || runner.runs("ffmpeg") != conversions {
+		t.Errorf("expected the check to be reused, ffprobe ran %d more times, ffmpeg %d", runner.runs("ffprobe")-probes, runner.runs("ffmpeg")-conversions)
+	}
+}
+
+func TestGetSourceNotVideo(t *testing.T) {
+	tests := map[string]string{
+		"audio": `{"streams": [{"codec_type": "audio", "codec_name": "mp3"}], "format": {"format_name": "mp3"}}`,
+		"image": `{"streams": [{"codec_type": "video", "codec_name": "png"}], "format": {"format_name": "png_pipe"}}`,
+		"html":  `{"streams": [], "format": {}}`,
+	}
+	for name, probe := range tests {
+		config := testConfig(t)
+		config.UploadMode = "local"
+		s, r := newTestState(t, config, &fakeRunner{probe: probe})
+		const did = "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+		blobCID, err := s.cm.storeLocalBlob(did, []byte("<script>alert(1)</script>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := get(r, "GET", fmt.Sprintf("/watch/%s/%s/source", did, blobCID))
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: got %d %q", name, w.Code, w.Body)
+		}
+	}
+}
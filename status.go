@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var startedAt = time.Now()
+
+// version is the module version, or else the VCS revision douga was
+// built from.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "unknown"
+}
+
+// getStatus describes this server, at the root.
+func (s *State) getStatus(c *gin.Context) {
+	status := gin.H{
+		"name":    "douga",
+		"about":   "https://github.com/lun-4/douga -- a reimplementation of video.bsky.app for the bit",
+		"version": version(),
+		"uptime":  int64(time.Since(startedAt).Seconds()),
+		"downloads": gin.H{
+			"inFlight": s.cm.downloadsInFlight.Load(),
+			"max":      cap(s.cm.downloadSlots),
+		},
+		"diskUsageBytes": s.cm.diskUsage.Load(),
+	}
+	if bc := s.cm.blobCache; bc != nil {
+		status["blobCache"] = gin.H{"hits": bc.hits.Load(), "misses": bc.misses.Load()}
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// notFound answers unknown routes with a JSON error, in the XRPC error
+// format for XRPC methods.
+func notFound(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/xrpc/") {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "MethodNotImplemented",
+			"message": "method not implemented: " + strings.TrimPrefix(c.Request.URL.Path, "/xrpc/"),
+		})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "NotFound", "message": "not found"})
+}
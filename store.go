@@ -0,0 +1,629 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/lex/util"
+	_ "github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+var errJobNotFound = errors.New("job not found")
+var errJobExists = errors.New("job already exists")
+var errUserNotFound = errors.New("user not found")
+var errJobsRunning = errors.New("user has jobs in progress")
+
+// JobStore persists upload jobs so that their status survives restarts and
+// can be shared between multiple douga instances.
+type JobStore interface {
+	// CreateJob stores a new job, failing with errJobExists if its ID is
+	// already taken. If idempotencyKey is set and already maps to a job of
+	// the same user created since keysExpiredBefore, no job is created and
+	// the ID of that job is returned instead. Otherwise the key is mapped
+	// to the new job, whose ID is returned.
+	CreateJob(job Job, idempotencyKey string, keysExpiredBefore time.Time) (string, error)
+	// ReleaseIdempotencyKeys forgets the idempotency keys mapped to the
+	// job id, so that retries of an upload that never ran start over.
+	ReleaseIdempotencyKeys(jobID string) error
+	SaveJob(job Job) error
+	GetJob(id string) (*Job, error)
+	// GetJobByBlob returns the latest completed job of did that produced
+	// the blob cid.
+	GetJobByBlob(did, cid string) (*Job, error)
+	// UsageSince returns how many videos and bytes a DID uploaded since the
+	// given time, used for daily upload limits.
+	UsageSince(did string, since time.Time) (videos int64, bytes int64, err error)
+	// DeleteFinishedJobs removes completed and failed jobs last updated
+	// before the given time, returning how many were removed.
+	DeleteFinishedJobs(before time.Time) (int64, error)
+	// DeleteUserJobs removes the jobs and idempotency keys of did,
+	// returning how many jobs were removed and the CIDs of their blobs.
+	// It fails with errJobsRunning if any of them isn't finished.
+	DeleteUserJobs(did string) (jobs int64, blobCIDs []string, err error)
+}
+
+// PinStore persists the videos pinned by admins, whose conversion is kept
+// warm and never evicted.
+type PinStore interface {
+	AddPin(did, cid string) error
+	// RemovePin reports whether the video was pinned.
+	RemovePin(did, cid string) (bool, error)
+	ListPins() ([]Pin, error)
+	// RemoveUserPins unpins every video of did, returning their CIDs.
+	RemoveUserPins(did string) ([]string, error)
+}
+
+type Pin struct {
+	DID       string    `json:"did"`
+	CID       string    `json:"cid"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UserStore persists what we know about users (currently their PDS), so
+// that a PLC outage doesn't block uploads for users we have seen before.
+type UserStore interface {
+	SaveUser(did string, u User) error
+	GetUser(did string) (*User, error)
+	// DeleteUser reports whether the user was known.
+	DeleteUser(did string) (bool, error)
+}
+
+// openStore picks a storage backend from the DATABASE_URL scheme.
+// sqlite is used by default, with DB_PATH as the database file.
+func openStore(config Config) (*sqlStore, error) {
+	if config.DatabaseURL == "" {
+		return newSQLiteStore(config.DBPath)
+	}
+
+	scheme, rest, ok := strings.Cut(config.DatabaseURL, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid DATABASE_URL %q: missing scheme", config.DatabaseURL)
+	}
+	switch scheme {
+	case "sqlite", "sqlite3":
+		return newSQLiteStore(rest)
+	case "postgres", "postgresql":
+		return newPostgresStore(config.DatabaseURL)
+	default:
+		return nil, fmt.Errorf("unsupported DATABASE_URL scheme %q", scheme)
+	}
+}
+
+// sqlStore implements JobStore and UserStore on top of database/sql.
+// Queries only use syntax shared by SQLite and Postgres ($N placeholders,
+// ON CONFLICT upserts), the backends only differ in their schema.
+type sqlStore struct {
+	db *sql.DB
+	// serializes writes on SQLite, which only allows one writer at a time
+	writeMu *sync.Mutex
+}
+
+func newSQLiteStore(path string) (*sqlStore, error) {
+	// the pragmas below only apply to the connection running them, the
+	// busy timeout must be in the DSN so every pooled connection has it
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", path+separator+"_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	PRAGMA journal_mode=WAL;
+	PRAGMA busy_timeout = 5000;
+	PRAGMA synchronous = NORMAL;
+	PRAGMA cache_size = 1000000000;
+	PRAGMA foreign_keys = true;
+	PRAGMA temp_store = memory;
+
+	CREATE TABLE IF NOT EXISTS users (
+		did text primary key,
+		handle text,
+		pds_url text
+	) STRICT;
+
+	CREATE TABLE IF NOT EXISTS jobs (
+		id text primary key,
+		user_did text not null,
+		state text not null,
+		progress integer not null,
+		error text,
+		blob text,
+		blob_cid text,
+		verified_cid text,
+		thumb_blob text,
+		content_type text not null,
+		size integer not null,
+		created_at integer not null,
+		updated_at integer not null
+	) STRICT;
+	CREATE INDEX IF NOT EXISTS jobs_user_did_created_at ON jobs (user_did, created_at);
+
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_did text not null,
+		key text not null,
+		job_id text not null,
+		created_at integer not null,
+		primary key (user_did, key)
+	) STRICT;
+	CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
+
+	CREATE TABLE IF NOT EXISTS pins (
+		did text not null,
+		cid text not null,
+		created_at integer not null,
+		primary key (did, cid)
+	) STRICT;
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables: %w", err)
+	}
+
+	// columns added after their table was first created. sqlite has no
+	// ADD COLUMN IF NOT EXISTS, so we ignore the duplicate column errors
+	for _, migration := range []string{
+		`ALTER TABLE users ADD COLUMN pds_url text`,
+		`ALTER TABLE jobs ADD COLUMN verified_cid text`,
+		`ALTER TABLE jobs ADD COLUMN thumb_blob text`,
+		`ALTER TABLE jobs ADD COLUMN blob_cid text`,
+	} {
+		_, err = db.Exec(migration)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return nil, fmt.Errorf("error migrating tables: %w", err)
+		}
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS jobs_blob_cid ON jobs (blob_cid)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating indexes: %w", err)
+	}
+
+	return &sqlStore{db: db, writeMu: &sync.Mutex{}}, nil
+}
+
+func newPostgresStore(url string) (*sqlStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS users (
+		did text primary key,
+		handle text,
+		pds_url text
+	);
+
+	CREATE TABLE IF NOT EXISTS jobs (
+		id text primary key,
+		user_did text not null,
+		state text not null,
+		progress bigint not null,
+		error text,
+		blob text,
+		blob_cid text,
+		verified_cid text,
+		thumb_blob text,
+		content_type text not null,
+		size bigint not null,
+		created_at bigint not null,
+		updated_at bigint not null
+	);
+	CREATE INDEX IF NOT EXISTS jobs_user_did_created_at ON jobs (user_did, created_at);
+
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_did text not null,
+		key text not null,
+		job_id text not null,
+		created_at bigint not null,
+		primary key (user_did, key)
+	);
+	CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
+
+	CREATE TABLE IF NOT EXISTS pins (
+		did text not null,
+		cid text not null,
+		created_at bigint not null,
+		primary key (did, cid)
+	);
+
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS verified_cid text;
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS thumb_blob text;
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS blob_cid text;
+	CREATE INDEX IF NOT EXISTS jobs_blob_cid ON jobs (blob_cid);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables: %w", err)
+	}
+
+	return &sqlStore{db: db}, nil
+}
+
+func (st *sqlStore) Close() error {
+	return st.db.Close()
+}
+
+// how often a write is retried while SQLite reports the database as busy,
+// on top of the busy timeout
+const maxBusyRetries = 5
+
+// write runs a statement that writes to the database. On SQLite, writes
+// are serialized and retried with backoff while the database is busy or
+// locked, e.g. by a checkpoint or another process.
+func (st *sqlStore) write(query string, args ...any) (sql.Result, error) {
+	if st.writeMu == nil {
+		return st.db.Exec(query, args...)
+	}
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+
+	backoff := 10 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		res, err := st.db.Exec(query, args...)
+		if !isBusy(err) || attempt == maxBusyRetries {
+			return res, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// writeTx runs fn in a transaction, committing it if fn succeeds. Like
+// write, it is serialized and retried while the database is busy on
+// SQLite.
+func (st *sqlStore) writeTx(fn func(tx *sql.Tx) error) error {
+	run := func() error {
+		tx, err := st.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	if st.writeMu == nil {
+		return run()
+	}
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+
+	backoff := 10 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := run()
+		if !isBusy(err) || attempt == maxBusyRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+func (st *sqlStore) CreateJob(job Job, idempotencyKey string, keysExpiredBefore time.Time) (string, error) {
+	jobID := job.ID
+	err := st.writeTx(func(tx *sql.Tx) error {
+		jobID = job.ID
+		if idempotencyKey != "" {
+			_, err := tx.Exec(`DELETE FROM idempotency_keys WHERE created_at < $1`, keysExpiredBefore.Unix())
+			if err != nil {
+				return err
+			}
+			res, err := tx.Exec(`
+			INSERT INTO idempotency_keys (user_did, key, job_id, created_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_did, key) DO NOTHING
+			`, job.userDID, idempotencyKey, job.ID, time.Now().Unix())
+			if err != nil {
+				return err
+			}
+			claimed, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if claimed == 0 {
+				return tx.QueryRow(`
+				SELECT job_id FROM idempotency_keys WHERE user_did = $1 AND key = $2
+				`, job.userDID, idempotencyKey).Scan(&jobID)
+			}
+		}
+
+		res, err := tx.Exec(`
+		INSERT INTO jobs (id, user_did, state, progress, content_type, size, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO NOTHING
+		`, job.ID, job.userDID, job.state, job.progress, job.contentType, job.size, job.createdAt.Unix(), time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			return errJobExists
+		}
+		return nil
+	})
+	return jobID, err
+}
+
+func (st *sqlStore) SaveJob(job Job) error {
+	var jobErr sql.NullString
+	if job.err != nil {
+		jobErr = sql.NullString{String: job.err.Error(), Valid: true}
+	}
+	var verifiedCID sql.NullString
+	if job.verifiedCID != "" {
+		verifiedCID = sql.NullString{String: job.verifiedCID, Valid: true}
+	}
+	blob, err := marshalBlob(job.blob)
+	if err != nil {
+		return err
+	}
+	var blobCID sql.NullString
+	if job.blob != nil {
+		blobCID = sql.NullString{String: job.blob.Ref.String(), Valid: true}
+	}
+	thumbBlob, err := marshalBlob(job.thumbBlob)
+	if err != nil {
+		return err
+	}
+
+	_, err = st.write(`
+	INSERT INTO jobs (id, user_did, state, progress, error, blob, blob_cid, verified_cid, thumb_blob, content_type, size, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	ON CONFLICT (id) DO UPDATE SET
+		state = excluded.state,
+		progress = excluded.progress,
+		error = excluded.error,
+		blob = excluded.blob,
+		blob_cid = excluded.blob_cid,
+		verified_cid = excluded.verified_cid,
+		thumb_blob = excluded.thumb_blob,
+		updated_at = excluded.updated_at
+	`, job.ID, job.userDID, job.state, job.progress, jobErr, blob, blobCID, verifiedCID, thumbBlob, job.contentType, job.size, job.createdAt.Unix(), time.Now().Unix())
+	return err
+}
+
+func marshalBlob(blob *util.LexBlob) (sql.NullString, error) {
+	if blob == nil {
+		return sql.NullString{}, nil
+	}
+	blobJSON, err := json.Marshal(blob)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to marshal blob: %w", err)
+	}
+	return sql.NullString{String: string(blobJSON), Valid: true}, nil
+}
+
+func unmarshalBlob(blob sql.NullString) (*util.LexBlob, error) {
+	if !blob.Valid {
+		return nil, nil
+	}
+	out := &util.LexBlob{}
+	if err := json.Unmarshal([]byte(blob.String), out); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal blob: %w", err)
+	}
+	return out, nil
+}
+
+const jobColumns = `id, user_did, state, progress, error, blob, verified_cid, thumb_blob, content_type, size, created_at`
+
+func (st *sqlStore) GetJob(id string) (*Job, error) {
+	return scanJob(st.db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = $1`, id))
+}
+
+func (st *sqlStore) GetJobByBlob(did, cid string) (*Job, error) {
+	return scanJob(st.db.QueryRow(`
+	SELECT `+jobColumns+` FROM jobs
+	WHERE blob_cid = $1 AND user_did = $2 AND state = $3
+	ORDER BY created_at DESC LIMIT 1
+	`, cid, did, "JOB_STATE_COMPLETED"))
+}
+
+// scanJob reads a row of jobColumns.
+func scanJob(row *sql.Row) (*Job, error) {
+	var job Job
+	var jobErr, blob, verifiedCID, thumbBlob sql.NullString
+	var createdAt int64
+	err := row.Scan(&job.ID, &job.userDID, &job.state, &job.progress, &jobErr, &blob, &verifiedCID, &thumbBlob, &job.contentType, &job.size, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job.createdAt = time.Unix(createdAt, 0)
+	job.verifiedCID = verifiedCID.String
+	if jobErr.Valid {
+		job.err = errors.New(jobErr.String)
+	}
+	job.blob, err = unmarshalBlob(blob)
+	if err != nil {
+		return nil, fmt.Errorf("job %s: %w", job.ID, err)
+	}
+	job.thumbBlob, err = unmarshalBlob(thumbBlob)
+	if err != nil {
+		return nil, fmt.Errorf("job %s: %w", job.ID, err)
+	}
+	return &job, nil
+}
+
+func (st *sqlStore) UsageSince(did string, since time.Time) (int64, int64, error) {
+	var videos, bytes int64
+	err := st.db.QueryRow(`
+	SELECT count(*), coalesce(sum(size), 0)
+	FROM jobs WHERE user_did = $1 AND created_at >= $2 AND state != $3
+	`, did, since.Unix(), "JOB_STATE_FAILED").Scan(&videos, &bytes)
+	return videos, bytes, err
+}
+
+func (st *sqlStore) ReleaseIdempotencyKeys(jobID string) error {
+	_, err := st.write(`DELETE FROM idempotency_keys WHERE job_id = $1`, jobID)
+	return err
+}
+
+func (st *sqlStore) DeleteFinishedJobs(before time.Time) (int64, error) {
+	res, err := st.write(`
+	DELETE FROM jobs WHERE state IN ($1, $2) AND updated_at < $3
+	`, "JOB_STATE_COMPLETED", "JOB_STATE_FAILED", before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (st *sqlStore) DeleteUserJobs(did string) (int64, []string, error) {
+	var jobs int64
+	var blobCIDs []string
+	// a job created meanwhile is either deleted along or kept with its key
+	err := st.writeTx(func(tx *sql.Tx) error {
+		var running int64
+		err := tx.QueryRow(`
+		SELECT count(*) FROM jobs WHERE user_did = $1 AND state NOT IN ($2, $3)
+		`, did, "JOB_STATE_COMPLETED", "JOB_STATE_FAILED").Scan(&running)
+		if err != nil {
+			return err
+		}
+		if running > 0 {
+			return errJobsRunning
+		}
+
+		rows, err := tx.Query(`SELECT DISTINCT blob_cid FROM jobs WHERE user_did = $1 AND blob_cid IS NOT NULL`, did)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		blobCIDs = make([]string, 0)
+		for rows.Next() {
+			var blobCID string
+			if err := rows.Scan(&blobCID); err != nil {
+				return err
+			}
+			blobCIDs = append(blobCIDs, blobCID)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		if _, err := tx.Exec(`DELETE FROM idempotency_keys WHERE user_did = $1`, did); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`DELETE FROM jobs WHERE user_did = $1`, did)
+		if err != nil {
+			return err
+		}
+		jobs, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return jobs, blobCIDs, nil
+}
+
+func (st *sqlStore) AddPin(did, cid string) error {
+	_, err := st.write(`
+	INSERT INTO pins (did, cid, created_at) VALUES ($1, $2, $3)
+	ON CONFLICT (did, cid) DO NOTHING
+	`, did, cid, time.Now().Unix())
+	return err
+}
+
+func (st *sqlStore) RemovePin(did, cid string) (bool, error) {
+	res, err := st.write(`DELETE FROM pins WHERE did = $1 AND cid = $2`, did, cid)
+	if err != nil {
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	return removed > 0, err
+}
+
+func (st *sqlStore) ListPins() ([]Pin, error) {
+	rows, err := st.db.Query(`SELECT did, cid, created_at FROM pins ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pins := make([]Pin, 0)
+	for rows.Next() {
+		var pin Pin
+		var createdAt int64
+		if err := rows.Scan(&pin.DID, &pin.CID, &createdAt); err != nil {
+			return nil, err
+		}
+		pin.CreatedAt = time.Unix(createdAt, 0)
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+func (st *sqlStore) RemoveUserPins(did string) ([]string, error) {
+	rows, err := st.db.Query(`SELECT cid FROM pins WHERE did = $1`, did)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cids := make([]string, 0)
+	for rows.Next() {
+		var cid string
+		if err := rows.Scan(&cid); err != nil {
+			return nil, err
+		}
+		cids = append(cids, cid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	_, err = st.write(`DELETE FROM pins WHERE did = $1`, did)
+	return cids, err
+}
+
+func (st *sqlStore) SaveUser(did string, u User) error {
+	_, err := st.write(`
+	INSERT INTO users (did, pds_url) VALUES ($1, $2)
+	ON CONFLICT (did) DO UPDATE SET pds_url = excluded.pds_url
+	`, did, u.pdsUrl)
+	return err
+}
+
+func (st *sqlStore) GetUser(did string) (*User, error) {
+	var pdsUrl sql.NullString
+	err := st.db.QueryRow(`SELECT pds_url FROM users WHERE did = $1`, did).Scan(&pdsUrl)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !pdsUrl.Valid) {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &User{pdsUrl: pdsUrl.String}, nil
+}
+
+func (st *sqlStore) DeleteUser(did string) (bool, error) {
+	res, err := st.write(`DELETE FROM users WHERE did = $1`, did)
+	if err != nil {
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	return removed > 0, err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *sqlStore {
+	t.Helper()
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "douga.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func testJob(id, did string) Job {
+	return Job{ID: id, userDID: did, state: "JOB_STATE_CREATED", createdAt: time.Now()}
+}
+
+func TestCreateJobIdempotencyKey(t *testing.T) {
+	store := newTestStore(t)
+	expired := time.Now().Add(-time.Hour)
+
+	const retries = 8
+	ids := make([]string, retries)
+	errs := make([]error, retries)
+	var wg sync.WaitGroup
+	for i := range retries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids[i], errs[i] = store.CreateJob(testJob(fmt.Sprintf("job%d", i), "did:plc:a"), "key", expired)
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	for i := range retries {
+		if errs[i] != nil {
+			t.Fatalf("retry %d: %s", i, errs[i])
+		}
+		if ids[i] != ids[0] {
+			t.Fatalf("retry %d got job %s, retry 0 got %s", i, ids[i], ids[0])
+		}
+		if _, err := store.GetJob(fmt.Sprintf("job%d", i)); err == nil {
+			created++
+		} else if !errors.Is(err, errJobNotFound) {
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d jobs created for one Idempotency-Key, expected 1", created)
+	}
+
+	// keys are per user
+	id, err := store.CreateJob(testJob("other", "did:plc:b"), "key", expired)
+	if err != nil || id != "other" {
+		t.Fatalf("got %q, %v for another user's key, expected a new job", id, err)
+	}
+	// and expire
+	id, err = store.CreateJob(testJob("later", "did:plc:a"), "key", time.Now().Add(time.Minute))
+	if err != nil || id != "later" {
+		t.Fatalf("got %q, %v for an expired key, expected a new job", id, err)
+	}
+}
+
+func TestCreateJobExists(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.CreateJob(testJob("job", "did:plc:a"), "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := store.CreateJob(testJob("job", "did:plc:a"), "key", time.Time{})
+	if !errors.Is(err, errJobExists) {
+		t.Fatalf("got %v, expected errJobExists", err)
+	}
+	// the failed job doesn't keep the key
+	id, err := store.CreateJob(testJob("job2", "did:plc:a"), "key", time.Time{})
+	if err != nil || id != "job2" {
+		t.Fatalf("got %q, %v, expected the key to be free", id, err)
+	}
+}
+
+func TestDeleteUserJobs(t *testing.T) {
+	store := newTestStore(t)
+	const did = "did:web:a.example.com"
+	expired := time.Now().Add(-time.Hour)
+	for i, owner := range []string{did, did, "did:web:a.example.com.evil"} {
+		job := testJob(fmt.Sprintf("job%d", i), owner)
+		job.state = "JOB_STATE_COMPLETED"
+		if _, err := store.CreateJob(job, fmt.Sprintf("key%d", i), expired); err != nil {
+			t.Fatal(err)
+		}
+	}
+	running := testJob("running", did)
+	if _, err := store.CreateJob(running, "", expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.DeleteUserJobs(did); !errors.Is(err, errJobsRunning) {
+		t.Fatalf("expected errJobsRunning, got %v", err)
+	}
+	if _, err := store.GetJob("job0"); err != nil {
+		t.Fatalf("expected nothing to be deleted while a job runs: %s", err)
+	}
+
+	running.state = "JOB_STATE_FAILED"
+	if err := store.SaveJob(running); err != nil {
+		t.Fatal(err)
+	}
+	jobs, _, err := store.DeleteUserJobs(did)
+	if err != nil || jobs != 3 {
+		t.Fatalf("expected 3 jobs deleted, got %d, %v", jobs, err)
+	}
+	if _, err := store.GetJob("job2"); err != nil {
+		t.Errorf("expected the jobs of other users to be kept: %s", err)
+	}
+	// the keys went along with the jobs
+	id, err := store.CreateJob(testJob("job3", did), "key0", expired)
+	if err != nil || id != "job3" {
+		t.Errorf("expected key0 to be free again, got %s, %v", id, err)
+	}
+}
+
+func TestReleaseIdempotencyKeys(t *testing.T) {
+	store := newTestStore(t)
+	expired := time.Now().Add(-time.Hour)
+	if _, err := store.CreateJob(testJob("job1", "did:plc:a"), "key", expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ReleaseIdempotencyKeys("job1"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.CreateJob(testJob("job2", "did:plc:a"), "key", expired)
+	if err != nil || id != "job2" {
+		t.Fatalf("expected a released key to create a new job, got %s %v", id, err)
+	}
+}
+
+func TestDeleteFinishedJobs(t *testing.T) {
+	store := newTestStore(t)
+	for id, state := range map[string]string{"completed": "JOB_STATE_COMPLETED", "failed": "JOB_STATE_FAILED", "running": "JOB_STATE_CREATED"} {
+		job := testJob(id, "did:plc:a")
+		job.state = state
+		if err := store.SaveJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// jobs finished within JOB_TTL are still there for clients polling them
+	cm := &ConversionManager{config: Config{JobTTL: time.Hour}, jobs: store}
+	cm.expireJobs()
+	for _, id := range []string{"completed", "failed", "running"} {
+		if _, err := store.GetJob(id); err != nil {
+			t.Errorf("expected %s to be kept within JOB_TTL: %s", id, err)
+		}
+	}
+
+	removed, err := store.DeleteFinishedJobs(time.Now().Add(time.Minute))
+	if err != nil || removed != 2 {
+		t.Fatalf("expected 2 finished jobs deleted, got %d, %v", removed, err)
+	}
+	if _, err := store.GetJob("completed"); err == nil {
+		t.Error("expected the completed job to be deleted")
+	}
+	if _, err := store.GetJob("running"); err != nil {
+		t.Errorf("expected the running job to be kept: %s", err)
+	}
+}
+
+func TestConcurrentSaveJob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "douga.db")
+	// two instances sharing the database, only the writes of each one are
+	// serialized, those of the other make it busy
+	stores := make([]*sqlStore, 2)
+	for i := range stores {
+		store, err := newSQLiteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		stores[i] = store
+	}
+
+	const jobs = 50
+	const updates = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, jobs*updates)
+	for i := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := stores[i%len(stores)]
+			job := testJob(fmt.Sprintf("job%d", i), "did:plc:a")
+			for progress := range updates {
+				job.progress = int64(progress + 1)
+				if err := store.SaveJob(job); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("SaveJob: %s", err)
+	}
+	for i := range jobs {
+		job, err := stores[0].GetJob(fmt.Sprintf("job%d", i))
+		if err != nil {
+			t.Fatalf("job%d was lost: %s", i, err)
+		}
+		if job.progress != updates {
+			t.Errorf("job%d: got progress %d, expected the last update", i, job.progress)
+		}
+	}
+}
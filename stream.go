@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// With STREAM_SOURCE, ffmpeg doesn't read blobs from upstream itself but
+// from a proxy on loopback, which fetches them with the blobGuard client
+// like downloads do: ffmpeg would follow redirects anywhere, and wouldn't
+// count against MAX_CONCURRENT_DOWNLOADS.
+
+// sourceProxy serves the blobs being streamed to ffmpeg, each under a
+// random path only known to the ffmpeg reading it.
+type sourceProxy struct {
+	once    sync.Once
+	baseURL string
+	err     error
+	// stream id -> streamedSource
+	sources sync.Map
+}
+
+type streamedSource struct {
+	url   string
+	guard *blobGuard
+}
+
+// start listens on a random loopback port the first time it is called.
+func (p *sourceProxy) start() error {
+	p.once.Do(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			p.err = fmt.Errorf("failed to start the source proxy: %w", err)
+			return
+		}
+		p.baseURL = "http://" + listener.Addr().String()
+		go func() {
+			err := http.Serve(listener, http.HandlerFunc(p.serve))
+			log.Printf("Source proxy stopped: %s", err)
+		}()
+	})
+	return p.err
+}
+
+// add serves source until the returned remove is called.
+func (p *sourceProxy) add(source streamedSource) (string, func(), error) {
+	if err := p.start(); err != nil {
+		return "", nil, err
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+	p.sources.Store(id, source)
+	return p.baseURL + "/" + id, func() { p.sources.Delete(id) }, nil
+}
+
+func (p *sourceProxy) serve(w http.ResponseWriter, r *http.Request) {
+	sourceA, ok := p.sources.Load(strings.TrimPrefix(r.URL.Path, "/"))
+	if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		http.NotFound(w, r)
+		return
+	}
+	source := sourceA.(streamedSource)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, source.url, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// ffmpeg seeks with ranges, e.g. to the moov atom at the end of MP4s
+	for _, header := range proxiedRequestHeaders {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	resp, err := source.guard.client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range proxiedResponseHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	// ffmpeg hangs up whenever it seeks, or has read enough
+	_, err = io.Copy(w, resp.Body)
+	if err != nil && r.Context().Err() == nil && !errors.Is(err, syscall.EPIPE) && !errors.Is(err, syscall.ECONNRESET) {
+		log.Printf("Failed to stream %s: %s", source.url, err)
+	}
+}
+
+// openStream returns where ffmpeg can read the blob did/cid from, for
+// STREAM_SOURCE: its local upload or cached copy if there is one, or else
+// the source proxy. Streams hold a download slot until closed.
+func (cm *ConversionManager) openStream(ctx context.Context, did, cid string) (source string, closeStream func(), err error) {
+	if path, ok := cm.localSourceFile(did, cid); ok {
+		return path, func() { os.Remove(path) }, nil
+	}
+
+	select {
+	case cm.downloadSlots <- struct{}{}:
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+	cm.downloadsInFlight.Add(1)
+	release := func() {
+		cm.downloadsInFlight.Add(-1)
+		<-cm.downloadSlots
+	}
+
+	sourceURL, guard, err := cm.streamSource(ctx, did, cid)
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+	proxyURL, remove, err := cm.streams.add(streamedSource{url: sourceURL, guard: guard})
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+	return proxyURL, func() {
+		remove()
+		release()
+	}, nil
+}
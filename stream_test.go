@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAppview serves blob at every /blob/ path, with range support.
+// Other paths redirect to redirectTo.
+func newTestAppview(t testing.TB, blob []byte, redirectTo string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/blob/") {
+			http.Redirect(w, r, redirectTo, http.StatusFound)
+			return
+		}
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenStream(t *testing.T) {
+	blob := []byte("0123456789abcdef")
+	appview := newTestAppview(t, blob, "http://127.0.0.1:1/")
+	config := testConfig(t)
+	config.AppviewURL = appview.URL
+	config.StreamSource = true
+	config.MaxConcurrentDownloads = 1
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+
+	source, closeStream, err := cm.openStream(context.Background(), "did:plc:a", "cid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(source, "http://127.0.0.1:") {
+		t.Fatalf("expected a loopback proxy URL, got %s", source)
+	}
+	if cm.downloadsInFlight.Load() != 1 {
+		t.Errorf("expected the stream to hold a download slot")
+	}
+
+	req, _ := http.NewRequest("GET", source, nil)
+	req.Header.Set("Range", "bytes=2-5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "2345" || resp.Header.Get("Content-Range") != "bytes 2-5/16" {
+		t.Fatalf("range request: got %d %q %q", resp.StatusCode, body, resp.Header.Get("Content-Range"))
+	}
+
+	// the slot is only free once the stream is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := cm.openStream(ctx, "did:plc:a", "cid"); err == nil {
+		t.Fatal("expected a second stream to wait for the download slot")
+	}
+	closeStream()
+	if cm.downloadsInFlight.Load() != 0 {
+		t.Errorf("expected closing the stream to release its download slot")
+	}
+	resp, err = http.Get(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("closed stream: got %d, expected 404", resp.StatusCode)
+	}
+}
+
+func TestSourceProxyRedirect(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer internal.Close()
+	appview := newTestAppview(t, nil, internal.URL)
+
+	var proxy sourceProxy
+	source, remove, err := proxy.add(streamedSource{url: appview.URL + "/elsewhere", guard: newBlobGuard([]string{strings.TrimPrefix(appview.URL, "http://")})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remove()
+	resp, err := http.Get(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || bytes.Contains(body, []byte("secret")) {
+		t.Fatalf("redirect to another host: got %d %q", resp.StatusCode, body)
+	}
+}
+
+// BenchmarkTimeToFirstSegment measures how long it takes from starting a
+// conversion until ffmpeg read enough of the blob for its first segment,
+// downloading it first or streaming it.
+func BenchmarkTimeToFirstSegment(b *testing.B) {
+	const blobSize = 64 << 20
+	const firstSegmentSize = 1 << 20
+	blob := make([]byte, blobSize)
+	appview := newTestAppview(b, blob, "/")
+
+	for _, stream := range []bool{false, true} {
+		name := "download"
+		if stream {
+			name = "stream"
+		}
+		b.Run(name, func(b *testing.B) {
+			config := testConfig(b)
+			config.AppviewURL = appview.URL
+			config.StreamSource = stream
+			cm := NewConversionManager(config, noopReporter{})
+			defer cm.cleanupTicker.Stop()
+			cm.runner = &fakeRunner{readInput: firstSegmentSize}
+			outputDir := b.TempDir()
+			b.SetBytes(blobSize)
+			b.ResetTimer()
+			for range b.N {
+				source, probeResult, cleanup, err := cm.openSource(context.Background(), "did:plc:a", "cid")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := cm.runFFmpeg(context.Background(), cm.hlsArgs(source, outputDir, probeResult)...); err != nil {
+					b.Fatal(err)
+				}
+				cleanup()
+			}
+			b.StopTimer()
+			if entries, _ := os.ReadDir(outputDir); len(entries) == 0 {
+				b.Fatal("expected the fake ffmpeg to write segments")
+			}
+		})
+	}
+}
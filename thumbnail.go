@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ThumbnailFormat struct {
+	Name        string
+	Extension   string
+	ContentType string
+	// ffmpeg encoder needed for this format, empty if always available
+	Encoder   string
+	CodecArgs []string
+}
+
+var (
+	thumbnailJPEG = ThumbnailFormat{
+		Name:        "jpeg",
+		Extension:   ".jpg",
+		ContentType: contentTypes[".jpg"],
+	}
+	thumbnailWebP = ThumbnailFormat{
+		Name:        "webp",
+		Extension:   ".webp",
+		ContentType: contentTypes[".webp"],
+		Encoder:     "libwebp",
+		CodecArgs:   []string{"-c:v", "libwebp"},
+	}
+	thumbnailAVIF = ThumbnailFormat{
+		Name:        "avif",
+		Extension:   ".avif",
+		ContentType: contentTypes[".avif"],
+		Encoder:     "libaom-av1",
+		CodecArgs:   []string{"-c:v", "libaom-av1", "-still-picture", "1"},
+	}
+)
+
+// thumbnailFormats in order of preference when negotiating via Accept
+var thumbnailFormats = []ThumbnailFormat{thumbnailAVIF, thumbnailWebP, thumbnailJPEG}
+
+// hasEncoder reports whether the local ffmpeg build has the given encoder.
+// The encoder list is only read from ffmpeg once.
+func (cm *ConversionManager) hasEncoder(name string) bool {
+	cm.encodersOnce.Do(func() {
+		cm.encoders = make(map[string]bool)
+		output, err := cm.runner.Output(context.Background(), "ffmpeg", "-hide_banner", "-encoders")
+		if err != nil {
+			log.Printf("Failed to list ffmpeg encoders: %s", err)
+			return
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			// lines look like " V....D libwebp   libwebp WebP image"
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				cm.encoders[fields[1]] = true
+			}
+		}
+	})
+	return cm.encoders[name]
+}
+
+var thumbnailSeeks = []string{"fast", "accurate"}
+
+// thumbnailAccurate reports whether a request wants a frame-accurate
+// thumbnail, from the seek query parameter or else THUMBNAIL_SEEK.
+func (cm *ConversionManager) thumbnailAccurate(c *gin.Context) bool {
+	switch c.Query("seek") {
+	case "accurate":
+		return true
+	case "fast":
+		return false
+	}
+	return cm.config.ThumbnailSeek == "accurate"
+}
+
+// thumbnailFormat picks the thumbnail format for a request, from the
+// format query parameter or else the Accept header. Formats whose encoder
+// is missing fall back to JPEG.
+func (cm *ConversionManager) thumbnailFormat(c *gin.Context) ThumbnailFormat {
+	available := func(format ThumbnailFormat) bool {
+		return format.Encoder == "" || cm.hasEncoder(format.Encoder)
+	}
+
+	if name := c.Query("format"); name != "" {
+		for _, format := range thumbnailFormats {
+			if format.Name == name && available(format) {
+				return format
+			}
+		}
+		return thumbnailJPEG
+	}
+
+	accept := c.GetHeader("Accept")
+	for _, format := range thumbnailFormats {
+		if strings.Contains(accept, format.ContentType) && available(format) {
+			return format
+		}
+	}
+	return thumbnailJPEG
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gonanoid "github.com/matoous/go-nanoid"
+)
+
+// resumableUpload is a video being uploaded in chunks. Chunks are appended
+// to a temp file, and once all Upload-Length bytes arrived it becomes a
+// regular job.
+type resumableUpload struct {
+	mu          sync.Mutex
+	path        string
+	userDID     string
+	token       string
+	contentType string
+	length      int64
+	offset      int64
+	// deletes the upload once it went UploadExpiry without a chunk
+	expiry *time.Timer
+}
+
+// createUpload starts a resumable upload of Upload-Length bytes. Chunks
+// are then sent with PATCH to the returned Location, and HEAD on it tells
+// how many bytes were received so that an interrupted upload can resume.
+// Both need the token of the uploader, like creating the upload.
+func (s *State) createUpload(c *gin.Context) {
+	userDID, ok := s.uploaderDID(c)
+	if !ok {
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("Upload-Length must be a positive number of bytes"))
+		return
+	}
+	if length > s.config.MaxUploadBytes {
+		c.AbortWithError(http.StatusRequestEntityTooLarge, fmt.Errorf("upload is larger than %d bytes", s.config.MaxUploadBytes))
+		return
+	}
+	// the body is only sniffed once complete
+	if err := s.checkUploadType(c.GetHeader("content-type"), nil); err != nil {
+		c.AbortWithError(http.StatusUnsupportedMediaType, err)
+		return
+	}
+
+	uploadID, err := gonanoid.Nanoid()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to generate upload id: %w", err))
+		return
+	}
+	file, err := s.config.createTemp("upload_*")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	file.Close()
+
+	upload := &resumableUpload{
+		path:        file.Name(),
+		userDID:     userDID,
+		token:       c.GetHeader("authorization"),
+		contentType: c.GetHeader("content-type"),
+		length:      length,
+	}
+	upload.expiry = time.AfterFunc(s.config.UploadExpiry, func() {
+		upload.mu.Lock()
+		defer upload.mu.Unlock()
+		if s.uploads.CompareAndDelete(uploadID, upload) {
+			log.Printf("Upload %s expired", uploadID)
+			os.Remove(upload.path)
+		}
+	})
+	s.uploads.Store(uploadID, upload)
+
+	c.Header("Location", "/uploads/"+uploadID)
+	c.Header("Upload-Offset", "0")
+	c.JSON(http.StatusCreated, gin.H{"uploadId": uploadID, "offset": 0, "length": length})
+}
+
+// lookupUpload finds the upload of the request, which must be one of the
+// authenticated user.
+func (s *State) lookupUpload(c *gin.Context) (*resumableUpload, bool) {
+	userDID := c.GetString("user_did")
+	if userDID == "" {
+		c.AbortWithError(http.StatusUnauthorized, errors.New("authentication required"))
+		return nil, false
+	}
+	uploadA, ok := s.uploads.Load(c.Param("id"))
+	// other users' uploads look like missing ones
+	if !ok || uploadA.(*resumableUpload).userDID != userDID {
+		c.AbortWithError(http.StatusNotFound, errors.New("upload not found"))
+		return nil, false
+	}
+	return uploadA.(*resumableUpload), true
+}
+
+// getUploadOffset reports how many bytes of an upload were received.
+func (s *State) getUploadOffset(c *gin.Context) {
+	upload, ok := s.lookupUpload(c)
+	if !ok {
+		return
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	c.Header("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.length, 10))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+}
+
+// uploadChunk appends the request body to an upload. Upload-Offset must
+// match the bytes received so far, so a chunk retried after a network
+// error is not appended twice. The chunk completing the upload starts its
+// job and is answered with the job status.
+func (s *State) uploadChunk(c *gin.Context) {
+	upload, ok := s.lookupUpload(c)
+	if !ok {
+		return
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, errors.New("Upload-Offset is missing"))
+		return
+	}
+	if offset != upload.offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		c.AbortWithError(http.StatusConflict, fmt.Errorf("upload is at offset %d, got %d", upload.offset, offset))
+		return
+	}
+
+	file, err := os.OpenFile(upload.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	// a client that disconnects mid chunk keeps what was received, it
+	// resumes from the offset reported by HEAD
+	written, copyErr := io.Copy(file, io.LimitReader(c.Request.Body, upload.length-upload.offset+1))
+	closeErr := file.Close()
+	var tooLarge *http.MaxBytesError
+	if errors.As(copyErr, &tooLarge) {
+		// keep what was received, the client can resume with a smaller chunk
+		upload.offset += written
+		c.Header("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		c.AbortWithError(http.StatusRequestEntityTooLarge, fmt.Errorf("chunks can be at most %d bytes", tooLarge.Limit))
+		return
+	}
+	if written > upload.length-upload.offset {
+		c.AbortWithError(http.StatusRequestEntityTooLarge, fmt.Errorf("chunk goes past Upload-Length %d", upload.length))
+		os.Truncate(upload.path, upload.offset)
+		return
+	}
+	upload.offset += written
+	upload.expiry.Reset(s.config.UploadExpiry)
+	c.Header("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	if err := errors.Join(copyErr, closeErr); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	// the token may have been refreshed during a long upload, it was
+	// verified to be of the uploader by lookupUpload
+	upload.token = c.GetHeader("authorization")
+
+	if upload.offset < upload.length {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	upload.expiry.Stop()
+	s.uploads.Delete(c.Param("id"))
+	body, err := os.ReadFile(upload.path)
+	os.Remove(upload.path)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	s.startJob(c, upload.userDID, upload.token, upload.contentType, body, "")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testUploadRouter serves the resumable upload routes, authenticating
+// requests as the DID in their X-Test-DID header.
+func testUploadRouter(s *State) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	auth := func(c *gin.Context) {
+		if did := c.GetHeader("X-Test-DID"); did != "" {
+			c.Set("user_did", did)
+		}
+	}
+	r.POST("/xrpc/pm.l4.douga.createUpload", auth, s.createUpload)
+	r.HEAD("/uploads/:id", auth, s.getUploadOffset)
+	r.PATCH("/uploads/:id", auth, s.uploadChunk)
+	return r
+}
+
+func TestUploadOwner(t *testing.T) {
+	s := &State{config: Config{WorkDir: t.TempDir(), MaxUploadBytes: 1 << 20, AllowedUploadTypes: "video/mp4", UploadExpiry: time.Hour}}
+	r := testUploadRouter(s)
+	do := func(method, path, did string, headers map[string]string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if did != "" {
+			req.Header.Set("X-Test-DID", did)
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/xrpc/pm.l4.douga.createUpload", "did:plc:owner", map[string]string{"Upload-Length": "10", "Content-Type": "video/mp4"}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("createUpload: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	t.Cleanup(func() {
+		s.uploads.Range(func(_, uploadA any) bool {
+			upload := uploadA.(*resumableUpload)
+			upload.expiry.Stop()
+			os.Remove(upload.path)
+			return true
+		})
+	})
+
+	chunk := map[string]string{"Upload-Offset": "0"}
+	if w := do("PATCH", location, "", chunk, "01234"); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous chunk: got %d, expected 401", w.Code)
+	}
+	if w := do("PATCH", location, "did:plc:other", chunk, "01234"); w.Code != http.StatusNotFound {
+		t.Errorf("chunk of another user: got %d, expected 404", w.Code)
+	}
+	if w := do("HEAD", location, "did:plc:other", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("offset for another user: got %d, expected 404", w.Code)
+	}
+	if w := do("PATCH", location, "did:plc:owner", chunk, "01234"); w.Code != http.StatusNoContent {
+		t.Fatalf("chunk of the owner: got %d %s", w.Code, w.Body)
+	}
+	if w := do("HEAD", location, "did:plc:owner", nil, ""); w.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("expected the owner's chunk only, got offset %q", w.Header().Get("Upload-Offset"))
+	}
+}
+
+// staticResolver resolves every DID to the PDS it names.
+type staticResolver string
+
+func (r staticResolver) ResolvePDS(ctx context.Context, did string) (string, error) {
+	return string(r), nil
+}
+
+func TestGetUploadLimits(t *testing.T) {
+	statuses := map[string]string{
+		"did:plc:a":         `{"did":"did:plc:a","active":true}`,
+		"did:plc:suspended": `{"did":"did:plc:suspended","active":false,"status":"suspended"}`,
+	}
+	pds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(statuses[r.URL.Query().Get("did")]))
+	}))
+	defer pds.Close()
+	store := newTestStore(t)
+	s := &State{
+		storage: &Storage{jobs: store, users: store, resolver: staticResolver(pds.URL)},
+		config:  Config{DailyByteLimit: 1000, DailyVideoLimit: 2, MaxUploadBytes: 500},
+	}
+	job := testJob("job1", "did:plc:a")
+	job.size = 300
+	if _, err := store.CreateJob(job, "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.GET("/limits", func(c *gin.Context) { c.Set("user_did", c.GetHeader("X-Test-DID")) }, s.getUploadLimits)
+
+	limitsOf := func(did string) UploadLimits {
+		req := httptest.NewRequest("GET", "/limits", nil)
+		req.Header.Set("X-Test-DID", did)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var limits UploadLimits
+		if err := json.Unmarshal(w.Body.Bytes(), &limits); err != nil {
+			t.Fatal(err)
+		}
+		return limits
+	}
+	limits := limitsOf("did:plc:a")
+	if !limits.CanUpload || *limits.RemainingDailyBytes != 700 || *limits.RemainingDailyVideos != 1 || limits.MaxUploadBytes != 500 {
+		t.Errorf("got %+v", limits)
+	}
+	limits = limitsOf("did:plc:suspended")
+	if limits.CanUpload || limits.Message == nil || *limits.Message != "Your account is suspended." {
+		t.Errorf("suspended account: got %+v", limits)
+	}
+}
+
+func TestUploadVideoTooLarge(t *testing.T) {
+	s := &State{config: Config{MaxUploadBytes: 10, AllowedUploadTypes: "video/mp4"}}
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	auth := func(c *gin.Context) { c.Set("user_did", "did:plc:a") }
+	r.POST("/xrpc/app.bsky.video.uploadVideo", auth, limitBody(s.config.MaxUploadBytes), s.uploadVideo)
+
+	for _, declared := range []bool{true, false} {
+		req := httptest.NewRequest("POST", "/xrpc/app.bsky.video.uploadVideo", strings.NewReader(strings.Repeat("a", 11)))
+		req.Header.Set("Content-Type", "video/mp4")
+		if !declared {
+			// chunked, only the reader can tell
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("upload over the limit, Content-Length declared %v: got %d", declared, w.Code)
+		}
+	}
+}
+
+func TestCheckUploadType(t *testing.T) {
+	s := &State{config: Config{AllowedUploadTypes: "video/mp4, video/webm", MaxUploadBytes: 1 << 20}}
+	mp4 := []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00isomiso2avc1mp41")
+	for _, tc := range []struct {
+		contentType string
+		body        []byte
+		ok          bool
+	}{
+		{"video/mp4", mp4, true},
+		{"video/webm; codecs=vp9", nil, true},
+		{"video/mp4", []byte("<html><body>not a video</body></html>"), false},
+		{"video/mp4", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), false},
+		{"image/png", nil, false},
+		{"application/octet-stream", mp4, false},
+		{"", nil, false},
+	} {
+		if err := s.checkUploadType(tc.contentType, tc.body); (err == nil) != tc.ok {
+			t.Errorf("%q with %d bytes: expected ok %v, got %v", tc.contentType, len(tc.body), tc.ok, err)
+		}
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	auth := func(c *gin.Context) { c.Set("user_did", "did:plc:a") }
+	r.POST("/xrpc/app.bsky.video.uploadVideo", auth, s.uploadVideo)
+	r.POST("/xrpc/pm.l4.douga.createUpload", auth, s.createUpload)
+	for path, body := range map[string]string{"/xrpc/app.bsky.video.uploadVideo": "a blob", "/xrpc/pm.l4.douga.createUpload": ""} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/zip")
+		req.Header.Set("Upload-Length", "6")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s with a disallowed type: got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/gin-gonic/gin"
+)
+
+// UserDataDeletion is what deleteUserData removed.
+type UserDataDeletion struct {
+	DID string `json:"did"`
+	// whether we had the user's PDS stored
+	User            bool  `json:"user"`
+	Jobs            int64 `json:"jobs"`
+	Pins            int   `json:"pins"`
+	Conversions     int   `json:"conversions"`
+	Thumbnails      int   `json:"thumbnails"`
+	Blobs           int   `json:"blobs"`
+	Uploads         int   `json:"uploads"`
+	RetainedSources int   `json:"retainedSources"`
+	// retained failed conversions, see FAILED_CONVERSION_RETENTION
+	Failures int `json:"failures"`
+}
+
+// adminOrUser lets requests with the admin token through as admins, and
+// authenticates the others like authGroup does.
+func adminOrUser(adminToken string, auther *Auth) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isAdmin(c, adminToken) {
+			c.Set("admin", true)
+			c.Next()
+			return
+		}
+		auther.AuthenticateGinRequestViaJWT(c)
+	}
+}
+
+// deleteUserData removes everything we keep about a DID: its stored user,
+// jobs, pins, unfinished uploads, retained sources, and cached
+// conversions, thumbnails and blobs. Users may delete their own data, the
+// admin anyone's. Nothing is deleted while the user has jobs or
+// conversions in progress, that answers 409 instead.
+func (s *State) deleteUserData(c *gin.Context) {
+	admin := c.GetBool("admin")
+	userDID := c.GetString("user_did")
+	if !admin && userDID == "" {
+		c.AbortWithError(http.StatusUnauthorized, errors.New("authentication required"))
+		return
+	}
+	did := c.Query("did")
+	if did == "" {
+		did = userDID
+	}
+	if _, err := syntax.ParseDID(did); err != nil {
+		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid did: %w", err))
+		return
+	}
+	if !admin && did != userDID {
+		c.AbortWithError(http.StatusForbidden, errors.New("users can only delete their own data"))
+		return
+	}
+
+	if s.cm.userBusy(did) {
+		c.AbortWithError(http.StatusConflict, errInvalidateRunning)
+		return
+	}
+	deleted := UserDataDeletion{DID: did}
+	jobs, blobCIDs, err := s.storage.jobs.DeleteUserJobs(did)
+	if errors.Is(err, errJobsRunning) {
+		c.AbortWithError(http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to delete jobs: %w", err))
+		return
+	}
+	deleted.Jobs = jobs
+	pinned, err := s.storage.pins.RemoveUserPins(did)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to delete pins: %w", err))
+		return
+	}
+	deleted.Pins = len(pinned)
+	for _, cid := range pinned {
+		s.cm.pinned.Delete(fmt.Sprintf("%s/%s", did, cid))
+	}
+	deleted.User, err = s.storage.users.DeleteUser(did)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to delete user: %w", err))
+		return
+	}
+
+	deleted.Uploads = s.deleteUserUploads(did)
+	deleted.RetainedSources = s.deleteRetainedSources(did)
+	var cids []string
+	deleted.Conversions, deleted.Thumbnails, cids = s.cm.deleteUserCache(did)
+	deleted.Blobs = s.cm.deleteUserBlobs(did, append(blobCIDs, cids...))
+	deleted.Failures = s.cm.deleteUserFailures(did)
+	c.JSON(http.StatusOK, deleted)
+}
+
+// userBusy reports whether a conversion or thumbnail of did is running or
+// queued.
+func (cm *ConversionManager) userBusy(did string) bool {
+	busy := false
+	cm.conversions.Range(func(keyA, convA any) bool {
+		if !strings.HasPrefix(keyA.(string), did+"/") {
+			return true
+		}
+		conv := convA.(*Conversion)
+		conv.mu.Lock()
+		busy = conv.Converting || conv.queued
+		conv.mu.Unlock()
+		return !busy
+	})
+	prefix := thumbnailKeyPrefix(did, "")
+	cm.thumbnails.Range(func(keyA, thumbA any) bool {
+		if busy || !strings.HasPrefix(keyA.(string), prefix) {
+			return !busy
+		}
+		thumb := thumbA.(*Thumbnail)
+		thumb.mu.Lock()
+		busy = thumb.Generating
+		thumb.mu.Unlock()
+		return !busy
+	})
+	return busy
+}
+
+// deleteUserCache removes the conversions and thumbnails of did, like
+// flush, returning how many of each it removed and the CIDs of their
+// videos. Those started since userBusy are left alone.
+func (cm *ConversionManager) deleteUserCache(did string) (conversions, thumbnails int, cids []string) {
+	now := time.Now()
+	dirsToRemove := make([]string, 0)
+	cm.conversions.Range(func(keyA, convA any) bool {
+		key := keyA.(string)
+		rest, ok := strings.CutPrefix(key, did+"/")
+		if !ok {
+			return true
+		}
+		conv := convA.(*Conversion)
+		if cm.removeConversion(key, conv, now) {
+			dirsToRemove = append(dirsToRemove, conv.OutputDir)
+			conversions++
+			cid, _, _ := strings.Cut(rest, "/")
+			cids = append(cids, cid)
+		}
+		return true
+	})
+	prefix := thumbnailKeyPrefix(did, "")
+	cm.thumbnails.Range(func(keyA, thumbA any) bool {
+		key := keyA.(string)
+		if !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		thumb := thumbA.(*Thumbnail)
+		if cm.removeThumbnail(key, thumb, now) {
+			dirsToRemove = append(dirsToRemove, filepath.Dir(thumb.Path))
+			thumbnails++
+		}
+		return true
+	})
+	for _, dir := range dirsToRemove {
+		os.RemoveAll(dir)
+	}
+	return conversions, thumbnails, cids
+}
+
+// deleteUserBlobs removes the cached blobs among cids, and the local
+// uploads of did, returning how many it removed.
+func (cm *ConversionManager) deleteUserBlobs(did string, cids []string) int {
+	removed := 0
+	if cm.blobCache != nil {
+		seen := make(map[string]bool)
+		for _, cid := range cids {
+			if seen[cid] {
+				continue
+			}
+			seen[cid] = true
+			if ok, _ := cm.blobCache.remove(cid); ok {
+				removed++
+			}
+		}
+	}
+	if cm.config.UploadMode == "local" {
+		dir := filepath.Join(cm.config.WorkDir, "local", did)
+		if entries, err := os.ReadDir(dir); err == nil {
+			removed += len(entries)
+		}
+		os.RemoveAll(dir)
+	}
+	return removed
+}
+
+// deleteUserUploads cancels the unfinished resumable uploads of did,
+// returning how many there were.
+func (s *State) deleteUserUploads(did string) int {
+	removed := 0
+	s.uploads.Range(func(idA, uploadA any) bool {
+		upload := uploadA.(*resumableUpload)
+		upload.mu.Lock()
+		defer upload.mu.Unlock()
+		if upload.userDID == did && s.uploads.CompareAndDelete(idA, upload) {
+			upload.expiry.Stop()
+			os.Remove(upload.path)
+			removed++
+		}
+		return true
+	})
+	return removed
+}
+
+// deleteRetainedSources removes the retained sources of the failed jobs
+// of did, returning how many there were.
+func (s *State) deleteRetainedSources(did string) int {
+	removed := 0
+	s.failedSources.Range(func(idA, sourceA any) bool {
+		source := sourceA.(*retainedSource)
+		if source.did == did && s.failedSources.CompareAndDelete(idA, source) {
+			os.Remove(source.path)
+			removed++
+		}
+		return true
+	})
+	return removed
+}
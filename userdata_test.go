@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDeleteUserCacheThumbnails(t *testing.T) {
+	s, _ := newTestState(t, testConfig(t), &fakeRunner{})
+	// DIDs may contain underscores, and share a prefix
+	const did, other = "did:web:a_b", "did:web:a_b_c"
+	for _, owner := range []string{did, other} {
+		if _, err := s.cm.getOrCreateThumbnail(owner, "cid", thumbnailJPEG, thumbnailAt, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, thumbnails, _ := s.cm.deleteUserCache(did); thumbnails != 1 {
+		t.Fatalf("expected 1 thumbnail deleted, got %d", thumbnails)
+	}
+	if _, ok := s.cm.lookupThumbnail(other, "cid", thumbnailJPEG, thumbnailAt, false); !ok {
+		t.Error("expected the thumbnails of another DID sharing a prefix to be kept")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// watermarkPositions maps WATERMARK_POSITION to the overlay coordinates
+// of the watermark, 16 pixels off the edges.
+var watermarkPositions = map[string]string{
+	"top-left":     "16:16",
+	"top-right":    "main_w-overlay_w-16:16",
+	"bottom-left":  "16:main_h-overlay_h-16",
+	"bottom-right": "main_w-overlay_w-16:main_h-overlay_h-16",
+	"center":       "(main_w-overlay_w)/2:(main_h-overlay_h)/2",
+}
+
+// the watermark is read by the movie filter, inside a filtergraph where
+// quoting paths would need several levels of escaping
+var watermarkPath = regexp.MustCompile(`^[A-Za-z0-9/._-]+$`)
+
+// checkWatermark validates the WATERMARK_* settings, if a watermark is set.
+func (config Config) checkWatermark() error {
+	if config.Watermark == "" {
+		return nil
+	}
+	if !watermarkPath.MatchString(config.Watermark) {
+		return fmt.Errorf("WATERMARK can only contain letters, digits and /._-, got %q", config.Watermark)
+	}
+	info, err := os.Stat(config.Watermark)
+	if err != nil {
+		return fmt.Errorf("failed to read WATERMARK: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("WATERMARK %s is not a file", config.Watermark)
+	}
+	if _, ok := watermarkPositions[config.WatermarkPosition]; !ok {
+		return fmt.Errorf("invalid WATERMARK_POSITION %q, expected top-left, top-right, bottom-left, bottom-right or center", config.WatermarkPosition)
+	}
+	if config.WatermarkOpacity < 1 || config.WatermarkOpacity > 100 {
+		return fmt.Errorf("WATERMARK_OPACITY must be between 1 and 100, got %d", config.WatermarkOpacity)
+	}
+	return nil
+}
+
+// videoFilterGraph joins filters into the -vf graph of a video, with the
+// WATERMARK overlaid on top of them if set. Empty when there is nothing
+// to filter.
+func (cm *ConversionManager) videoFilterGraph(filters []string) string {
+	chain := strings.Join(filters, ",")
+	if cm.config.Watermark == "" {
+		return chain
+	}
+	base := "[in]"
+	graph := []string{cm.watermarkSource()}
+	if chain != "" {
+		graph = append(graph, "[in]"+chain+"[base]")
+		base = "[base]"
+	}
+	return strings.Join(append(graph, base+"[wm]"+cm.watermarkOverlay()+"[out]"), ";")
+}
+
+// watermarkSource is the filtergraph chain reading the watermark into
+// the [wm] label, at WATERMARK_OPACITY.
+func (cm *ConversionManager) watermarkSource() string {
+	source := "movie=" + cm.config.Watermark + ",format=rgba"
+	if cm.config.WatermarkOpacity < 100 {
+		source += fmt.Sprintf(",colorchannelmixer=aa=%.2f", float64(cm.config.WatermarkOpacity)/100)
+	}
+	return source + "[wm]"
+}
+
+// watermarkOverlay is the overlay filter putting the watermark at
+// WATERMARK_POSITION, its inputs are the video then the watermark.
+func (cm *ConversionManager) watermarkOverlay() string {
+	return "overlay=" + watermarkPositions[cm.config.WatermarkPosition]
+}
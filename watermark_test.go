@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckWatermark(t *testing.T) {
+	dir := t.TempDir()
+	logo := filepath.Join(dir, "logo.png")
+	if err := os.WriteFile(logo, []byte("a logo"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	valid := Config{Watermark: logo, WatermarkPosition: "bottom-right", WatermarkOpacity: 80}
+	if err := valid.checkWatermark(); err != nil {
+		t.Errorf("valid watermark: %v", err)
+	}
+	if err := (Config{}).checkWatermark(); err != nil {
+		t.Errorf("no watermark: %v", err)
+	}
+	for name, change := range map[string]func(*Config){
+		"missing":       func(c *Config) { c.Watermark = filepath.Join(dir, "missing.png") },
+		"directory":     func(c *Config) { c.Watermark = dir },
+		"quoted path":   func(c *Config) { c.Watermark = dir + "/logo'.png" },
+		"position":      func(c *Config) { c.WatermarkPosition = "middle" },
+		"opacity":       func(c *Config) { c.WatermarkOpacity = 0 },
+		"opacity above": func(c *Config) { c.WatermarkOpacity = 101 },
+	} {
+		config := valid
+		change(&config)
+		if err := config.checkWatermark(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestWatermarkFilter(t *testing.T) {
+	config := testConfig(t)
+	cm := NewConversionManager(config, noopReporter{})
+	t.Cleanup(cm.cleanupTicker.Stop)
+	if graph := argAfter(cm.hlsArgs("input.mp4", t.TempDir(), nil), "-vf"); strings.Contains(graph, "overlay") {
+		t.Errorf("expected no overlay without WATERMARK, got %q", graph)
+	}
+
+	cm.config.Watermark = "/etc/douga/logo.png"
+	cm.config.WatermarkPosition = "top-left"
+	cm.config.WatermarkOpacity = 50
+	graph := argAfter(cm.hlsArgs("input.mp4", t.TempDir(), nil), "-vf")
+	want := "movie=/etc/douga/logo.png,format=rgba,colorchannelmixer=aa=0.50[wm];[in]format=yuv420p[base];[base][wm]overlay=16:16[out]"
+	if graph != want {
+		t.Errorf("expected -vf %q, got %q", want, graph)
+	}
+
+	// renditions are overlaid once, before the split
+	cm.config.Renditions = []VideoRendition{{Name: "720p", Width: 1280, Height: 720}, {Name: "360p", Width: 640, Height: 360}}
+	graph = argAfter(cm.hlsArgs("input.mp4", t.TempDir(), nil), "-filter_complex")
+	if strings.Count(graph, "overlay=16:16") != 1 || !strings.Contains(graph, "[0:v:0][wm]overlay=16:16,split=2") {
+		t.Errorf("expected one overlay before the split, got %q", graph)
+	}
+}